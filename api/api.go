@@ -1,10 +1,15 @@
 package api
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/achung3071/gpcoin/blockchain"
 	"github.com/achung3071/gpcoin/p2p"
@@ -35,8 +40,69 @@ type postPeersBody struct {
 
 // Request for /transactions endpoint
 type postTransactionsBody struct {
-	To     string `json:"to"`
-	Amount int    `json:"amount"`
+	To      string               `json:"to"` // single recipient, if outputs is not given
+	Amount  int                  `json:"amount"`
+	Outputs []blockchain.Payment `json:"outputs"` // recipients paid by the same transaction
+
+	blockchain.TxOptions // fee (0 if not given) and coin selection
+}
+
+// Request for /multisig endpoint
+type postMultisigBody struct {
+	Required   int      `json:"required"`   // number of signatures needed
+	PublicKeys []string `json:"publicKeys"` // addresses of the keyholders
+}
+
+// Response for /multisig endpoints
+type multisigResponse struct {
+	Script     string               `json:"script"` // multisig address to pay to (as a script)
+	Required   int                  `json:"required"`
+	PublicKeys []string             `json:"publicKeys"`
+	Balance    int                  `json:"balance"`
+	Outputs    []*blockchain.UTxOut `json:"outputs"`
+}
+
+// Request for /multisig/spends endpoint
+type postMultisigSpendBody struct {
+	Script string `json:"script"` // multisig script of the outputs to spend
+
+	postTransactionsBody // recipients and options (inputs are outputs of the script)
+}
+
+// Request for /multisig/spends/sign endpoint
+type postSignMultisigBody struct {
+	blockchain.MultisigSpend
+
+	PublicKey string `json:"publicKey"` // keyholder of a signature made elsewhere (our wallet if not given)
+	Signature string `json:"signature"`
+}
+
+// Request for /htlc endpoint
+type postHTLCBody struct {
+	Recipient string `json:"recipient"` // address that can claim it
+	Amount    int    `json:"amount"`
+	LockTime  int    `json:"lockTime"` // block height from which we can refund it
+	Hash      string `json:"hash"`     // SHA-256 of the secret (a new secret is made if not given)
+
+	blockchain.TxOptions // fee and coin selection of the transaction locking the coins
+}
+
+// Response for /htlc endpoint
+type postHTLCResponse struct {
+	*blockchain.HTLC
+
+	Secret string `json:"secret,omitempty"` // preimage of the hash, if it was made for the request
+}
+
+// Request for /htlc/{txId}/{index}/claim and /htlc/{txId}/{index}/refund endpoints
+type postHTLCSpendBody struct {
+	Preimage string `json:"preimage"` // claims only
+	Fee      int    `json:"fee"`
+}
+
+// Request for /transactions/{txId}/bump endpoint
+type postBumpFeeBody struct {
+	Fee int `json:"fee"` // new fee of the transaction
 }
 
 type urlDescription struct {
@@ -130,9 +196,25 @@ func block(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Get the block at a specific height of the main chain
+func blockByHeight(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	block, err := (*blockchain.Block)(nil), blockchain.ErrBlockNotFound
+	// route only matches digits, so Atoi only fails for heights that are too large
+	if height, convErr := strconv.Atoi(vars["height"]); convErr == nil {
+		block, err = blockchain.FindBlockByHeight(blockchain.Blockchain(), height)
+	}
+	if err == blockchain.ErrBlockNotFound {
+		rw.WriteHeader(404)
+		json.NewEncoder(rw).Encode(errResponse{fmt.Sprint(err)})
+	} else {
+		json.NewEncoder(rw).Encode(block)
+	}
+}
+
 // Check the current mempool
 func mempool(rw http.ResponseWriter, r *http.Request) {
-	utils.ErrorHandler(json.NewEncoder(rw).Encode(blockchain.Mempool().Txs))
+	utils.ErrorHandler(json.NewEncoder(rw).Encode(blockchain.MempoolInfo(blockchain.Mempool())))
 }
 
 // Get list of peers (GET) | Add a new peer via websocket (POST)
@@ -146,7 +228,11 @@ func peers(rw http.ResponseWriter, r *http.Request) {
 		utils.ErrorHandler(err)
 		myPort := port[1:] // remove ":"
 		// broadcast is true b/c peer added via API request (not broadcasted yet)
-		p2p.AddPeer(data.Address, data.Port, myPort, true)
+		if err := p2p.AddPeer(data.Address, data.Port, myPort, true); err != nil {
+			rw.WriteHeader(http.StatusConflict)
+			json.NewEncoder(rw).Encode(errResponse{err.Error()})
+			return
+		}
 		rw.WriteHeader(http.StatusCreated)
 	default:
 		rw.WriteHeader(http.StatusMethodNotAllowed)
@@ -158,17 +244,35 @@ func status(rw http.ResponseWriter, r *http.Request) {
 	blockchain.Status(blockchain.Blockchain(), rw)
 }
 
+// Send the circulating and maximum supply of coins
+func supply(rw http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(rw).Encode(blockchain.Supply(blockchain.Blockchain()))
+}
+
+// Read the body of a request for a new transaction
+func decodeTxRequest(r *http.Request) postTransactionsBody {
+	var data postTransactionsBody
+	json.NewDecoder(r.Body).Decode(&data) // get data
+	data.setDefaultOutputs()
+	return data
+}
+
+// Pay the single recipient of a request if it does not list its outputs
+func (data *postTransactionsBody) setDefaultOutputs() {
+	if len(data.Outputs) == 0 {
+		data.Outputs = []blockchain.Payment{{To: data.To, Amount: data.Amount}}
+	}
+}
+
 // Add a new transaction to mempool
 func transactions(rw http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
-		var data postTransactionsBody
-		json.NewDecoder(r.Body).Decode(&data) // get data
+		data := decodeTxRequest(r)
 		// Add the new transaction to the blockchain mempool
-		tx, err := blockchain.Mempool().AddTx(data.To, data.Amount)
+		tx, err := blockchain.Mempool().AddTx(data.Outputs, data.TxOptions)
 		if err != nil {
-			rw.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(rw).Encode(errResponse{err.Error()})
+			writeTxError(rw, err)
 			return
 		}
 		p2p.BroadcastNewTx(tx)             // send new tx to all peers
@@ -176,6 +280,219 @@ func transactions(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Make and sign a transaction without adding it to the mempool (e.g., to send it later)
+func signTransaction(rw http.ResponseWriter, r *http.Request) {
+	data := decodeTxRequest(r)
+	tx, err := blockchain.SignTx(data.Outputs, data.TxOptions)
+	if err != nil {
+		writeTxError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(tx)
+}
+
+// Add a signed transaction (e.g., from /transactions/sign) to the mempool
+func rawTransaction(rw http.ResponseWriter, r *http.Request) {
+	tx := &blockchain.Tx{}
+	if err := json.NewDecoder(r.Body).Decode(tx); err != nil {
+		writeTxError(rw, err)
+		return
+	}
+	// same checks as a transaction relayed by a peer
+	if err := blockchain.Mempool().AddTxFromPeer(tx); err != nil {
+		writeTxError(rw, err)
+		return
+	}
+	p2p.BroadcastNewTx(tx)
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// Replace one of our mempool transactions with one paying a higher fee
+func bumpFee(rw http.ResponseWriter, r *http.Request) {
+	var data postBumpFeeBody
+	json.NewDecoder(r.Body).Decode(&data)
+	tx, err := blockchain.Mempool().BumpFee(mux.Vars(r)["txId"], data.Fee)
+	if err != nil {
+		writeTxError(rw, err)
+		return
+	}
+	p2p.BroadcastNewTx(tx) // peers allowing replace-by-fee replace the original as well
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(tx)
+}
+
+// Respond with why a transaction could not be made or added to the mempool
+func writeTxError(rw http.ResponseWriter, err error) {
+	rw.WriteHeader(http.StatusBadRequest)
+	var rejection *blockchain.TxRejectError
+	if errors.As(err, &rejection) {
+		json.NewEncoder(rw).Encode(rejection) // reason the mempool did not accept it
+	} else {
+		json.NewEncoder(rw).Encode(errResponse{err.Error()})
+	}
+}
+
+// Get a Merkle proof that a transaction is in a block of the main chain
+func txProof(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	proof, err := blockchain.TxProof(blockchain.Blockchain(), vars["txId"])
+	if err == blockchain.ErrTxNotFound {
+		rw.WriteHeader(404)
+		json.NewEncoder(rw).Encode(errResponse{fmt.Sprint(err)})
+	} else {
+		utils.ErrorHandler(err)
+		json.NewEncoder(rw).Encode(proof)
+	}
+}
+
+// Send the keys and unspent outputs of a multisig script
+func writeMultisig(rw http.ResponseWriter, lockingScript string) {
+	required, publicKeys, err := blockchain.ParseMultisigScript(lockingScript)
+	if err != nil {
+		writeTxError(rw, err)
+		return
+	}
+	outputs := blockchain.UTxOutsByScript(lockingScript, blockchain.Blockchain())
+	balance := 0
+	for _, output := range outputs {
+		balance += output.Amount
+	}
+	json.NewEncoder(rw).Encode(multisigResponse{lockingScript, required, publicKeys, balance, outputs})
+}
+
+// Make a multisig script (address) from the keys of its keyholders
+func multisig(rw http.ResponseWriter, r *http.Request) {
+	var data postMultisigBody
+	json.NewDecoder(r.Body).Decode(&data)
+	lockingScript, err := blockchain.MultisigScript(data.Required, data.PublicKeys)
+	if err != nil {
+		writeTxError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+	writeMultisig(rw, lockingScript)
+}
+
+// Get the keys, balance and unspent outputs of a multisig script
+func multisigByScript(rw http.ResponseWriter, r *http.Request) {
+	writeMultisig(rw, mux.Vars(r)["script"])
+}
+
+// Build an unsigned spend of the outputs of a multisig script
+func multisigSpends(rw http.ResponseWriter, r *http.Request) {
+	var data postMultisigSpendBody
+	json.NewDecoder(r.Body).Decode(&data)
+	data.setDefaultOutputs()
+	spend, err := blockchain.MakeMultisigSpend(data.Script, data.Outputs, data.TxOptions)
+	if err != nil {
+		writeTxError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(spend)
+}
+
+// Add the signature of our wallet (or one made elsewhere) to a multisig spend
+func signMultisigSpend(rw http.ResponseWriter, r *http.Request) {
+	var data postSignMultisigBody
+	json.NewDecoder(r.Body).Decode(&data)
+	spend := &data.MultisigSpend
+	var err error
+	if data.PublicKey != "" {
+		err = spend.AddSignature(data.PublicKey, data.Signature)
+	} else {
+		err = blockchain.SignMultisigSpend(spend)
+	}
+	if err != nil {
+		writeTxError(rw, err)
+		return
+	}
+	json.NewEncoder(rw).Encode(spend)
+}
+
+// Add a multisig spend with enough signatures to the mempool and send it to peers
+func broadcastMultisigSpend(rw http.ResponseWriter, r *http.Request) {
+	spend := &blockchain.MultisigSpend{}
+	json.NewDecoder(r.Body).Decode(spend)
+	tx, err := blockchain.Mempool().AddMultisigSpend(spend)
+	if err != nil {
+		writeTxError(rw, err)
+		return
+	}
+	p2p.BroadcastNewTx(tx)
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(tx)
+}
+
+// Lock coins from our wallet in an HTLC
+func htlc(rw http.ResponseWriter, r *http.Request) {
+	var data postHTLCBody
+	json.NewDecoder(r.Body).Decode(&data)
+	secret := ""
+	if data.Hash == "" {
+		preimage := make([]byte, 32)
+		_, err := rand.Read(preimage)
+		utils.ErrorHandler(err)
+		secret = hex.EncodeToString(preimage)
+		hash := sha256.Sum256(preimage)
+		data.Hash = hex.EncodeToString(hash[:])
+	}
+	tx, h, err := blockchain.Mempool().AddHTLC(data.Hash, data.Recipient, data.LockTime, data.Amount, data.TxOptions)
+	if err != nil {
+		writeTxError(rw, err)
+		return
+	}
+	p2p.BroadcastNewTx(tx)
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(postHTLCResponse{h, secret})
+}
+
+// Read the output of an HTLC request (an index too large for an int is -1, which is not an output)
+func htlcOutPoint(r *http.Request) (string, int) {
+	vars := mux.Vars(r)
+	index, err := strconv.Atoi(vars["index"])
+	if err != nil {
+		index = -1
+	}
+	return vars["txId"], index
+}
+
+// Get an HTLC, with whether it was claimed (and the preimage its claim revealed) or refunded
+func htlcByOutPoint(rw http.ResponseWriter, r *http.Request) {
+	txId, index := htlcOutPoint(r)
+	h, err := blockchain.FindHTLC(blockchain.Blockchain(), txId, index)
+	if err == blockchain.ErrTxNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(errResponse{err.Error()})
+	} else if err != nil {
+		writeTxError(rw, err)
+	} else {
+		json.NewEncoder(rw).Encode(h)
+	}
+}
+
+// Claim an HTLC sent to us (POST .../claim with its preimage) | Refund one we sent (POST .../refund)
+func spendHTLC(rw http.ResponseWriter, r *http.Request) {
+	var data postHTLCSpendBody
+	json.NewDecoder(r.Body).Decode(&data)
+	txId, index := htlcOutPoint(r)
+	var tx *blockchain.Tx
+	var err error
+	if mux.Vars(r)["action"] == "claim" {
+		tx, err = blockchain.Mempool().ClaimHTLC(txId, index, data.Preimage, data.Fee)
+	} else {
+		tx, err = blockchain.Mempool().RefundHTLC(txId, index, data.Fee)
+	}
+	if err != nil {
+		writeTxError(rw, err)
+		return
+	}
+	p2p.BroadcastNewTx(tx)
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(tx)
+}
+
 // Returns address of wallet used by this node
 func walletAddress(rw http.ResponseWriter, r *http.Request) {
 	address := wallet.Wallet().Address
@@ -193,10 +510,24 @@ func Start(portNum int) {
 	router.HandleFunc("/balance/{address}", balance).Methods("GET")
 	router.HandleFunc("/blocks", blocks).Methods("GET", "POST")
 	router.HandleFunc("/blocks/{hash:[a-f0-9]+}", block).Methods("GET")
+	router.HandleFunc("/blocks/height/{height:[0-9]+}", blockByHeight).Methods("GET")
+	router.HandleFunc("/htlc", htlc).Methods("POST")
+	router.HandleFunc("/htlc/{txId:[a-f0-9]+}/{index:[0-9]+}", htlcByOutPoint).Methods("GET")
+	router.HandleFunc("/htlc/{txId:[a-f0-9]+}/{index:[0-9]+}/{action:claim|refund}", spendHTLC).Methods("POST")
 	router.HandleFunc("/mempool", mempool).Methods("GET")
+	router.HandleFunc("/multisig", multisig).Methods("POST")
+	router.HandleFunc("/multisig/{script:[a-f0-9]+}", multisigByScript).Methods("GET")
+	router.HandleFunc("/multisig/spends", multisigSpends).Methods("POST")
+	router.HandleFunc("/multisig/spends/sign", signMultisigSpend).Methods("POST")
+	router.HandleFunc("/multisig/spends/broadcast", broadcastMultisigSpend).Methods("POST")
 	router.HandleFunc("/peers", peers).Methods("GET", "POST")
 	router.HandleFunc("/status", status).Methods("GET")
+	router.HandleFunc("/supply", supply).Methods("GET")
 	router.HandleFunc("/transactions", transactions).Methods("POST")
+	router.HandleFunc("/transactions/sign", signTransaction).Methods("POST")
+	router.HandleFunc("/transactions/raw", rawTransaction).Methods("POST")
+	router.HandleFunc("/transactions/{txId:[a-f0-9]+}/bump", bumpFee).Methods("POST")
+	router.HandleFunc("/transactions/{txId:[a-f0-9]+}/proof", txProof).Methods("GET")
 	router.HandleFunc("/wallet-address", walletAddress).Methods("GET")
 	router.HandleFunc("/ws", p2p.Upgrade).Methods("GET")
 
@@ -31,29 +31,119 @@ func Documentation(rw http.ResponseWriter, r *http.Request) {
 			Description: "Get a specific block",
 			Payload:     "",
 		},
+		{
+			URL:         url("/blocks/height/{height}"),
+			Method:      "GET",
+			Description: "Get the block at a height of the main chain",
+			Payload:     "",
+		},
 		{
 			URL:         url("/status"),
 			Method:      "GET",
 			Description: "Check status of blockchain",
 			Payload:     "",
 		},
+		{
+			URL:         url("/supply"),
+			Method:      "GET",
+			Description: "Get the circulating and maximum supply of coins",
+			Payload:     "",
+		},
 		{
 			URL:         url("/balance/{address}"),
 			Method:      "GET",
-			Description: "Get transaction outputs or balance(?total=true) at address",
+			Description: "Get spendable transaction outputs (including unconfirmed ones) or balance(?total=true) at address",
 			Payload:     "",
 		},
+		{
+			URL:         url("/htlc"),
+			Method:      "POST",
+			Description: "Lock coins in an HTLC the recipient can claim with the secret, refundable from the lock height (makes a secret if no hash is given)",
+			Payload:     "{recipient: string, amount: int, lockTime: int, hash?: string, fee?: int, coinSelection?: string}",
+		},
+		{
+			URL:         url("/htlc/{txId}/{index}"),
+			Method:      "GET",
+			Description: "Get an HTLC and whether it was claimed (with the secret its claim revealed) or refunded",
+			Payload:     "",
+		},
+		{
+			URL:         url("/htlc/{txId}/{index}/claim"),
+			Method:      "POST",
+			Description: "Claim an HTLC sent to our wallet with its secret",
+			Payload:     "{preimage: string, fee?: int}",
+		},
+		{
+			URL:         url("/htlc/{txId}/{index}/refund"),
+			Method:      "POST",
+			Description: "Refund an HTLC sent from our wallet, once the next block is at its lock height",
+			Payload:     "{fee?: int}",
+		},
 		{
 			URL:         url("/mempool"),
 			Method:      "GET",
-			Description: "Get the current mempool",
+			Description: "Get the current mempool, its size and counts of evicted/expired transactions",
+			Payload:     "",
+		},
+		{
+			URL:         url("/multisig"),
+			Method:      "POST",
+			Description: "Make a multisig script (address) needing signatures by required of the keys",
+			Payload:     "{required: int, publicKeys: [string]}",
+		},
+		{
+			URL:         url("/multisig/{script}"),
+			Method:      "GET",
+			Description: "Get the keys, balance and spendable transaction outputs of a multisig script",
 			Payload:     "",
 		},
+		{
+			URL:         url("/multisig/spends"),
+			Method:      "POST",
+			Description: "Build an unsigned spend of outputs of a multisig script, with change back to the script",
+			Payload:     "{script: string, ...} with the rest as in POST /transactions",
+		},
+		{
+			URL:         url("/multisig/spends/sign"),
+			Method:      "POST",
+			Description: "Add the signature of our wallet (or of another keyholder, if given) to a multisig spend",
+			Payload:     "spend (e.g., from /multisig/spends), with {publicKey: string, signature: string} for a signature made elsewhere",
+		},
+		{
+			URL:         url("/multisig/spends/broadcast"),
+			Method:      "POST",
+			Description: "Add a multisig spend with enough signatures to the mempool and send it to peers",
+			Payload:     "spend (e.g., from /multisig/spends/sign)",
+		},
 		{
 			URL:         url("/transactions"),
 			Method:      "POST",
 			Description: "Post a new transaction to the mempool",
-			Payload:     "{to: string, amount: int}",
+			Payload:     "{to: string, amount: int, fee?: int, coinSelection?: string, inputs?: [{txId: string, index: int}], changeAddress?: string, lockTime?: int} or {outputs: [{to: string, amount: int, script?: string}], ...}",
+		},
+		{
+			URL:         url("/transactions/sign"),
+			Method:      "POST",
+			Description: "Make and sign a transaction without adding it to the mempool (e.g., locked until a later block)",
+			Payload:     "same as POST /transactions",
+		},
+		{
+			URL:         url("/transactions/raw"),
+			Method:      "POST",
+			Description: "Add a signed transaction to the mempool and send it to peers",
+			Payload:     "transaction (e.g., from /transactions/sign)",
+		},
+		{
+			URL:         url("/transactions/{txId}/bump"),
+			Method:      "POST",
+			Description: "Replace one of our mempool transactions with one paying a higher fee (needs -rbf)",
+			Payload:     "{fee: int}",
+		},
+		{
+			URL:         url("/transactions/{txId}/proof"),
+			Method:      "GET",
+			Description: "Get a Merkle proof that a transaction is in a block",
+			Payload:     "",
 		},
 		{
 			URL:         url("/wallet-address"),
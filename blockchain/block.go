@@ -2,7 +2,6 @@ package blockchain
 
 import (
 	"errors"
-	"strings"
 	"time"
 
 	"github.com/achung3071/gpcoin/utils"
@@ -11,8 +10,9 @@ import (
 type Block struct {
 	Hash         string `json:"hash"`
 	PrevHash     string `json:"prevHash,omitempty"`
+	MerkleRoot   string `json:"merkleRoot"` // commits to every transaction in the block
 	Height       int    `json:"height"`
-	Difficulty   int    `json:"difficulty"`
+	Bits         int    `json:"bits"` // compact target the hash must not be above
 	Nonce        int    `json:"nonce"`
 	Timestamp    int    `json:"timestamp"`
 	Transactions []*Tx  `json:"transactions"`
@@ -20,6 +20,25 @@ type Block struct {
 
 var ErrBlockNotFound error = errors.New("Block with given hash not found")
 
+// Reasons for rejecting a block received from a peer
+var (
+	ErrInvalidPrevHash   error = errors.New("block does not build on the newest block in the chain")
+	ErrInvalidHeight     error = errors.New("block height is not one more than the newest block")
+	ErrInvalidDifficulty error = errors.New("block was not mined at the expected difficulty")
+	ErrInvalidPoW        error = errors.New("block hash does not match its data or difficulty")
+	ErrInvalidCoinbase   error = errors.New("block must start with a single coinbase for its height paying at most the block subsidy and fees")
+	ErrMalformedBlock    error = errors.New("block or one of its transactions is missing data")
+	ErrBlockTooLarge     error = errors.New("block transactions are larger than the maximum block size")
+	ErrInvalidMerkleRoot error = errors.New("block merkle root does not match its transactions")
+	ErrEmptyChain        error = errors.New("chain does not have any blocks")
+	ErrInvalidGenesis    error = errors.New("chain does not start with the genesis block of this network")
+	ErrStaleTimestamp    error = errors.New("block timestamp is not after the median timestamp of the blocks before it")
+	ErrFutureTimestamp   error = errors.New("block timestamp is too far ahead of our clock")
+)
+
+// How far ahead of our clock a block timestamp can be (clocks of nodes are never quite the same)
+const maxFutureBlockTime int = 2 * 60 * 60
+
 // NON-MUTATING FUNCTIONS
 // Save block in DB
 func commitBlock(b *Block) {
@@ -27,22 +46,30 @@ func commitBlock(b *Block) {
 }
 
 // Create a new block (mine and add mempool transactions)
-func createBlock(prevHash string, height int, diff int) *Block {
+func createBlock(prevHash string, height int, bits int) *Block {
+	recent := recentBlocks(prevHash)
 	// Initialize every new block added to chain w/ a coinbase transaction
 	newBlock := &Block{
-		Hash:       "",
-		PrevHash:   prevHash,
-		Height:     height,
-		Difficulty: diff,
-		Nonce:      0,
+		Hash:      "",
+		PrevHash:  prevHash,
+		Height:    height,
+		Bits:      bits,
+		Nonce:     0,
+		Timestamp: minTimestampAfter(recent),
 	}
 	// flush mempool and get confirmed transactions
-	newBlock.Transactions = Mempool().ConfirmTxs()
+	newBlock.Transactions = Mempool().ConfirmTxs(lockPointAfter(recent))
 	newBlock.mine() // provide PoW
 	commitBlock(newBlock)
 	return newBlock
 }
 
+// Hash the block header. Transactions are only included through the Merkle root,
+// so the hash is the same size of work no matter how many transactions there are.
+func (b *Block) calculateHash() string {
+	return hashEncoding(b.encodeHeader())
+}
+
 // Find block from DB based on hash
 func FindBlock(hash string) (*Block, error) {
 	blockBytes := dbStorage.FindBlock(hash)
@@ -54,14 +81,151 @@ func FindBlock(hash string) (*Block, error) {
 	return block, nil
 }
 
+// Check that the block hash belongs to the block data and is at most its target
+func (b *Block) hasValidPoW() bool {
+	target := targetFromBits(b.Bits)
+	if target == nil {
+		return false
+	}
+	return b.Hash == b.calculateHash() && meetsTarget(b.Hash, target)
+}
+
+// Check every block of a chain from another node (newest block first),
+// going from the genesis block up to the newest block
+func validateChain(blocks []*Block) error {
+	if len(blocks) == 0 {
+		return ErrEmptyChain
+	}
+	if genesis := blocks[len(blocks)-1]; genesis == nil || genesis.Hash != params.GenesisHash {
+		return ErrInvalidGenesis
+	}
+	uTxOuts := newUTxOutSet()
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if err := validateHeader(blocks[i], blocks[i+1:]); err != nil {
+			return err
+		}
+		if err := validateBlockTxs(blocks[i].Transactions, lockPointAfter(blocks[i+1:]), uTxOuts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the earliest timestamp a block after the given chain of blocks (newest block first) can have
+func minTimestampAfter(blocks []*Block) int {
+	return medianTimePast(blocks) + 1
+}
+
+// Check that a block links to the newest of the given blocks (newest block first, or none for
+// the genesis block), has a timestamp after the median timestamp of the blocks before it but
+// not too far in the future, has valid proof of work, and has well-formed transactions
+// matching its Merkle root. Retargeting and time locks read block timestamps, so they must
+// not be set at will by the miner.
+func validateHeader(block *Block, recent []*Block) error {
+	if block == nil {
+		return ErrMalformedBlock
+	}
+	prevHash, prevHeight := "", 0
+	if len(recent) > 0 {
+		prevHash, prevHeight = recent[0].Hash, recent[0].Height
+	}
+	// Cheap checks of the header first, so blocks without valid proof of work are
+	// rejected before going through their transactions
+	if block.PrevHash != prevHash {
+		return ErrInvalidPrevHash
+	}
+	if block.Height != prevHeight+1 {
+		return ErrInvalidHeight
+	}
+	if block.Bits != bitsAfter(recent) {
+		return ErrInvalidDifficulty
+	}
+	if block.Timestamp < minTimestampAfter(recent) {
+		return ErrStaleTimestamp
+	}
+	if block.Timestamp > int(time.Now().Unix())+maxFutureBlockTime {
+		return ErrFutureTimestamp
+	}
+	if !block.hasValidPoW() {
+		return ErrInvalidPoW
+	}
+	seenTxIds := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if !tx.isWellFormed() || seenTxIds[tx.Id] {
+			return ErrMalformedBlock
+		}
+		seenTxIds[tx.Id] = true
+	}
+	if blockSize(block.Transactions) > params.MaxBlockSize {
+		return ErrBlockTooLarge
+	}
+	if block.MerkleRoot != merkleRoot(txIds(block.Transactions)) {
+		return ErrInvalidMerkleRoot
+	}
+	return nil
+}
+
+// Check the coinbase and every other transaction in a block at the given lock point (whose
+// height was already checked), spending the outputs in uTxOuts as the transactions are validated
+func validateBlockTxs(txs []*Tx, at lockPoint, uTxOuts *uTxOutSet) error {
+	height := at.height
+	if len(txs) == 0 || !isCoinbase(txs[0]) {
+		return ErrInvalidCoinbase
+	}
+	coinbase := txs[0]
+	if coinbase.TxIns[0].Index != height {
+		return ErrInvalidCoinbase
+	}
+	uTxOuts.apply(coinbase)
+	fees := 0
+	for _, tx := range txs[1:] {
+		if isCoinbase(tx) { // only one coinbase allowed per block
+			return ErrInvalidCoinbase
+		}
+		if !tx.isFinal(at) {
+			return ErrTxLockTime
+		}
+		fee, err := validateTx(tx, uTxOuts)
+		if err != nil {
+			return err
+		}
+		fees += fee
+		uTxOuts.apply(tx)
+	}
+	// the miner can claim less than this, but any fees left unclaimed are gone for good
+	if !paysAtMost(coinbase, blockSubsidy(height)+fees) {
+		return ErrInvalidCoinbase
+	}
+	return nil
+}
+
+// Checks that the outputs of a transaction are positive and add up to at most amount
+func paysAtMost(tx *Tx, amount int) bool {
+	remaining := amount // subtract one output at a time so huge amounts cannot overflow
+	for _, txOut := range tx.TxOuts {
+		if txOut.Amount <= 0 || txOut.Amount > remaining {
+			return false
+		}
+		remaining -= txOut.Amount
+	}
+	return true
+}
+
 // MUTATING FUNCTIONS
-// Give proof of work (find nonce) to add block to blockchain
+// Give proof of work (find nonce) to add block to blockchain. The block is timestamped with
+// the current time, or with its timestamp before mining if that is later (e.g., the earliest
+// timestamp it can have when blocks come faster than once a second).
 func (b *Block) mine() {
-	target := strings.Repeat("0", b.Difficulty) // num. zeros hash must start with
+	b.MerkleRoot = merkleRoot(txIds(b.Transactions)) // header commits to the transactions
+	target := targetFromBits(b.Bits)                 // number the hash cannot be above
+	minTimestamp := b.Timestamp
 	for {
 		b.Timestamp = int(time.Now().Unix())
-		hash := utils.Hash(b)
-		if strings.HasPrefix(hash, target) {
+		if b.Timestamp < minTimestamp {
+			b.Timestamp = minTimestamp
+		}
+		hash := b.calculateHash()
+		if meetsTarget(hash, target) {
 			b.Hash = hash
 			break
 		} else {
@@ -10,9 +10,11 @@ import (
 func TestCreateBlock(t *testing.T) {
 	oldStorage := dbStorage
 	defer func() { dbStorage = oldStorage }()
-	dbStorage = mockDB{}
-	Mempool().Txs["test"] = &Tx{}
-	b := createBlock("x", 1, 1)
+	dbStorage = newFakeDB()
+	genesis := (&blockchain{}).addGenesisBlock()
+	tx := makeTestTx(genesis.Transactions[0], params.MinerReward)
+	setTestMempool(tx)
+	b := createBlock(genesis.Hash, 2, params.MaxBits)
 	t.Run("createBlock() should return a block", func(t *testing.T) {
 		if reflect.TypeOf(b) != reflect.TypeOf(&Block{}) {
 			t.Error("createBlock() did not return an instance of a block")
@@ -25,6 +27,44 @@ func TestCreateBlock(t *testing.T) {
 	})
 }
 
+// Storage checking that confirmed transactions only leave the saved mempool
+// once the chain state with their block is saved
+type confirmingDB struct {
+	*fakeDB
+	t *testing.T
+}
+
+func (c confirmingDB) SaveMempool(changes map[string][]byte) {
+	for id, data := range changes {
+		if data == nil && c.FindTxLocation(id) == nil {
+			c.t.Errorf("Transaction '%s' left the saved mempool before its block was saved", id)
+		}
+	}
+	c.fakeDB.SaveMempool(changes)
+}
+
+func TestAddBlock(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	storage := newFakeDB()
+	dbStorage = confirmingDB{storage, t}
+	defer setTestMempool()
+	bc := &blockchain{}
+	genesis := bc.addGenesisBlock()
+	tx := makeTestTx(genesis.Transactions[0], params.MinerReward)
+	setTestMempool(tx)
+	Mempool().unsaved[tx.Id] = true
+	Mempool().save()
+
+	block := bc.AddBlock()
+	if len(block.Transactions) != 2 || bc.LastHash != block.Hash {
+		t.Fatalf("Expected a new block with the mempool transaction, got %d transactions", len(block.Transactions))
+	}
+	if len(storage.mempool) != 0 {
+		t.Errorf("Expected the confirmed transaction to leave the saved mempool, got %d transactions", len(storage.mempool))
+	}
+}
+
 func TestFindBlock(t *testing.T) {
 	oldStorage := dbStorage
 	defer func() { dbStorage = oldStorage }()
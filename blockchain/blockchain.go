@@ -2,6 +2,8 @@ package blockchain
 
 import (
 	"encoding/json"
+	"errors"
+	"math/big"
 	"net/http"
 	"sync"
 
@@ -10,17 +12,22 @@ import (
 )
 
 const (
-	defaultDifficulty      int = 2
-	updateIntervalInBlocks int = 5 // how often we should update difficulty
-	expectedMinsPerBlock   int = 2 // num. mins expected for a block to be created
-	updateWindowInMins     int = 2 // difficulty changes only when actual - expected time exceeds this window
+	indexVersion int = 3 // increase when indexes saved with the chain (e.g., UTXO set) change
 )
 
+// Location of a transaction in the main chain (saved in the tx index)
+type txLocation struct {
+	BlockHash string
+	Position  int // index of the tx in the block's transactions
+}
+
 type blockchain struct {
-	LastHash       string
-	Height         int
-	CurrDifficulty int
-	m              sync.Mutex
+	LastHash     string
+	Height       int
+	CurrBits     int      // compact target of the newest block
+	TotalWork    *big.Int `json:"chainWork"` // sum of the work of every block in the main chain
+	IndexVersion int      `json:"-"`         // indexVersion when the indexes were last rebuilt
+	m            sync.Mutex
 }
 
 // Storage interface as an adapter for different storage types
@@ -28,15 +35,29 @@ type blockchain struct {
 type storage interface {
 	FindBlock(hash string) []byte
 	SaveBlock(hash string, data []byte)
-	EmptyBlocks()
-	SaveBlockchain(data []byte)
 	LoadBlockchain() []byte
+	SaveChainState(state db.ChainState)
+	FindUTxOut(key string) []byte
+	LoadUTxOuts() map[string][]byte
+	LoadUTxOutsOf(owner string) map[string][]byte
+	FindTxLocation(txId string) []byte
+	FindBlockHash(height int) string
+	SaveMempool(changes map[string][]byte)
+	LoadMempool() map[string][]byte
 }
 
 var b *blockchain                   // Holds singleton instance of blockchain
 var dbStorage storage = db.BoltDB{} // Layer for interacting w/ storage
 var once sync.Once
 
+var ErrUnknownParent error = errors.New("block builds on a block we do not have")
+var ErrNotEnoughWork error = errors.New("chain does not have more work than our chain")
+var ErrForkTooDeep error = errors.New("block is on a side branch leaving the main chain too far below its newest block")
+
+// Side branches leaving the main chain further below its newest block are refused,
+// so that cheap blocks building on old blocks cannot fill the db
+var maxForkDepth int = 100
+
 // NON-MUTATING FUNCTIONS
 // Only function that should be used to access the blockchain (b).
 func Blockchain() *blockchain {
@@ -47,16 +68,42 @@ func Blockchain() *blockchain {
 		}
 		chainData := dbStorage.LoadBlockchain()
 		if chainData == nil { // blockchain not in db
-			// ensure AddBlock() does not call Blockchain() again,
+			b.IndexVersion = indexVersion // indexes are built as blocks are added
+			// ensure addGenesisBlock() does not call Blockchain() again,
 			// or else it will result in a deadlock (circularity)
-			b.AddBlock()
+			b.addGenesisBlock()
 		} else {
 			b.restore(chainData)
+			// before anything is written to the db, which might be of another network
+			if b.savedGenesisHash() != params.GenesisHash {
+				utils.ErrorHandler(ErrInvalidGenesis)
+			}
+			if b.TotalWork == nil { // saved before work was tracked
+				b.TotalWork = chainWork(blocksFrom(b.LastHash))
+			}
+			if b.IndexVersion < indexVersion { // saved before the current indexes existed
+				b.Reindex()
+			}
+			// transactions that were waiting for a block before the restart
+			Mempool().load(lockPointAfter(recentBlocks(b.LastHash)))
 		}
 	})
 	return b
 }
 
+// Get the hash of the first block of the saved main chain, from the height index if it is
+// up to date (or else by walking back the chain, as the index might not have it yet)
+func (b *blockchain) savedGenesisHash() string {
+	if b.IndexVersion >= indexVersion {
+		return dbStorage.FindBlockHash(1)
+	}
+	blocks := blocksFrom(b.LastHash)
+	if len(blocks) == 0 {
+		return ""
+	}
+	return blocks[len(blocks)-1].Hash
+}
+
 // Get sum of all transaction outputs for an address
 func BalanceByAddress(address string, b *blockchain) int {
 	txOuts := UTxOutsByAddress(address, b)
@@ -71,67 +118,163 @@ func BalanceByAddress(address string, b *blockchain) int {
 func Blocks(b *blockchain) []*Block {
 	b.m.Lock()
 	defer b.m.Unlock()
+	return blocksFrom(b.LastHash)
+}
+
+// Get all blocks from the given hash back to the genesis block
+// (does not lock the blockchain, so it can be used while adding blocks)
+func blocksFrom(hash string) []*Block {
 	var blocks []*Block
-	currHash := b.LastHash
-	for {
+	currHash := hash
+	for currHash != "" {
 		block, err := FindBlock(currHash)
 		utils.ErrorHandler(err)
 		blocks = append(blocks, block)
-		if block.PrevHash != "" { // not the first block
-			currHash = block.PrevHash
-		} else {
-			break
-		}
+		currHash = block.PrevHash // empty for the first block
 	}
 	return blocks
 }
 
-// Save blockchain to DB
-func commitBlockchain(b *blockchain) {
-	dbStorage.SaveBlockchain(utils.ToBytes(b))
+// Get the expected number of hashes needed to mine a block, 2^256 / (target + 1)
+func blockWork(block *Block) *big.Int {
+	target := targetFromBits(block.Bits)
+	if target == nil {
+		return big.NewInt(0)
+	}
+	maxHash := new(big.Int).Lsh(big.NewInt(1), 256)
+	return maxHash.Div(maxHash, target.Add(target, big.NewInt(1)))
 }
 
-// Get difficulty of blockchain (i.e., how many 0s need to be in front of block hash)
-func getDifficulty(b *blockchain) int {
+// Get the total work of the main chain
+func ChainWork(b *blockchain) *big.Int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return new(big.Int).Set(b.TotalWork)
+}
+
+// Get the total work needed to mine a list of blocks
+func chainWork(blocks []*Block) *big.Int {
+	total := big.NewInt(0)
+	for _, block := range blocks {
+		total.Add(total, blockWork(block))
+	}
+	return total
+}
+
+// Save blockchain to DB along with the changes to its unspent transaction outputs
+// and to the tx/height indexes for the blocks that left or joined the main chain
+func commitChainState(b *blockchain, uTxOuts *uTxOutSet, disconnected, connected []*Block) {
+	dbStorage.SaveChainState(chainState(b, uTxOuts, disconnected, connected))
+}
+
+// Get the changes to save for commitChainState()
+func chainState(b *blockchain, uTxOuts *uTxOutSet, disconnected, connected []*Block) db.ChainState {
+	state := db.ChainState{
+		Blockchain:   utils.ToBytes(b),
+		UTxOuts:      uTxOuts.encodedChanges(),
+		OwnedUTxOuts: uTxOuts.encodedChangesByOwner(),
+		TxLocations:  make(map[string][]byte),
+		BlockHashes:  make(map[int][]byte),
+	}
+	// Remove disconnected blocks first, so that connected blocks overwrite them
+	for _, block := range disconnected {
+		for _, tx := range block.Transactions {
+			state.TxLocations[tx.Id] = nil
+		}
+		state.BlockHashes[block.Height] = nil
+	}
+	for _, block := range connected {
+		for position, tx := range block.Transactions {
+			state.TxLocations[tx.Id] = utils.ToBytes(txLocation{block.Hash, position})
+		}
+		state.BlockHashes[block.Height] = []byte(block.Hash)
+	}
+	return state
+}
+
+// Get compact target of the next block (i.e., the number its hash cannot be above)
+func getBits(b *blockchain) int {
 	if b.Height == 0 {
 		// no blocks yet
-		return defaultDifficulty
-	} else if b.Height%5 == 0 {
+		return params.DefaultBits
+	} else if b.Height%params.UpdateIntervalInBlocks == 0 {
 		// Time to recalculate & update difficulty!
-		return recalculateDifficulty(b)
+		return retarget(recentBlocks(b.LastHash), b.CurrBits)
 	} else {
-		// 5 blocks not added since last update, so don't update
-		return b.CurrDifficulty
+		// UpdateIntervalInBlocks blocks not added since last update, so don't update
+		return b.CurrBits
 	}
 }
 
 // Find a particular transaction in the blockchain
 func FindTx(b *blockchain, txId string) *Tx {
-	txs := Txs(b)
-	for _, tx := range txs {
-		if tx.Id == txId {
-			return tx
-		}
+	b.m.Lock()
+	defer b.m.Unlock()
+	return findTx(txId)
+}
+
+// Find a transaction in the main chain using the tx index
+// (does not lock the blockchain, so it can be used while adding blocks)
+func findTx(txId string) *Tx {
+	data := dbStorage.FindTxLocation(txId)
+	if data == nil {
+		return nil
 	}
-	return nil
+	var location txLocation
+	utils.FromBytes(&location, data)
+	block, err := FindBlock(location.BlockHash)
+	if err != nil {
+		return nil
+	}
+	return block.Transactions[location.Position]
+}
+
+// Find the block at a height of the main chain using the height index
+func FindBlockByHeight(b *blockchain, height int) (*Block, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	hash := dbStorage.FindBlockHash(height)
+	if hash == "" {
+		return nil, ErrBlockNotFound
+	}
+	return FindBlock(hash)
 }
 
-// Calculates difficulty based on whether time taken to create 5 blocks is
-// too long (> 12 mins) or too short (< 8 mins)
-func recalculateDifficulty(b *blockchain) int {
-	blocks := Blocks(b)
+// Get compact target of the block after the given chain of blocks (newest block first)
+func bitsAfter(blocks []*Block) int {
+	if len(blocks) == 0 {
+		return params.DefaultBits
+	}
 	newestBlock := blocks[0]
-	lastUpdatedBlock := blocks[updateIntervalInBlocks-1]
-	// convert from seconds -> minutes
-	timeSinceLastUpdate := (newestBlock.Timestamp - lastUpdatedBlock.Timestamp) / 60
-	expectedTime := updateIntervalInBlocks * expectedMinsPerBlock
-	if timeSinceLastUpdate < expectedTime-updateWindowInMins {
-		return b.CurrDifficulty + 1 // increase difficulty
-	} else if timeSinceLastUpdate > expectedTime+updateWindowInMins {
-		return b.CurrDifficulty - 1 // lower difficulty
-	} else {
-		return b.CurrDifficulty
+	if newestBlock.Height%params.UpdateIntervalInBlocks == 0 {
+		return retarget(blocks, newestBlock.Bits)
 	}
+	return newestBlock.Bits
+}
+
+// Scales the target by how long the most recent blocks took compared to the expected time,
+// so blocks that came twice as fast get a target half as big (twice the work)
+func retarget(blocks []*Block, currBits int) int {
+	if params.NoRetargeting {
+		return currBits
+	}
+	newestBlock := blocks[0]
+	lastUpdatedBlock := blocks[params.UpdateIntervalInBlocks-1]
+	actualSecs := newestBlock.Timestamp - lastUpdatedBlock.Timestamp
+	// time between the oldest and newest block is UpdateIntervalInBlocks-1 blocks
+	expectedSecs := (params.UpdateIntervalInBlocks - 1) * params.ExpectedMinsPerBlock * 60
+	if actualSecs < expectedSecs/params.MaxRetargetFactor {
+		actualSecs = expectedSecs / params.MaxRetargetFactor
+	} else if actualSecs > expectedSecs*params.MaxRetargetFactor {
+		actualSecs = expectedSecs * params.MaxRetargetFactor
+	}
+	target := targetFromBits(currBits)
+	target.Mul(target, big.NewInt(int64(actualSecs)))
+	target.Div(target, big.NewInt(int64(expectedSecs)))
+	if maxTarget := targetFromBits(params.MaxBits); target.Cmp(maxTarget) > 0 {
+		target = maxTarget
+	}
+	return bitsFromTarget(target)
 }
 
 // Encode blockchain metadata into response writer (used in /status endpoint)
@@ -150,41 +293,126 @@ func Txs(b *blockchain) []*Tx {
 	return txs
 }
 
-// Get unspent transaction outputs (i.e., still valid for use as inputs) filtered by address
+// Get unspent transaction outputs (i.e., still valid for use as inputs) filtered by address,
+// including outputs of mempool transactions and leaving out outputs spent in the mempool
 func UTxOutsByAddress(address string, b *blockchain) []*UTxOut {
-	var uTxOuts []*UTxOut                       // holds unspent TxOuts by this address
-	txsWithSpentTxOuts := make(map[string]bool) // transactions which created spent TxOuts
-	for _, block := range Blocks(b) {
-		for _, tx := range block.Transactions {
-			for _, txIn := range tx.TxIns {
-				if txIn.Signature == "COINBASE" {
-					break // no need to look for previous txOut, just skip
-				}
-				// If transaction is initiated by address in question
-				if FindTx(Blockchain(), txIn.TxId).TxOuts[txIn.Index].Address == address {
-					// Earlier transaction (txIn.TxId) has an output that is now spent
-					txsWithSpentTxOuts[txIn.TxId] = true
-				}
-			}
-			for idx, txOut := range tx.TxOuts {
-				if txOut.Address == address {
-					// Is this txOut spent (i.e., has the transaction generated a spent output)?
-					outputSpent := txsWithSpentTxOuts[tx.Id]
-					if !outputSpent { // output has yet to be spent
-						uTxOut := UTxOut{
-							TxId:   tx.Id,
-							Index:  idx,
-							Amount: txOut.Amount,
-						}
-						// Ensure output is not part of a pending tx (i.e., not on mempool)
-						if !isOnMempool(uTxOut) {
-							uTxOuts = append(uTxOuts, &uTxOut)
-						}
-					}
-					break // no other txOuts in this transaction belong to this address
-				}
-			}
+	return uTxOutsOwnedBy(addressOwner(address), b)
+}
+
+// Get unspent transaction outputs locked by a script (see UTxOutsByAddress())
+func UTxOutsByScript(lockingScript string, b *blockchain) []*UTxOut {
+	return uTxOutsOwnedBy(scriptOwner(lockingScript), b)
+}
+
+// Get unspent transaction outputs of an owner (see spendableUTxOuts())
+func uTxOutsOwnedBy(owner string, b *blockchain) []*UTxOut {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return Mempool().spendableUTxOuts(owner)
+}
+
+// Walk back from two blocks until both sides reach the same block, returning
+// the blocks that are only on side A and only on side B (newest block first)
+func forkBlocks(hashA, hashB string) ([]*Block, []*Block) {
+	var sideA, sideB []*Block
+	blockA, blockB := findChainBlock(hashA), findChainBlock(hashB)
+	for blockA != nil || blockB != nil {
+		if blockA != nil && blockB != nil && blockA.Hash == blockB.Hash {
+			break // common ancestor
 		}
+		if blockB == nil || (blockA != nil && blockA.Height >= blockB.Height) {
+			sideA = append(sideA, blockA)
+			blockA = findChainBlock(blockA.PrevHash)
+		} else {
+			sideB = append(sideB, blockB)
+			blockB = findChainBlock(blockB.PrevHash)
+		}
+	}
+	return sideA, sideB
+}
+
+// Checks if our main chain has more work than the chain ending at a block we have
+func (b *blockchain) HasMoreWork(hash string) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if _, err := FindBlock(hash); err != nil {
+		return false
+	}
+	ours, theirs := forkBlocks(b.LastHash, hash)
+	return chainWork(ours).Cmp(chainWork(theirs)) > 0
+}
+
+// Split a chain from another node (newest block first, down to the genesis block) at the
+// newest block it shares with our main chain, returning our blocks and their blocks above
+// it (newest block first) like forkBlocks(), without needing their blocks to be saved
+func (b *blockchain) forkFromMainChain(blocks []*Block) ([]*Block, []*Block) {
+	for i, block := range blocks {
+		if dbStorage.FindBlockHash(block.Height) == block.Hash {
+			ourSide, _ := forkBlocks(b.LastHash, block.Hash)
+			return ourSide, blocks[:i]
+		}
+	}
+	return nil, blocks // not reached once validateChain() checked the genesis block
+}
+
+// Get how far below the newest block of the main chain the chain ending at a block we have
+// leaves it (0 for the newest block). The walk back stops once it is deeper than maxForkDepth.
+func (b *blockchain) forkDepth(hash string) int {
+	for {
+		block := findChainBlock(hash)
+		depth := b.Height - block.Height
+		if depth > maxForkDepth || dbStorage.FindBlockHash(block.Height) == block.Hash {
+			return depth
+		}
+		hash = block.PrevHash
+	}
+}
+
+// Get a block in a chain we have (nil for the hash before the genesis block)
+func findChainBlock(hash string) *Block {
+	if hash == "" {
+		return nil
+	}
+	block, err := FindBlock(hash)
+	utils.ErrorHandler(err)
+	return block
+}
+
+// Get transactions (except coinbases) from blocks that left the main chain,
+// oldest first, so they can be returned to the mempool
+func orphanedTxs(blocks []*Block) []*Tx {
+	var txs []*Tx
+	for i := len(blocks) - 1; i >= 0; i-- {
+		txs = append(txs, blocks[i].Transactions[1:]...)
+	}
+	return txs
+}
+
+// Get the most recent blocks (enough to retarget and to check lock times, see
+// medianTimePast()) of the chain ending at the given hash
+func recentBlocks(hash string) []*Block {
+	count := params.UpdateIntervalInBlocks
+	if count < medianTimeBlocks {
+		count = medianTimeBlocks
+	}
+	var blocks []*Block
+	for block := findChainBlock(hash); block != nil && len(blocks) < count; {
+		blocks = append(blocks, block)
+		block = findChainBlock(block.PrevHash)
+	}
+	return blocks
+}
+
+// Get unspent transaction outputs of the chain ending at the given hash, by rolling the
+// saved UTXO set of the main chain back to where the chains split and applying the other side
+func (b *blockchain) uTxOutSetAt(hash string) *uTxOutSet {
+	uTxOuts := savedUTxOutSet()
+	mainSide, otherSide := forkBlocks(b.LastHash, hash)
+	for _, block := range mainSide { // newest block first
+		uTxOuts.disconnect(block)
+	}
+	for i := len(otherSide) - 1; i >= 0; i-- { // oldest block first
+		uTxOuts.connect(otherSide[i])
 	}
 	return uTxOuts
 }
@@ -192,49 +420,128 @@ func UTxOutsByAddress(address string, b *blockchain) []*UTxOut {
 // MUTATING FUNCTIONS
 // Adds a new block to the blockchain & save in DB
 func (b *blockchain) AddBlock() *Block {
-	newBlock := createBlock(b.LastHash, b.Height+1, getDifficulty(b))
-	b.LastHash = newBlock.Hash
-	b.Height = newBlock.Height
-	// newBlock.Difficulty already updated using Blockchain().difficulty()
-	b.CurrDifficulty = newBlock.Difficulty
-	commitBlockchain(b)
+	b.m.Lock()
+	defer b.m.Unlock()
+	newBlock := createBlock(b.LastHash, b.Height+1, getBits(b))
+	b.extend(newBlock)
+	Mempool().saveConfirmed()
 	return newBlock
 }
 
-// Adds a new block broadcasted by a peer
-func (b *blockchain) AddBlockFromPeer(block *Block) {
+// Start an empty blockchain with the genesis block of the network
+func (b *blockchain) addGenesisBlock() *Block {
 	b.m.Lock()
 	defer b.m.Unlock()
-	m.m.Lock()
-	defer m.m.Unlock()
+	genesis := genesisBlock(params)
+	commitBlock(genesis)
+	b.extend(genesis)
+	return genesis
+}
 
-	b.Height += 1
+// Make a saved block (on top of the newest block) the newest block of the main chain
+func (b *blockchain) extend(block *Block) {
 	b.LastHash = block.Hash
-	b.CurrDifficulty = block.Difficulty
-	commitBlockchain(b)
-	commitBlock(block)
+	b.Height = block.Height
+	// block.Bits already updated using getBits()
+	b.CurrBits = block.Bits
+	if b.TotalWork == nil {
+		b.TotalWork = big.NewInt(0)
+	}
+	b.TotalWork.Add(b.TotalWork, blockWork(block))
+	uTxOuts := savedUTxOutSet()
+	uTxOuts.connect(block)
+	commitChainState(b, uTxOuts, nil, []*Block{block})
+}
 
-	// Remove txs in new block from mempool
-	for _, tx := range block.Transactions {
-		_, ok := m.Txs[tx.Id]
-		if ok {
-			delete(m.Txs, tx.Id)
-		}
+// Adds a new block broadcasted by a peer (rejected if it breaks consensus rules).
+// Blocks on a side branch are kept, and become the main chain once the branch has more work.
+// Side branches leaving the main chain more than maxForkDepth blocks below its newest block
+// are refused.
+func (b *blockchain) AddBlockFromPeer(block *Block) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if block == nil {
+		return ErrMalformedBlock
+	}
+	if _, err := FindBlock(block.Hash); err == nil {
+		return nil // already have this block
+	}
+	if block.PrevHash == "" {
+		return ErrInvalidGenesis // genesis block of another chain
+	}
+	if _, err := FindBlock(block.PrevHash); err != nil {
+		return ErrUnknownParent
+	}
+	if b.forkDepth(block.PrevHash) > maxForkDepth {
+		return ErrForkTooDeep
 	}
+	// The header (e.g., proof of work) is checked before the UTXO set is rolled back to the
+	// previous block, which is the costliest step, so that junk blocks are rejected cheaply
+	recent := recentBlocks(block.PrevHash)
+	if err := validateHeader(block, recent); err != nil {
+		return err
+	}
+	uTxOuts := b.uTxOutSetAt(block.PrevHash)
+	if err := validateBlockTxs(block.Transactions, lockPointAfter(recent), uTxOuts); err != nil {
+		return err
+	}
+	commitBlock(block)
+	mainSide, branchSide := forkBlocks(b.LastHash, block.Hash)
+	if chainWork(branchSide).Cmp(chainWork(mainSide)) > 0 {
+		// validateBlockTxs() applied the block, so uTxOuts are the outputs of the branch
+		b.reorganize(mainSide, branchSide, uTxOuts)
+	}
+	return nil
 }
 
-// Replace blockchain with new set of blocks from another node
-func (b *blockchain) Replace(blocks []*Block) {
+// Replace blockchain with new set of blocks from another node (newest block first).
+// The whole chain is validated first, so our blocks are untouched if it is invalid,
+// and it only becomes the main chain (and is saved) if it has more work than ours.
+func (b *blockchain) Replace(blocks []*Block) error {
+	if err := validateChain(blocks); err != nil {
+		return err
+	}
 	b.m.Lock()
 	defer b.m.Unlock()
-	b.LastHash = blocks[0].Hash
-	b.CurrDifficulty = blocks[0].Difficulty
-	b.Height = len(blocks)
-	commitBlockchain(b)
-	dbStorage.EmptyBlocks()
-	for _, block := range blocks {
+	ourSide, theirSide := b.forkFromMainChain(blocks)
+	if chainWork(theirSide).Cmp(chainWork(ourSide)) <= 0 {
+		return ErrNotEnoughWork
+	}
+	for _, block := range theirSide {
 		commitBlock(block)
 	}
+	b.reorganize(ourSide, theirSide, b.uTxOutSetAt(blocks[0].Hash))
+	return nil
+}
+
+// Move the main chain from the disconnected blocks to the connected blocks
+// (both newest block first, above their common ancestor), saving the UTXO set
+// of the new chain. Transactions from the disconnected blocks go back to the
+// mempool if they are still valid.
+func (b *blockchain) reorganize(disconnected, connected []*Block, uTxOuts *uTxOutSet) {
+	newTip := connected[0]
+	b.LastHash = newTip.Hash
+	b.Height = newTip.Height
+	b.CurrBits = newTip.Bits
+	b.TotalWork = new(big.Int).Sub(b.TotalWork, chainWork(disconnected))
+	b.TotalWork.Add(b.TotalWork, chainWork(connected))
+	commitChainState(b, uTxOuts, disconnected, connected)
+	Mempool().update(orphanedTxs(disconnected), uTxOuts, lockPointAfter(recentBlocks(newTip.Hash)))
+}
+
+// Rebuild the UTXO set and tx/height indexes from the main chain in the blocks bucket
+func (b *blockchain) Reindex() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	uTxOuts := newUTxOutSet() // saved outputs are removed when resetting
+	blocks := blocksFrom(b.LastHash)
+	for i := len(blocks) - 1; i >= 0; i-- { // oldest block first
+		uTxOuts.connect(blocks[i])
+	}
+	b.IndexVersion = indexVersion
+	state := chainState(b, uTxOuts, nil, blocks)
+	state.Reset = true
+	dbStorage.SaveChainState(state)
 }
 
 // Load existing data into blockchain variable
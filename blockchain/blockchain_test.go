@@ -1,16 +1,32 @@
 package blockchain
 
 import (
+	"os"
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/achung3071/gpcoin/db"
 	"github.com/achung3071/gpcoin/utils"
+	"github.com/achung3071/gpcoin/wallet"
 )
 
 type mockDB struct {
 	mockLoadBlockchain func() []byte
 	mockFindBlock      func(hash string) []byte
+	mockFindTxLocation func(txId string) []byte
+	mockFindBlockHash  func(height int) string
+}
+
+// Tests run on mainnet rules, with a genesis block paying the test wallet so that it can be spent
+func TestMain(m *testing.M) {
+	p := mainnetParams
+	p.GenesisAddress = wallet.Wallet().Address
+	p, err := MineGenesis(p)
+	utils.ErrorHandler(err)
+	utils.ErrorHandler(SetParams(p))
+	os.Exit(m.Run())
 }
 
 func (m mockDB) FindBlock(hash string) []byte {
@@ -20,8 +36,182 @@ func (m mockDB) LoadBlockchain() []byte {
 	return m.mockLoadBlockchain()
 }
 func (mockDB) SaveBlock(hash string, data []byte) {}
-func (mockDB) SaveBlockchain(data []byte)         {}
-func (mockDB) EmptyBlocks()                       {}
+func (m mockDB) FindTxLocation(txId string) []byte {
+	return m.mockFindTxLocation(txId)
+}
+func (mockDB) SaveChainState(state db.ChainState)     {}
+func (mockDB) FindUTxOut(key string) []byte           { return nil }
+func (mockDB) LoadUTxOuts() map[string][]byte         { return nil }
+func (mockDB) LoadUTxOutsOf(string) map[string][]byte { return nil }
+func (mockDB) SaveMempool(map[string][]byte)          {}
+func (mockDB) LoadMempool() map[string][]byte         { return nil }
+func (m mockDB) FindBlockHash(height int) string {
+	if m.mockFindBlockHash == nil {
+		return ""
+	}
+	return m.mockFindBlockHash(height)
+}
+
+// In-memory storage for tests that need saved blocks to be found again
+type fakeDB struct {
+	blocks      map[string][]byte
+	chainData   []byte
+	uTxOuts     map[string][]byte
+	owned       map[string]map[string][]byte // owner -> "txId:index" -> unspent tx output
+	txLocations map[string][]byte
+	blockHashes map[int][]byte
+	mempool     map[string][]byte
+}
+
+func newFakeDB() *fakeDB {
+	f := &fakeDB{blocks: make(map[string][]byte), mempool: make(map[string][]byte)}
+	f.resetIndexes()
+	return f
+}
+func (f *fakeDB) resetIndexes() {
+	f.uTxOuts = make(map[string][]byte)
+	f.owned = make(map[string]map[string][]byte)
+	f.txLocations = make(map[string][]byte)
+	f.blockHashes = make(map[int][]byte)
+}
+func (f *fakeDB) FindBlock(hash string) []byte {
+	return f.blocks[hash]
+}
+func (f *fakeDB) LoadBlockchain() []byte {
+	return f.chainData
+}
+func (f *fakeDB) SaveBlock(hash string, data []byte) {
+	f.blocks[hash] = data
+}
+func (f *fakeDB) SaveChainState(state db.ChainState) {
+	if state.Reset {
+		f.resetIndexes()
+	}
+	f.chainData = state.Blockchain
+	putAll(f.uTxOuts, state.UTxOuts)
+	for owner, changes := range state.OwnedUTxOuts {
+		if f.owned[owner] == nil {
+			f.owned[owner] = make(map[string][]byte)
+		}
+		putAll(f.owned[owner], changes)
+		if len(f.owned[owner]) == 0 {
+			delete(f.owned, owner)
+		}
+	}
+	putAll(f.txLocations, state.TxLocations)
+	for height, hash := range state.BlockHashes {
+		if hash == nil {
+			delete(f.blockHashes, height)
+		} else {
+			f.blockHashes[height] = hash
+		}
+	}
+}
+func (f *fakeDB) FindTxLocation(txId string) []byte {
+	return f.txLocations[txId]
+}
+func (f *fakeDB) FindBlockHash(height int) string {
+	return string(f.blockHashes[height])
+}
+
+// Put (or delete, for nil data) every entry into a map
+func putAll(entries map[string][]byte, changes map[string][]byte) {
+	for key, data := range changes {
+		if data == nil {
+			delete(entries, key)
+		} else {
+			entries[key] = data
+		}
+	}
+}
+func (f *fakeDB) FindUTxOut(key string) []byte {
+	return f.uTxOuts[key]
+}
+func (f *fakeDB) LoadUTxOuts() map[string][]byte {
+	return f.uTxOuts
+}
+func (f *fakeDB) LoadUTxOutsOf(owner string) map[string][]byte {
+	return f.owned[owner]
+}
+
+// Check that the outputs indexed by owner are exactly the saved UTXO set
+func (f *fakeDB) ownersMatchUTxOuts() bool {
+	expected := make(map[string]map[string][]byte)
+	for key, data := range f.uTxOuts {
+		txOut := &TxOut{}
+		utils.FromBytes(txOut, data)
+		if expected[txOut.owner()] == nil {
+			expected[txOut.owner()] = make(map[string][]byte)
+		}
+		expected[txOut.owner()][key] = data
+	}
+	return reflect.DeepEqual(f.owned, expected)
+}
+func (f *fakeDB) SaveMempool(changes map[string][]byte) {
+	putAll(f.mempool, changes)
+}
+func (f *fakeDB) LoadMempool() map[string][]byte {
+	return f.mempool
+}
+
+// Storage counting the reads needed to build a UTXO set (of outputs or of the transactions
+// whose outputs are spent)
+type countingDB struct {
+	*fakeDB
+	uTxOutReads int
+}
+
+func (c *countingDB) FindUTxOut(key string) []byte {
+	c.uTxOutReads++
+	return c.fakeDB.FindUTxOut(key)
+}
+func (c *countingDB) FindTxLocation(txId string) []byte {
+	c.uTxOutReads++
+	return c.fakeDB.FindTxLocation(txId)
+}
+
+// Mine a block with the given transactions on top of the blockchain
+// (without adding it, as if it was mined by a peer)
+func mineTestBlock(bc *blockchain, txs ...*Tx) *Block {
+	prev, err := FindBlock(bc.LastHash)
+	utils.ErrorHandler(err)
+	return mineTestBlockOn(prev, txs...)
+}
+
+// Mine a block with the given transactions on top of any block we have
+func mineTestBlockOn(prev *Block, txs ...*Tx) *Block {
+	block := &Block{
+		PrevHash:     prev.Hash,
+		Height:       prev.Height + 1,
+		Bits:         bitsAfter(blocksFrom(prev.Hash)),
+		Timestamp:    minTimestampAfter(blocksFrom(prev.Hash)),
+		Transactions: append([]*Tx{createCoinbaseTx(prev.Height+1, 0)}, txs...),
+	}
+	block.mine()
+	return block
+}
+
+// Mine a block again at the given timestamp, even if it is in the past (unlike mine())
+func mineTestBlockAt(block *Block, timestamp int) {
+	block.MerkleRoot = merkleRoot(txIds(block.Transactions))
+	block.Timestamp = timestamp
+	block.Hash = block.calculateHash()
+	for !meetsTarget(block.Hash, targetFromBits(block.Bits)) {
+		block.Nonce++
+		block.Hash = block.calculateHash()
+	}
+}
+
+// Make a signed transaction spending the first output of prevTx
+func makeTestTx(prevTx *Tx, amount int) *Tx {
+	tx := &Tx{
+		TxIns:  []*TxIn{{prevTx.Id, 0, "", ""}},
+		TxOuts: []*TxOut{{wallet.Wallet().Address, amount, ""}},
+	}
+	tx.getId()
+	tx.sign()
+	return tx
+}
 
 func TestBlockchain(t *testing.T) {
 	oldStorage := dbStorage
@@ -33,17 +223,54 @@ func TestBlockchain(t *testing.T) {
 		if b.Height != 1 {
 			t.Error("Blockchain() did not create a brand new blockchain")
 		}
+		if b.LastHash != params.GenesisHash {
+			t.Error("Blockchain() did not start with the genesis block of the network")
+		}
 	})
+	existingChain := func() []byte {
+		return utils.ToBytes(&blockchain{LastHash: "", Height: 2, CurrBits: params.DefaultBits, IndexVersion: indexVersion})
+	}
 	t.Run("Blockchain() return existing blockchain when available", func(t *testing.T) {
 		once = *new(sync.Once) // ensure that code in Blockchain() can be run multiple times
-		dbStorage = mockDB{mockLoadBlockchain: func() []byte {
-			return utils.ToBytes(&blockchain{LastHash: "", Height: 2, CurrDifficulty: 1})
-		}}
+		dbStorage = mockDB{
+			mockLoadBlockchain: existingChain,
+			mockFindBlockHash:  func(int) string { return params.GenesisHash },
+		}
 		b := Blockchain()
 		if b.Height != 2 {
 			t.Errorf("Expected blockchain of height 2, got height %d", b.Height)
 		}
 	})
+	t.Run("Blockchain() should panic for the blockchain of another network", func(t *testing.T) {
+		once = *new(sync.Once)
+		dbStorage = mockDB{
+			mockLoadBlockchain: existingChain,
+			mockFindBlockHash:  func(int) string { return "x" },
+		}
+		defer func() {
+			if recover() == nil {
+				t.Error("Blockchain() did not panic for a different genesis block")
+			}
+		}()
+		Blockchain()
+	})
+	t.Run("Blockchain() should panic for another network before reindexing its db", func(t *testing.T) {
+		once = *new(sync.Once)
+		fake := newFakeDB()
+		dbStorage = fake
+		genesis := mineTestBlockOn(&Block{}) // genesis block of another chain
+		commitBlock(genesis)
+		fake.chainData = utils.ToBytes(&blockchain{LastHash: genesis.Hash, Height: 1, CurrBits: genesis.Bits, IndexVersion: indexVersion - 1})
+		defer func() {
+			if recover() == nil {
+				t.Error("Blockchain() did not panic for a different genesis block")
+			}
+			if len(fake.blockHashes) != 0 || len(fake.uTxOuts) != 0 {
+				t.Error("Blockchain() reindexed the db of another network")
+			}
+		}()
+		Blockchain()
+	})
 }
 
 func TestBlocks(t *testing.T) {
@@ -69,10 +296,7 @@ func TestFindTx(t *testing.T) {
 	oldStorage := dbStorage
 	defer func() { dbStorage = oldStorage }()
 	t.Run("FindTx() should return nil when transaction doesn't exist", func(t *testing.T) {
-		dbStorage = mockDB{mockFindBlock: func(string) []byte {
-			block := &Block{Hash: "y", Transactions: []*Tx{}}
-			return utils.ToBytes(block)
-		}}
+		dbStorage = mockDB{mockFindTxLocation: func(string) []byte { return nil }}
 		tx := FindTx(&blockchain{LastHash: "y"}, "test")
 		if tx != nil {
 			t.Errorf("Expected transaction to be nil, got txId %s", tx.Id)
@@ -81,9 +305,12 @@ func TestFindTx(t *testing.T) {
 	t.Run("FindTx() should return existing transaction", func(t *testing.T) {
 		dbStorage = mockDB{
 			mockFindBlock: func(string) []byte {
-				block := &Block{Hash: "y", Transactions: []*Tx{{Id: "test"}}}
+				block := &Block{Hash: "y", Transactions: []*Tx{{Id: "other"}, {Id: "test"}}}
 				return utils.ToBytes(block)
 			},
+			mockFindTxLocation: func(string) []byte {
+				return utils.ToBytes(txLocation{BlockHash: "y", Position: 1})
+			},
 		}
 		tx := FindTx(&blockchain{LastHash: "y"}, "test")
 		if tx == nil {
@@ -94,7 +321,31 @@ func TestFindTx(t *testing.T) {
 	})
 }
 
-func TestGetDifficulty(t *testing.T) {
+func TestFindBlockByHeight(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+
+	bc := &blockchain{}
+	genesis := bc.addGenesisBlock()
+	newBlock := mineTestBlock(bc)
+	utils.ErrorHandler(bc.AddBlockFromPeer(newBlock))
+	t.Run("FindBlockByHeight() should return blocks of the main chain", func(t *testing.T) {
+		for _, expected := range []*Block{genesis, newBlock} {
+			block, err := FindBlockByHeight(bc, expected.Height)
+			if err != nil || block.Hash != expected.Hash {
+				t.Errorf("Expected block %s at height %d", expected.Hash, expected.Height)
+			}
+		}
+	})
+	t.Run("FindBlockByHeight() should error above the newest block", func(t *testing.T) {
+		if _, err := FindBlockByHeight(bc, 3); err != ErrBlockNotFound {
+			t.Errorf("Expected error '%v', got '%v'", ErrBlockNotFound, err)
+		}
+	})
+}
+
+func TestGetBits(t *testing.T) {
 	oldStorage := dbStorage
 	defer func() { dbStorage = oldStorage }()
 	blocks := []*Block{
@@ -104,7 +355,7 @@ func TestGetDifficulty(t *testing.T) {
 		{PrevHash: "x"},
 		{PrevHash: ""},
 	}
-	// Needed b/c recalculateDifficulty calls Blocks(), which calls FindBlock()
+	// Needed b/c retarget() uses recentBlocks(), which calls FindBlock()
 	currBlock := 0
 	dbStorage = mockDB{mockFindBlock: func(string) []byte {
 		defer func() { currBlock++ }()
@@ -116,15 +367,15 @@ func TestGetDifficulty(t *testing.T) {
 			expectedOutput int
 		}
 		tests := []test{
-			{height: 0, expectedOutput: defaultDifficulty},
-			{height: 2, expectedOutput: defaultDifficulty},
-			{height: 5, expectedOutput: defaultDifficulty + 1},
+			{height: 0, expectedOutput: params.DefaultBits},
+			{height: 2, expectedOutput: params.DefaultBits},
+			{height: 5, expectedOutput: 0x1f3fffc0}, // blocks came at once, so a quarter of the target
 		}
 		for _, tc := range tests {
-			bc := &blockchain{Height: tc.height, CurrDifficulty: defaultDifficulty}
-			result := getDifficulty(bc)
+			bc := &blockchain{LastHash: "x", Height: tc.height, CurrBits: params.DefaultBits}
+			result := getBits(bc)
 			if result != tc.expectedOutput {
-				t.Errorf("getDifficulty() should return %d got %d", tc.expectedOutput, result)
+				t.Errorf("getBits() should return %x got %x", tc.expectedOutput, result)
 			}
 		}
 	})
@@ -133,37 +384,464 @@ func TestGetDifficulty(t *testing.T) {
 func TestAddBlockFromPeer(t *testing.T) {
 	oldStorage := dbStorage
 	defer func() { dbStorage = oldStorage }()
-	dbStorage = mockDB{}
+	dbStorage = newFakeDB()
 
-	bc := &blockchain{Height: 1, CurrDifficulty: 1, LastHash: "xx"}
-	Mempool().Txs["test"] = &Tx{} // ensure this tx is removed from mempool
-	newBlock := &Block{Difficulty: 2, Hash: "test", Transactions: []*Tx{{Id: "test"}}}
-	bc.AddBlockFromPeer(newBlock)
+	bc := &blockchain{}
+	genesis := bc.addGenesisBlock()
+	coinbase := genesis.Transactions[0]
 
 	t.Run("AddBlockFromPeer() should update the blockchain", func(t *testing.T) {
-		if bc.CurrDifficulty != 2 || bc.Height != 2 || bc.LastHash != "test" {
+		newBlock := mineTestBlock(bc, makeTestTx(coinbase, params.MinerReward))
+		if err := bc.AddBlockFromPeer(newBlock); err != nil {
+			t.Fatalf("AddBlockFromPeer() rejected a valid block: %s", err)
+		}
+		if bc.Height != 2 || bc.LastHash != newBlock.Hash {
 			t.Error("AddBlockFromPeer() did not update the blockchain with new block's data")
 		}
 	})
+
 	t.Run("AddBlockFromPeer() should remove transactions from the mempool", func(t *testing.T) {
-		_, ok := Mempool().Txs["test"]
-		if ok {
-			t.Error("AddBlockFromPeer() should have removed transaction id 'test' from mempool")
+		tx := makeTestTx(bc.lastCoinbase(t), params.MinerReward)
+		setTestMempool(tx)
+		utils.ErrorHandler(bc.AddBlockFromPeer(mineTestBlock(bc, tx)))
+		if _, ok := Mempool().Txs[tx.Id]; ok {
+			t.Errorf("AddBlockFromPeer() should have removed transaction id '%s' from mempool", tx.Id)
+		}
+	})
+
+	t.Run("AddBlockFromPeer() should reject invalid blocks", func(t *testing.T) {
+		spendable := bc.lastCoinbase(t)
+		badSignature := makeTestTx(spendable, params.MinerReward)
+		badSignature.TxIns[0].Signature = wallet.Sign(coinbase.Id, wallet.Wallet())
+		type test struct {
+			name  string
+			block func() *Block
+			err   error
+		}
+		tests := []test{
+			{"genesis block of another chain", func() *Block {
+				return mineTestBlockOn(&Block{})
+			}, ErrInvalidGenesis},
+			{"unknown previous block", func() *Block {
+				block := mineTestBlock(bc)
+				block.PrevHash = "abc"
+				block.mine()
+				return block
+			}, ErrUnknownParent},
+			{"wrong height for previous block", func() *Block {
+				block := mineTestBlockOn(genesis)
+				block.Height++
+				block.mine()
+				return block
+			}, ErrInvalidHeight},
+			{"wrong height", func() *Block {
+				block := mineTestBlock(bc)
+				block.Height++
+				block.mine()
+				return block
+			}, ErrInvalidHeight},
+			{"wrong difficulty", func() *Block {
+				block := mineTestBlock(bc)
+				block.Bits = params.MaxBits
+				block.mine()
+				return block
+			}, ErrInvalidDifficulty},
+			{"transactions not matching merkle root", func() *Block {
+				block := mineTestBlock(bc, makeTestTx(spendable, params.MinerReward))
+				block.Transactions = block.Transactions[:1]
+				return block
+			}, ErrInvalidMerkleRoot},
+			{"same transaction twice", func() *Block {
+				tx := makeTestTx(spendable, params.MinerReward)
+				return mineTestBlock(bc, tx, tx)
+			}, ErrMalformedBlock},
+			{"timestamp not after the median time past", func() *Block {
+				block := mineTestBlock(bc)
+				mineTestBlockAt(block, medianTimePast(recentBlocks(bc.LastHash)))
+				return block
+			}, ErrStaleTimestamp},
+			{"timestamp too far in the future", func() *Block {
+				block := mineTestBlock(bc)
+				block.Timestamp = int(time.Now().Unix()) + maxFutureBlockTime + 60
+				block.mine()
+				return block
+			}, ErrFutureTimestamp},
+			{"hash not matching data", func() *Block {
+				block := mineTestBlock(bc)
+				block.Nonce++
+				return block
+			}, ErrInvalidPoW},
+			{"hash not matching data and a malformed transaction", func() *Block {
+				tx := makeTestTx(spendable, params.MinerReward)
+				tx.Timestamp++
+				block := mineTestBlock(bc, tx)
+				block.Nonce++
+				return block
+			}, ErrInvalidPoW}, // the header is checked before the transactions
+			{"missing coinbase", func() *Block {
+				block := mineTestBlock(bc, makeTestTx(spendable, params.MinerReward))
+				block.Transactions = block.Transactions[1:]
+				block.mine()
+				return block
+			}, ErrInvalidCoinbase},
+			{"coinbase paying too much", func() *Block {
+				block := mineTestBlock(bc)
+				block.Transactions[0].TxOuts[0].Amount = params.MinerReward + 1
+				block.Transactions[0].getId()
+				block.mine()
+				return block
+			}, ErrInvalidCoinbase},
+			{"coinbase claiming more than the fees", func() *Block {
+				block := mineTestBlock(bc, makeTestTx(spendable, params.MinerReward-10))
+				block.Transactions[0] = createCoinbaseTx(block.Height, 11)
+				block.mine()
+				return block
+			}, ErrInvalidCoinbase},
+			{"coinbase for another height", func() *Block {
+				block := mineTestBlock(bc)
+				block.Transactions[0] = createCoinbaseTx(block.Height-1, 0)
+				block.mine()
+				return block
+			}, ErrInvalidCoinbase},
+			{"transaction id not matching data", func() *Block {
+				tx := makeTestTx(spendable, params.MinerReward)
+				tx.Timestamp++
+				return mineTestBlock(bc, tx)
+			}, ErrMalformedBlock},
+			{"input already spent", func() *Block {
+				return mineTestBlock(bc, makeTestTx(coinbase, params.MinerReward))
+			}, ErrTxInputSpent},
+			{"double spend within block", func() *Block {
+				return mineTestBlock(bc, makeTestTx(spendable, params.MinerReward), makeTestTx(spendable, 1))
+			}, ErrTxInputSpent},
+			{"input signed for another transaction", func() *Block {
+				return mineTestBlock(bc, badSignature)
+			}, ErrTxBadSignature},
+			{"outputs exceeding inputs", func() *Block {
+				return mineTestBlock(bc, makeTestTx(spendable, params.MinerReward+1))
+			}, ErrTxOverspending},
+		}
+		for _, tc := range tests {
+			lastHash := bc.LastHash
+			err := bc.AddBlockFromPeer(tc.block())
+			if err != tc.err {
+				t.Errorf("Block with %s: expected error '%v', got '%v'", tc.name, tc.err, err)
+			}
+			if bc.LastHash != lastHash {
+				t.Errorf("Block with %s should not have been added to the blockchain", tc.name)
+			}
+		}
+	})
+
+	t.Run("AddBlockFromPeer() should check proof of work before rolling back the UTXO set", func(t *testing.T) {
+		storage := &countingDB{fakeDB: dbStorage.(*fakeDB)}
+		dbStorage = storage
+		defer func() { dbStorage = storage.fakeDB }()
+		block := mineTestBlockOn(genesis) // rolling back to the genesis block undoes the spends above it
+		block.Nonce++
+		if err := bc.AddBlockFromPeer(block); err != ErrInvalidPoW {
+			t.Errorf("Expected error '%v', got '%v'", ErrInvalidPoW, err)
+		}
+		if storage.uTxOutReads != 0 {
+			t.Errorf("Expected the UTXO set not to be read, got %d reads", storage.uTxOutReads)
+		}
+	})
+
+	t.Run("AddBlockFromPeer() should let the coinbase claim transaction fees", func(t *testing.T) {
+		block := mineTestBlock(bc, makeTestTx(bc.lastCoinbase(t), params.MinerReward-10))
+		block.Transactions[0] = createCoinbaseTx(block.Height, 10)
+		block.mine()
+		if err := bc.AddBlockFromPeer(block); err != nil {
+			t.Fatalf("AddBlockFromPeer() rejected a coinbase claiming the fees: %s", err)
 		}
 	})
+}
 
+// Get the coinbase transaction of the newest block
+func (b *blockchain) lastCoinbase(t *testing.T) *Tx {
+	return findTestBlock(t, b.LastHash).Transactions[0]
 }
 
 func TestReplace(t *testing.T) {
 	oldStorage := dbStorage
 	defer func() { dbStorage = oldStorage }()
-	dbStorage = mockDB{}
+
+	// Build the chain of another node
+	dbStorage = newFakeDB()
+	peerChain := &blockchain{}
+	genesis := peerChain.addGenesisBlock()
+	utils.ErrorHandler(peerChain.AddBlockFromPeer(mineTestBlock(peerChain, makeTestTx(genesis.Transactions[0], params.MinerReward))))
+	utils.ErrorHandler(peerChain.AddBlockFromPeer(mineTestBlock(peerChain)))
+	peerBlocks := Blocks(peerChain)
+
+	// Build our own (shorter) chain from the same genesis block
+	ourDB := newFakeDB()
+	dbStorage = ourDB
+	bc := &blockchain{}
+	bc.addGenesisBlock()
+	ourBlock := mineTestBlock(bc)
+	utils.ErrorHandler(bc.AddBlockFromPeer(ourBlock))
+
+	// Decode a fresh copy of the peer's blocks, so test cases can modify them
+	copyBlocks := func() []*Block {
+		var blocks []*Block
+		utils.FromBytes(&blocks, utils.ToBytes(peerBlocks))
+		return blocks
+	}
+
+	t.Run("Replace() should reject invalid chains and keep the old chain", func(t *testing.T) {
+		type test struct {
+			name   string
+			blocks func() []*Block
+			err    error
+		}
+		tests := []test{
+			{"empty chain", func() []*Block { return nil }, ErrEmptyChain},
+			{"another genesis block", func() []*Block {
+				return []*Block{mineTestBlockOn(&Block{})}
+			}, ErrInvalidGenesis},
+			{"missing block", func() []*Block {
+				blocks := copyBlocks()
+				return append(blocks[:1], blocks[2:]...)
+			}, ErrInvalidPrevHash},
+			{"tampered transaction", func() []*Block {
+				blocks := copyBlocks()
+				blocks[1].Transactions[1].TxOuts[0].Amount = params.MinerReward + 1
+				return blocks
+			}, ErrMalformedBlock},
+			{"stale timestamp", func() []*Block {
+				blocks := copyBlocks()
+				mineTestBlockAt(blocks[0], blocks[1].Timestamp-1)
+				return blocks
+			}, ErrStaleTimestamp},
+			{"timestamp too far in the future", func() []*Block {
+				blocks := copyBlocks()
+				blocks[0].Timestamp = int(time.Now().Unix()) + maxFutureBlockTime + 60
+				blocks[0].mine()
+				return blocks
+			}, ErrFutureTimestamp},
+			{"tampered nonce", func() []*Block {
+				blocks := copyBlocks()
+				blocks[0].Nonce++
+				return blocks
+			}, ErrInvalidPoW},
+			{"null block", func() []*Block {
+				blocks := copyBlocks()
+				blocks[0] = nil
+				return blocks
+			}, ErrMalformedBlock},
+		}
+		for _, tc := range tests {
+			err := bc.Replace(tc.blocks())
+			if err != tc.err {
+				t.Errorf("Chain with %s: expected error '%v', got '%v'", tc.name, tc.err, err)
+			}
+			if bc.LastHash != ourBlock.Hash || bc.Height != 2 {
+				t.Errorf("Chain with %s should not have replaced the blockchain", tc.name)
+			}
+			if _, ok := ourDB.blocks[ourBlock.Hash]; !ok {
+				t.Errorf("Chain with %s should not have removed our blocks", tc.name)
+			}
+		}
+	})
+
 	t.Run("Replace() should mutate the blockchain", func(t *testing.T) {
-		bc := &blockchain{Height: 1, CurrDifficulty: 1, LastHash: "xx"}
-		blocks := []*Block{{Difficulty: 2, Hash: "test"}, {Difficulty: 2, Hash: "test"}}
-		bc.Replace(blocks)
-		if bc.CurrDifficulty != 2 || bc.Height != 2 || bc.LastHash != "test" {
+		if err := bc.Replace(copyBlocks()); err != nil {
+			t.Fatalf("Replace() rejected a valid chain: %s", err)
+		}
+		if bc.Height != 3 || bc.LastHash != peerChain.LastHash {
 			t.Error("Replace() did not update the blockchain with the new blocks")
 		}
+		if len(ourDB.blocks) != 4 {
+			t.Errorf("Expected our old block to be kept with 2 new blocks, got %d blocks", len(ourDB.blocks))
+		}
 	})
+
+	t.Run("Replace() should not switch to a chain with less work", func(t *testing.T) {
+		err := bc.Replace([]*Block{ourBlock, genesis})
+		if err != ErrNotEnoughWork {
+			t.Errorf("Expected error '%v', got '%v'", ErrNotEnoughWork, err)
+		}
+		if bc.LastHash != peerChain.LastHash {
+			t.Error("Replace() switched to a chain with less work")
+		}
+		lowWork := mineTestBlockOn(genesis)
+		mineTestBlockAt(lowWork, lowWork.Timestamp+1) // not the same block as ours
+		if err := bc.Replace([]*Block{lowWork, genesis}); err != ErrNotEnoughWork {
+			t.Errorf("Expected error '%v', got '%v'", ErrNotEnoughWork, err)
+		}
+		if _, ok := ourDB.blocks[lowWork.Hash]; ok {
+			t.Error("Replace() saved the blocks of a chain with less work")
+		}
+	})
+}
+
+func TestForkChoice(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	setTestMempool()
+
+	bc := &blockchain{}
+	genesis := bc.addGenesisBlock()
+	tx := makeTestTx(genesis.Transactions[0], params.MinerReward)
+	blockA1 := mineTestBlockOn(genesis, tx)
+	utils.ErrorHandler(bc.AddBlockFromPeer(blockA1))
+
+	t.Run("Block with the same work as the main chain should be kept on a side branch", func(t *testing.T) {
+		blockB1 := mineTestBlockOn(genesis)
+		if err := bc.AddBlockFromPeer(blockB1); err != nil {
+			t.Fatalf("AddBlockFromPeer() rejected a valid side branch block: %s", err)
+		}
+		if bc.LastHash != blockA1.Hash {
+			t.Error("Side branch with the same work should not become the main chain")
+		}
+		if _, err := FindBlock(blockB1.Hash); err != nil {
+			t.Error("Side branch block was not saved")
+		}
+
+		t.Run("Side branch with more work should become the main chain", func(t *testing.T) {
+			blockB2 := mineTestBlockOn(blockB1)
+			if err := bc.AddBlockFromPeer(blockB2); err != nil {
+				t.Fatalf("AddBlockFromPeer() rejected a valid side branch block: %s", err)
+			}
+			if bc.LastHash != blockB2.Hash || bc.Height != 3 {
+				t.Error("Blockchain did not reorganize to the branch with more work")
+			}
+			if bc.TotalWork.Cmp(chainWork([]*Block{genesis, blockB1, blockB2})) != 0 {
+				t.Errorf("Expected total work of the new main chain, got %s", bc.TotalWork)
+			}
+			if _, ok := Mempool().Txs[tx.Id]; !ok {
+				t.Error("Transaction from the disconnected block was not returned to the mempool")
+			}
+			if !bc.HasMoreWork(blockA1.Hash) {
+				t.Error("HasMoreWork() should be true for the old main chain")
+			}
+			if !reflect.DeepEqual(savedUTxOutKeys(), expectedUTxOutKeys(bc)) {
+				t.Error("Saved UTXO set does not match the new main chain")
+			}
+			if !dbStorage.(*fakeDB).ownersMatchUTxOuts() {
+				t.Error("Outputs indexed by owner do not match the saved UTXO set")
+			}
+			if block, _ := FindBlockByHeight(bc, 2); block == nil || block.Hash != blockB1.Hash {
+				t.Error("Height index does not point to the new main chain")
+			}
+			if FindTx(bc, tx.Id) != nil {
+				t.Error("Transaction from the disconnected block should be removed from the tx index")
+			}
+		})
+	})
+	t.Run("Side branches leaving the main chain too deep should be refused", func(t *testing.T) {
+		defer func(depth int) { maxForkDepth = depth }(maxForkDepth)
+		maxForkDepth = 1 // the main chain is now genesis, B1 and B2
+		onGenesis := mineTestBlockOn(genesis)
+		mineTestBlockAt(onGenesis, onGenesis.Timestamp+1) // not the same block as B1
+		for _, block := range []*Block{onGenesis, mineTestBlockOn(blockA1)} {
+			if err := bc.AddBlockFromPeer(block); err != ErrForkTooDeep {
+				t.Errorf("Expected error '%v', got '%v'", ErrForkTooDeep, err)
+			}
+			if _, err := FindBlock(block.Hash); err == nil {
+				t.Errorf("Block at height %d of a side branch too deep was saved", block.Height)
+			}
+		}
+		if err := bc.AddBlockFromPeer(mineTestBlockOn(findTestBlock(t, blocksFrom(bc.LastHash)[1].Hash))); err != nil {
+			t.Errorf("AddBlockFromPeer() rejected a side branch within the limit: %s", err)
+		}
+	})
+}
+
+func TestUTxOutsByAddress(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	setTestMempool()
+
+	bc := &blockchain{}
+	genesis := bc.addGenesisBlock()
+	utils.ErrorHandler(bc.AddBlockFromPeer(mineTestBlock(bc, makeTestTx(genesis.Transactions[0], 20))))
+	address := wallet.Wallet().Address
+
+	t.Run("UTxOutsByAddress() should return unspent outputs from the UTXO set", func(t *testing.T) {
+		uTxOuts := UTxOutsByAddress(address, bc)
+		if len(uTxOuts) != 2 { // new coinbase and output of the test transaction
+			t.Errorf("Expected 2 unspent outputs, got %d", len(uTxOuts))
+		}
+		if balance := BalanceByAddress(address, bc); balance != params.MinerReward+20 {
+			t.Errorf("Expected balance of %d, got %d", params.MinerReward+20, balance)
+		}
+	})
+	t.Run("UTxOutsByAddress() should skip outputs of other addresses", func(t *testing.T) {
+		if uTxOuts := UTxOutsByAddress("other", bc); len(uTxOuts) != 0 {
+			t.Errorf("Expected no unspent outputs, got %d", len(uTxOuts))
+		}
+	})
+}
+
+func TestReindex(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	fake := newFakeDB()
+	dbStorage = fake
+
+	bc := &blockchain{}
+	genesis := bc.addGenesisBlock()
+	utils.ErrorHandler(bc.AddBlockFromPeer(mineTestBlock(bc, makeTestTx(genesis.Transactions[0], params.MinerReward))))
+	expected := expectedUTxOutKeys(bc)
+	expectedTxLocations := fake.txLocations
+	expectedBlockHashes := fake.blockHashes
+	fake.resetIndexes()
+	fake.uTxOuts["stale:0"] = utils.ToBytes(&TxOut{"x", 1, ""})
+	fake.owned[addressOwner("x")] = map[string][]byte{"stale:0": fake.uTxOuts["stale:0"]}
+	fake.blockHashes[5] = []byte("stale")
+
+	bc.Reindex()
+	if !reflect.DeepEqual(savedUTxOutKeys(), expected) {
+		t.Error("Reindex() did not rebuild the UTXO set from the main chain")
+	}
+	if !fake.ownersMatchUTxOuts() {
+		t.Error("Reindex() did not rebuild the outputs indexed by owner")
+	}
+	if !reflect.DeepEqual(fake.txLocations, expectedTxLocations) {
+		t.Error("Reindex() did not rebuild the tx index from the main chain")
+	}
+	if !reflect.DeepEqual(fake.blockHashes, expectedBlockHashes) {
+		t.Error("Reindex() did not rebuild the height index from the main chain")
+	}
+	if bc.IndexVersion != indexVersion {
+		t.Errorf("Expected index version %d, got %d", indexVersion, bc.IndexVersion)
+	}
+}
+
+// Get the keys of every output in the saved UTXO set
+func savedUTxOutKeys() map[string]bool {
+	keys := make(map[string]bool)
+	for key := range dbStorage.LoadUTxOuts() {
+		keys[key] = true
+	}
+	return keys
+}
+
+// Get the keys of every unspent output by going through the whole main chain
+func expectedUTxOutKeys(bc *blockchain) map[string]bool {
+	uTxOuts := newUTxOutSet()
+	blocks := blocksFrom(bc.LastHash)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		uTxOuts.connect(blocks[i])
+	}
+	keys := make(map[string]bool)
+	for key, txOut := range uTxOuts.changes {
+		if txOut != nil {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// Find a block that the test expects to exist
+func findTestBlock(t *testing.T, hash string) *Block {
+	block, err := FindBlock(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
 }
@@ -0,0 +1,178 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"sort"
+
+	"github.com/achung3071/gpcoin/utils"
+)
+
+// How coin selection works:
+// To pay an amount (plus the fee), the wallet picks some of its unspent outputs as inputs,
+// and whatever they have left over comes back as change. Which outputs are picked is up to
+// a CoinSelector, chosen for each transaction or for the whole node (see SetCoinSelection()):
+//   - largest-first spends the fewest outputs, which keeps transactions small
+//   - smallest-first spends many small outputs, which cleans up dust
+//   - branch-and-bound looks for outputs that add up to the target exactly, so there is
+//     no change at all (falling back to largest-first if none do)
+//   - random picks outputs in a random order, so they say less about the wallet
+// The wallet tries its confirmed outputs first, and only then outputs of mempool transactions.
+
+const (
+	LargestFirst   string = "largest-first"
+	SmallestFirst  string = "smallest-first"
+	BranchAndBound string = "branch-and-bound"
+	RandomOrder    string = "random"
+
+	maxBranchAndBoundTries int = 100000 // most combinations branch-and-bound looks at
+)
+
+// Strategy for picking the outputs a transaction spends
+type CoinSelector interface {
+	// Pick outputs worth at least target in total (nil if all of them are not enough)
+	Select(uTxOuts []*UTxOut, target int) []*UTxOut
+}
+
+type largestFirst struct{}
+type smallestFirst struct{}
+
+type branchAndBound struct {
+	fallback CoinSelector // used when no combination matches the target exactly
+}
+
+type randomOrder struct {
+	intn func(n int) int // random number in [0, n)
+}
+
+var ErrUnknownCoinSelection error = errors.New("coin selection must be one of 'largest-first', 'smallest-first', 'branch-and-bound', 'random'")
+
+var coinSelection string = BranchAndBound // used when a transaction does not pick one
+
+// NON-MUTATING FUNCTIONS
+// Get the coin selection strategy with the given name ("" for the node's default)
+func CoinSelection(name string) (CoinSelector, error) {
+	if name == "" {
+		name = coinSelection
+	}
+	switch name {
+	case LargestFirst:
+		return largestFirst{}, nil
+	case SmallestFirst:
+		return smallestFirst{}, nil
+	case BranchAndBound:
+		return branchAndBound{fallback: largestFirst{}}, nil
+	case RandomOrder:
+		return randomOrder{intn: cryptoIntn}, nil
+	}
+	return nil, ErrUnknownCoinSelection
+}
+
+// Copy of outputs sorted by amount (ties broken by key, so the order is always the same)
+func sortByAmount(uTxOuts []*UTxOut, descending bool) []*UTxOut {
+	sorted := append([]*UTxOut{}, uTxOuts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Amount != sorted[j].Amount {
+			return (sorted[i].Amount > sorted[j].Amount) == descending
+		}
+		return uTxOutKey(sorted[i].TxId, sorted[i].Index) < uTxOutKey(sorted[j].TxId, sorted[j].Index)
+	})
+	return sorted
+}
+
+// Take outputs in order until they are worth at least target
+func takeUntil(uTxOuts []*UTxOut, target int) []*UTxOut {
+	total := 0
+	for i, uTxOut := range uTxOuts {
+		total += uTxOut.Amount
+		if total >= target {
+			return uTxOuts[:i+1]
+		}
+	}
+	return nil
+}
+
+func (largestFirst) Select(uTxOuts []*UTxOut, target int) []*UTxOut {
+	return takeUntil(sortByAmount(uTxOuts, true), target)
+}
+
+func (smallestFirst) Select(uTxOuts []*UTxOut, target int) []*UTxOut {
+	return takeUntil(sortByAmount(uTxOuts, false), target)
+}
+
+// Depth-first search over the outputs (largest first), including or leaving out each one,
+// and giving up on a branch once it is over the target or cannot reach it anymore
+func (s branchAndBound) Select(uTxOuts []*UTxOut, target int) []*UTxOut {
+	sorted := sortByAmount(uTxOuts, true)
+	remaining := make([]int, len(sorted)+1) // total of the outputs from each index on
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Amount
+	}
+	var picked []*UTxOut
+	tries := 0
+	var search func(i int, total int) bool
+	search = func(i int, total int) bool {
+		tries++
+		if total == target {
+			return true
+		}
+		if i == len(sorted) || total > target || total+remaining[i] < target || tries > maxBranchAndBoundTries {
+			return false
+		}
+		picked = append(picked, sorted[i])
+		if search(i+1, total+sorted[i].Amount) {
+			return true
+		}
+		picked = picked[:len(picked)-1]
+		next := i + 1 // outputs of the same amount would only repeat the same totals
+		for next < len(sorted) && sorted[next].Amount == sorted[i].Amount {
+			next++
+		}
+		return search(next, total)
+	}
+	if target > 0 && search(0, 0) {
+		return picked
+	}
+	return s.fallback.Select(uTxOuts, target)
+}
+
+func (s randomOrder) Select(uTxOuts []*UTxOut, target int) []*UTxOut {
+	shuffled := append([]*UTxOut{}, uTxOuts...)
+	for i := len(shuffled) - 1; i > 0; i-- { // Fisher-Yates shuffle
+		j := s.intn(i + 1)
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	return takeUntil(shuffled, target)
+}
+
+// Random number in [0, n) that cannot be predicted (unlike math/rand without a seed)
+func cryptoIntn(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	utils.ErrorHandler(err)
+	return int(i.Int64())
+}
+
+// Pick outputs worth at least target with selector, trying confirmed outputs on their own first
+func selectUTxOuts(selector CoinSelector, uTxOuts []*UTxOut, target int) []*UTxOut {
+	var confirmed []*UTxOut
+	for _, uTxOut := range uTxOuts {
+		if uTxOut.Confirmed {
+			confirmed = append(confirmed, uTxOut)
+		}
+	}
+	if selected := selector.Select(confirmed, target); selected != nil {
+		return selected
+	}
+	return selector.Select(uTxOuts, target)
+}
+
+// MUTATING FUNCTIONS
+// Change the coin selection used when a transaction does not pick one (e.g., from the command line)
+func SetCoinSelection(name string) error {
+	if _, err := CoinSelection(name); err != nil || name == "" {
+		return ErrUnknownCoinSelection
+	}
+	coinSelection = name
+	return nil
+}
@@ -0,0 +1,125 @@
+package blockchain
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Unspent outputs with the given amounts (the index is the position in the list)
+func testUTxOuts(amounts ...int) []*UTxOut {
+	uTxOuts := []*UTxOut{}
+	for idx, amount := range amounts {
+		uTxOuts = append(uTxOuts, &UTxOut{"x", idx, amount, true})
+	}
+	return uTxOuts
+}
+
+// Amounts of the given outputs, in order
+func amounts(uTxOuts []*UTxOut) []int {
+	result := []int{}
+	for _, uTxOut := range uTxOuts {
+		result = append(result, uTxOut.Amount)
+	}
+	return result
+}
+
+func TestCoinSelection(t *testing.T) {
+	uTxOuts := testUTxOuts(5, 30, 1, 12, 8)
+	type test struct {
+		name     string
+		selector CoinSelector
+		target   int
+		expected []int // nil if the outputs are not enough
+	}
+	tests := []test{
+		{"Largest-first should spend the fewest outputs", largestFirst{}, 35, []int{30, 12}},
+		{"Smallest-first should spend the smallest outputs", smallestFirst{}, 20, []int{1, 5, 8, 12}},
+		{"Branch-and-bound should find an exact match", branchAndBound{largestFirst{}}, 21, []int{12, 8, 1}},
+		{"Branch-and-bound should prefer the largest outputs for an exact match", branchAndBound{largestFirst{}}, 13, []int{12, 1}},
+		{"Branch-and-bound should fall back without an exact match", branchAndBound{largestFirst{}}, 41, []int{30, 12}},
+		{"Branch-and-bound should use the given fallback", branchAndBound{smallestFirst{}}, 4, []int{1, 5}},
+		{"Largest-first should fail when the outputs are not enough", largestFirst{}, 57, nil},
+		{"Smallest-first should fail when the outputs are not enough", smallestFirst{}, 57, nil},
+		{"Branch-and-bound should fail when the outputs are not enough", branchAndBound{largestFirst{}}, 57, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			selected := tc.selector.Select(uTxOuts, tc.target)
+			if tc.expected == nil {
+				if selected != nil {
+					t.Errorf("Expected no outputs, got %v", amounts(selected))
+				}
+			} else if !reflect.DeepEqual(amounts(selected), tc.expected) {
+				t.Errorf("Expected outputs %v, got %v", tc.expected, amounts(selected))
+			}
+		})
+	}
+}
+
+func TestBranchAndBoundTries(t *testing.T) {
+	// no subset of even amounts adds up to an odd target, but there are too many to try them all
+	even := []int{}
+	for i := 1; i <= 40; i++ {
+		even = append(even, 2*i)
+	}
+	selected := branchAndBound{largestFirst{}}.Select(testUTxOuts(even...), 401)
+	if expected := []int{80, 78, 76, 74, 72, 70}; !reflect.DeepEqual(amounts(selected), expected) {
+		t.Errorf("Expected to fall back to outputs %v, got %v", expected, amounts(selected))
+	}
+}
+
+func TestRandomOrder(t *testing.T) {
+	uTxOuts := testUTxOuts(5, 30, 1, 12, 8)
+	source := rand.New(rand.NewSource(1))
+	selector := randomOrder{intn: source.Intn}
+	seen := make(map[int]bool) // first output picked
+	for i := 0; i < 50; i++ {
+		selected := selector.Select(uTxOuts, 20)
+		total := 0
+		for _, uTxOut := range selected {
+			total += uTxOut.Amount
+		}
+		if total < 20 || total-selected[len(selected)-1].Amount >= 20 {
+			t.Fatalf("Expected outputs worth just over 20, got %v", amounts(selected))
+		}
+		seen[selected[0].Amount] = true
+	}
+	if len(seen) != len(uTxOuts) {
+		t.Errorf("Expected every output to be picked first at some point, got %d of them", len(seen))
+	}
+	if !reflect.DeepEqual(amounts(uTxOuts), []int{5, 30, 1, 12, 8}) {
+		t.Error("Select() should not reorder the outputs it is given")
+	}
+	if selector.Select(uTxOuts, 57) != nil {
+		t.Error("Expected no outputs when they are not enough")
+	}
+}
+
+func TestSelectUTxOuts(t *testing.T) {
+	uTxOuts := testUTxOuts(5, 30, 1, 12)
+	uTxOuts[1].Confirmed = false
+	t.Run("Confirmed outputs should be spent first", func(t *testing.T) {
+		if selected := selectUTxOuts(largestFirst{}, uTxOuts, 15); !reflect.DeepEqual(amounts(selected), []int{12, 5}) {
+			t.Errorf("Expected outputs [12 5], got %v", amounts(selected))
+		}
+	})
+	t.Run("Unconfirmed outputs should be spent when confirmed ones are not enough", func(t *testing.T) {
+		if selected := selectUTxOuts(largestFirst{}, uTxOuts, 19); !reflect.DeepEqual(amounts(selected), []int{30}) {
+			t.Errorf("Expected outputs [30], got %v", amounts(selected))
+		}
+	})
+	t.Run("The default coin selection should be set by name", func(t *testing.T) {
+		oldSelection := coinSelection
+		defer func() { coinSelection = oldSelection }()
+		if err := SetCoinSelection("biggest"); err != ErrUnknownCoinSelection {
+			t.Errorf("Expected error '%v', got '%v'", ErrUnknownCoinSelection, err)
+		}
+		if err := SetCoinSelection(SmallestFirst); err != nil {
+			t.Fatalf("SetCoinSelection() failed: %v", err)
+		}
+		if selector, _ := CoinSelection(""); selector != (smallestFirst{}) {
+			t.Errorf("Expected smallest-first by default, got %T", selector)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package blockchain
+
+import (
+	"math/big"
+)
+
+// How difficulty targets work:
+// A block hash (read as a 256-bit number) must be at most the block's target, so a lower
+// target means more hashes to try. Targets are kept in blocks as "bits" in the same compact
+// form as Bitcoin's nBits: the highest byte is the length of the target in bytes, and the
+// lower three bytes are its first three bytes (e.g., 0x1d00ffff is 0x00ffff * 256^(0x1d-3)).
+
+const signBit int = 0x00800000 // compact targets with this bit set are negative (never valid)
+
+// NON-MUTATING FUNCTIONS
+// Get the target of compact bits (nil if the bits are not a valid target)
+func targetFromBits(bits int) *big.Int {
+	if bits < 0 || bits > 0xffffffff || bits&signBit != 0 {
+		return nil
+	}
+	size := uint(bits >> 24)
+	mantissa := big.NewInt(int64(bits & 0x007fffff))
+	var target *big.Int
+	if size <= 3 {
+		target = mantissa.Rsh(mantissa, 8*(3-size))
+	} else {
+		target = mantissa.Lsh(mantissa, 8*(size-3))
+	}
+	if target.Sign() == 0 || target.BitLen() > 256 {
+		return nil
+	}
+	return target
+}
+
+// Get the compact bits of a (positive) target, rounding down to three bytes of precision
+func bitsFromTarget(target *big.Int) int {
+	size := uint(len(target.Bytes()))
+	var mantissa int
+	if size <= 3 {
+		mantissa = int(target.Int64()) << (8 * (3 - size))
+	} else {
+		mantissa = int(new(big.Int).Rsh(target, 8*(size-3)).Int64())
+	}
+	if mantissa&signBit != 0 { // move a byte into the size so the sign bit stays clear
+		mantissa >>= 8
+		size++
+	}
+	return int(size)<<24 | mantissa
+}
+
+// Checks that a hash (as hex) is at most the target
+func meetsTarget(hash string, target *big.Int) bool {
+	hashInt, ok := new(big.Int).SetString(hash, 16)
+	return ok && hashInt.Cmp(target) <= 0
+}
@@ -0,0 +1,99 @@
+package blockchain
+
+import (
+	"math/big"
+	"testing"
+)
+
+// Make a target from a hex string
+func hexTarget(s string) *big.Int {
+	target, _ := new(big.Int).SetString(s, 16)
+	return target
+}
+
+func TestCompactBits(t *testing.T) {
+	t.Run("Bits should convert to and from targets", func(t *testing.T) {
+		type test struct {
+			bits   int
+			target string
+		}
+		tests := []test{
+			{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"}, // Bitcoin's first target
+			{0x2000ffff, "ffff0000000000000000000000000000000000000000000000000000000000"},
+			{0x207fffff, "7fffff0000000000000000000000000000000000000000000000000000000000"},
+			{0x03123456, "123456"},
+			{0x02008000, "80"},
+		}
+		for _, tc := range tests {
+			target := targetFromBits(tc.bits)
+			if target == nil || target.Cmp(hexTarget(tc.target)) != 0 {
+				t.Errorf("Target of bits %x: expected %s, got %x", tc.bits, tc.target, target)
+			}
+			if bits := bitsFromTarget(hexTarget(tc.target)); bits != tc.bits {
+				t.Errorf("Bits of target %s: expected %x, got %x", tc.target, tc.bits, bits)
+			}
+		}
+	})
+	t.Run("Invalid bits should not have a target", func(t *testing.T) {
+		for _, bits := range []int{0, 0x01003456, 0x04923456, 0x21010000, 0xff123456, -1, 0x100000000} {
+			if target := targetFromBits(bits); target != nil {
+				t.Errorf("Bits %x should not be valid, got target %x", bits, target)
+			}
+		}
+	})
+}
+
+func TestBlockWork(t *testing.T) {
+	type test struct {
+		bits int
+		work int64
+	}
+	tests := []test{
+		{params.MaxBits, 2}, // about half of all hashes are below the target
+		{0x1f00ffff, 65537}, // 2^256 / (0xffff * 2^224 + 1)
+		{0x2000ffff, 256},   // a target 256 times bigger than the one above
+		{0x04923456, 0},     // invalid bits
+	}
+	for _, tc := range tests {
+		if work := blockWork(&Block{Bits: tc.bits}); work.Cmp(big.NewInt(tc.work)) != 0 {
+			t.Errorf("Work of bits %x: expected %d, got %s", tc.bits, tc.work, work)
+		}
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	expectedSecs := (params.UpdateIntervalInBlocks - 1) * params.ExpectedMinsPerBlock * 60
+	// Make recent blocks (newest block first) that took the given time
+	blocksTaking := func(secs int) []*Block {
+		blocks := make([]*Block, params.UpdateIntervalInBlocks)
+		for i := range blocks {
+			blocks[i] = &Block{Timestamp: 1700000000}
+		}
+		blocks[0].Timestamp += secs
+		return blocks
+	}
+	target := targetFromBits(params.DefaultBits)
+	type test struct {
+		name   string
+		secs   int
+		target *big.Int
+	}
+	tests := []test{
+		{"on time", expectedSecs, target},
+		{"twice as slow", expectedSecs * 2, new(big.Int).Mul(target, big.NewInt(2))},
+		{"twice as fast", expectedSecs / 2, new(big.Int).Div(target, big.NewInt(2))},
+		{"much too fast", 0, new(big.Int).Div(target, big.NewInt(int64(params.MaxRetargetFactor)))},
+		{"much too slow", expectedSecs * 100, new(big.Int).Mul(target, big.NewInt(int64(params.MaxRetargetFactor)))},
+	}
+	for _, tc := range tests {
+		bits := retarget(blocksTaking(tc.secs), params.DefaultBits)
+		if expected := bitsFromTarget(tc.target); bits != expected {
+			t.Errorf("Blocks %s: expected bits %x, got %x", tc.name, expected, bits)
+		}
+	}
+	t.Run("Target should never be easier than MaxBits", func(t *testing.T) {
+		if bits := retarget(blocksTaking(expectedSecs*2), params.MaxBits); bits != params.MaxBits {
+			t.Errorf("Expected bits %x, got %x", params.MaxBits, bits)
+		}
+	})
+}
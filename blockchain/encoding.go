@@ -0,0 +1,92 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Canonical encoding used for hashing (see ENCODING.md for the full format).
+// Every node must produce exactly the same bytes for the same block header or
+// transaction, so block hashes (PoW), transaction ids and the signatures over
+// them can be checked by any node. Increase encodingVersion whenever the
+// encoding changes, so that old and new hashes can never be confused.
+const encodingVersion byte = 3
+
+// Writes values in the canonical encoding
+type encoder struct {
+	buf bytes.Buffer
+}
+
+// NON-MUTATING FUNCTIONS
+// Get the bytes written so far
+func (e *encoder) bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// Hash bytes in the canonical encoding into a hex string
+func hashEncoding(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// Encode the block header (every field except the hash itself)
+func (b *Block) encodeHeader() []byte {
+	e := &encoder{}
+	e.writeVersion()
+	e.writeString(b.PrevHash)
+	e.writeString(b.MerkleRoot)
+	e.writeInt(b.Height)
+	e.writeInt(b.Bits)
+	e.writeInt(b.Nonce)
+	e.writeInt(b.Timestamp)
+	return e.bytes()
+}
+
+// Encode a transaction for its id. Signatures and unlocking scripts are left out, since they
+// have signatures of the id (a transaction is signed after its id is calculated).
+func (t *Tx) encode() []byte {
+	e := &encoder{}
+	e.writeVersion()
+	e.writeInt(t.Timestamp)
+	e.writeCount(len(t.TxIns))
+	for _, txIn := range t.TxIns {
+		e.writeString(txIn.TxId)
+		e.writeInt(txIn.Index)
+	}
+	e.writeCount(len(t.TxOuts))
+	for _, txOut := range t.TxOuts {
+		e.writeString(txOut.Address)
+		e.writeInt(txOut.Amount)
+		e.writeString(txOut.Script)
+	}
+	e.writeInt(t.LockTime)
+	return e.bytes()
+}
+
+// MUTATING FUNCTIONS
+// Write the encoding version (first byte of every encoding)
+func (e *encoder) writeVersion() {
+	e.buf.WriteByte(encodingVersion)
+}
+
+// Write an int as 8 bytes (big-endian two's complement)
+func (e *encoder) writeInt(i int) {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], uint64(int64(i)))
+	e.buf.Write(data[:])
+}
+
+// Write the number of items in a list as 4 bytes (big-endian)
+func (e *encoder) writeCount(n int) {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], uint32(n))
+	e.buf.Write(data[:])
+}
+
+// Write a string as its length (see writeCount) followed by its UTF-8 bytes
+func (e *encoder) writeString(s string) {
+	e.writeCount(len(s))
+	e.buf.WriteString(s)
+}
@@ -0,0 +1,82 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors from ENCODING.md, which other implementations can check against
+func testVectorTxs() (*Tx, *Tx) {
+	coinbase := &Tx{
+		Timestamp: 1700000000,
+		TxIns:     []*TxIn{{"", 1, params.CoinbaseAddress, ""}},
+		TxOuts:    []*TxOut{{"ab12", 50, ""}},
+	}
+	coinbase.getId()
+	tx := &Tx{
+		Timestamp: 1700000060,
+		TxIns:     []*TxIn{{coinbase.Id, 0, "signature", ""}},
+		TxOuts:    []*TxOut{{"cd34", 20, ""}, {"", 30, "51"}},
+		LockTime:  2,
+	}
+	tx.getId()
+	return coinbase, tx
+}
+
+func TestTxEncoding(t *testing.T) {
+	coinbase, tx := testVectorTxs()
+	type test struct {
+		name     string
+		tx       *Tx
+		encoding string
+		id       string
+	}
+	tests := []test{
+		{"coinbase", coinbase,
+			"03000000006553f100000000010000000000000000000000010000000100000004616231320000000000000032000000000000000000000000",
+			"c35889c685376383c04a20d0e0035f680c172a6f8fd4b7e4a44d11ae1f33de05"},
+		{"transaction", tx,
+			"03000000006553f13c000000010000004063333538383963363835333736333833633034613230643065303033356636383063313732613666386664346237653461343464313161653166333364653035000000000000000000000002000000046364333400000000000000140000000000000000000000000000001e0000000235310000000000000002",
+			"9e6ba6340e7906d991e25d3f54665253375990112da09f844cf72afab6c6f21a"},
+	}
+	for _, tc := range tests {
+		if encoding := hex.EncodeToString(tc.tx.encode()); encoding != tc.encoding {
+			t.Errorf("Encoding of %s: expected %s, got %s", tc.name, tc.encoding, encoding)
+		}
+		if tc.tx.Id != tc.id {
+			t.Errorf("Id of %s: expected %s, got %s", tc.name, tc.id, tc.tx.Id)
+		}
+	}
+	t.Run("Signatures should not change the id", func(t *testing.T) {
+		tx.TxIns[0].Signature = "another signature"
+		tx.TxIns[0].Script = "51"
+		if tx.calculateId() != tests[1].id {
+			t.Error("Changing a signature or unlocking script changed the transaction id")
+		}
+	})
+}
+
+func TestHeaderEncoding(t *testing.T) {
+	coinbase, _ := testVectorTxs()
+	block := &Block{
+		MerkleRoot: coinbase.Id,
+		Height:     1,
+		Bits:       0x2000ffff,
+		Nonce:      300,
+		Timestamp:  1700000000,
+	}
+	expected := "030000000000000040633335383839633638353337363338336330346132306430653030333566363830633137326136663866643462376534613434643131616531663333646530350000000000000001000000002000ffff000000000000012c000000006553f100"
+	if encoding := hex.EncodeToString(block.encodeHeader()); encoding != expected {
+		t.Errorf("Expected %s, got %s", expected, encoding)
+	}
+	expectedHash := "1eb563419558e870dc590bc51ba4164fdfef2fc4f8d059082d094314db5f5244"
+	if hash := block.calculateHash(); hash != expectedHash {
+		t.Errorf("Expected hash %s, got %s", expectedHash, hash)
+	}
+	t.Run("Hash should not depend on the transactions themselves", func(t *testing.T) {
+		block.Transactions = []*Tx{coinbase}
+		if block.calculateHash() != expectedHash {
+			t.Error("Adding transactions changed the header hash")
+		}
+	})
+}
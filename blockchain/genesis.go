@@ -0,0 +1,44 @@
+package blockchain
+
+// How the genesis block works:
+// Every node of a network builds exactly the same first block from the chain parameters
+// (no wallet or clock involved), so nodes start on the same chain instead of each mining
+// their own. Its hash is part of the parameters, and is checked when the db is opened and
+// when peers connect, so nodes from different networks never mix their chains.
+
+// NON-MUTATING FUNCTIONS
+// Build the genesis block of a network
+func genesisBlock(p ChainParams) *Block {
+	coinbase := &Tx{
+		Timestamp: p.GenesisTimestamp,
+		TxIns:     []*TxIn{{TxId: "", Index: 1, Signature: p.CoinbaseAddress}},
+		TxOuts:    []*TxOut{{Address: p.GenesisAddress, Amount: p.MinerReward}},
+	}
+	coinbase.getId()
+	block := &Block{
+		Height:       1,
+		Bits:         p.DefaultBits,
+		Nonce:        p.GenesisNonce,
+		Timestamp:    p.GenesisTimestamp,
+		Transactions: []*Tx{coinbase},
+	}
+	block.MerkleRoot = merkleRoot(txIds(block.Transactions))
+	block.Hash = block.calculateHash()
+	return block
+}
+
+// Find the nonce of the genesis block for new parameters (e.g., a custom network),
+// returning the parameters with GenesisNonce and GenesisHash filled in
+func MineGenesis(p ChainParams) (ChainParams, error) {
+	target := targetFromBits(p.DefaultBits)
+	if target == nil {
+		return ChainParams{}, ErrInvalidParams
+	}
+	block := genesisBlock(p)
+	for !meetsTarget(block.Hash, target) {
+		block.Nonce++
+		block.Hash = block.calculateHash()
+	}
+	p.GenesisNonce, p.GenesisHash = block.Nonce, block.Hash
+	return p, nil
+}
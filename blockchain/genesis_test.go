@@ -0,0 +1,44 @@
+package blockchain
+
+import (
+	"testing"
+)
+
+func TestGenesisBlock(t *testing.T) {
+	t.Run("Genesis block should be the same every time it is built", func(t *testing.T) {
+		first, second := genesisBlock(params), genesisBlock(params)
+		if first.Hash != second.Hash || first.Hash != params.GenesisHash {
+			t.Errorf("Expected genesis hash %s, got %s and %s", params.GenesisHash, first.Hash, second.Hash)
+		}
+	})
+	t.Run("Every network should have a different genesis block", func(t *testing.T) {
+		seen := make(map[string]bool)
+		for _, p := range []ChainParams{mainnetParams, testnetParams, regtestParams} {
+			if seen[p.GenesisHash] {
+				t.Errorf("Genesis block of %s is used by another network", p.Name)
+			}
+			seen[p.GenesisHash] = true
+		}
+	})
+	t.Run("Genesis block should be a valid chain on its own", func(t *testing.T) {
+		if err := validateChain([]*Block{genesisBlock(params)}); err != nil {
+			t.Errorf("Genesis block is not valid: %v", err)
+		}
+	})
+}
+
+func TestMineGenesis(t *testing.T) {
+	p := regtestParams
+	p.GenesisTimestamp++
+	p, err := MineGenesis(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.GenesisHash == regtestParams.GenesisHash || p.validate() != nil {
+		t.Error("MineGenesis() did not find a new valid genesis block")
+	}
+	p.DefaultBits = 0
+	if _, err := MineGenesis(p); err != ErrInvalidParams {
+		t.Errorf("Expected error '%v', got '%v'", ErrInvalidParams, err)
+	}
+}
@@ -0,0 +1,285 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/achung3071/gpcoin/script"
+	"github.com/achung3071/gpcoin/utils"
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+// How HTLCs work:
+// An HTLC (hash time-locked contract) output is locked by the standard HTLC script (see the
+// script package). Its recipient can claim it by revealing a preimage of its hash, and its
+// sender can take it back (refund it) once its lock time is reached: the refund must be locked
+// until then (see locktime.go), so it cannot be in an earlier block.
+//
+// Claiming an HTLC reveals the preimage in the unlocking script, which is what makes atomic
+// swaps between two chains work:
+//  1. Alice picks a secret preimage and locks coins on chain A for Bob with its hash.
+//  2. Bob checks that HTLC, then locks coins on chain B for Alice with the same hash and an
+//     earlier lock time (so Alice cannot get her refund and still claim his coins).
+//  3. Alice claims on chain B, revealing the preimage.
+//  4. Bob reads the preimage from her claim (see FindHTLC()) and claims on chain A.
+// If either of them stops halfway, both get refunds after the lock times, so nobody ends up
+// with both sides. The heights of two chains are unrelated, so each lock time is set on its
+// own chain.
+
+// Where an HTLC stands
+const (
+	HTLCUnspent  string = "unspent"
+	HTLCClaimed  string = "claimed"  // by the recipient, revealing the preimage
+	HTLCRefunded string = "refunded" // to the sender
+)
+
+// HTLC output and where it stands
+type HTLC struct {
+	TxId      string `json:"txId"`
+	Index     int    `json:"index"`
+	Amount    int    `json:"amount"`
+	Script    string `json:"script"`
+	Hash      string `json:"hash"`      // SHA-256 of the preimage that claims it
+	Recipient string `json:"recipient"` // address that can claim it
+	Sender    string `json:"sender"`    // address that can refund it
+	LockTime  int    `json:"lockTime"`  // block height (or unix time) the refund is locked until
+	Status    string `json:"status"`
+	SpentBy   string `json:"spentBy,omitempty"`  // id of the claim or refund
+	Preimage  string `json:"preimage,omitempty"` // revealed by the claim
+}
+
+var errInvalidHTLC error = errors.New("HTLC needs a 32 byte hash, the addresses of its recipient and sender and a lock time above 0")
+var errNotHTLC error = errors.New("output is not an HTLC")
+var errHTLCSpent error = errors.New("HTLC is already claimed or refunded")
+var errNotHTLCRecipient error = errors.New("only the recipient of an HTLC can claim it")
+var errNotHTLCSender error = errors.New("only the sender of an HTLC can refund it")
+var errWrongPreimage error = errors.New("preimage must be in hex and hash to the hash of the HTLC")
+
+// NON-MUTATING FUNCTIONS
+// Make an HTLC script (in hex) that recipient can claim with a preimage of hash, and sender
+// can refund from lockTime on (all in hex, except lockTime)
+func HTLCScript(hash string, recipient string, lockTime int, sender string) (string, error) {
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil || len(hashBytes) != script.HashSize || lockTime < 1 {
+		return "", errInvalidHTLC
+	}
+	keys := [][]byte{}
+	for _, address := range []string{recipient, sender} {
+		key, err := hex.DecodeString(address)
+		if err != nil || len(key) != script.PubKeySize {
+			return "", errInvalidHTLC
+		}
+		keys = append(keys, key)
+	}
+	return hex.EncodeToString(script.NewHTLC(hashBytes, keys[0], lockTime, keys[1])), nil
+}
+
+// Read an HTLC from the output it is locked in (not spent yet)
+func newHTLC(txId string, index int, txOut *TxOut) (*HTLC, error) {
+	data, err := hex.DecodeString(txOut.Script)
+	if err != nil {
+		return nil, errNotHTLC
+	}
+	hash, recipient, lockTime, sender, ok := script.ParseHTLC(data)
+	if !ok {
+		return nil, errNotHTLC
+	}
+	return &HTLC{
+		TxId:      txId,
+		Index:     index,
+		Amount:    txOut.Amount,
+		Script:    txOut.Script,
+		Hash:      hex.EncodeToString(hash),
+		Recipient: hex.EncodeToString(recipient),
+		Sender:    hex.EncodeToString(sender),
+		LockTime:  lockTime,
+		Status:    HTLCUnspent,
+	}, nil
+}
+
+// Find an HTLC output of a transaction in the main chain or the mempool, with whether it was
+// claimed (and its preimage) or refunded
+func FindHTLC(b *blockchain, txId string, index int) (*HTLC, error) {
+	tx := Mempool().findTx(txId)
+	if tx == nil {
+		tx = FindTx(b, txId)
+	}
+	if tx == nil {
+		return nil, ErrTxNotFound
+	}
+	if index < 0 || index >= len(tx.TxOuts) {
+		return nil, errNotHTLC
+	}
+	h, err := newHTLC(txId, index, tx.TxOuts[index])
+	if err != nil {
+		return nil, err
+	}
+	spender := Mempool().findSpender(txId, index)
+	if spender == nil {
+		spender = findSpender(b, txId, index)
+	}
+	if spender == nil {
+		return h, nil
+	}
+	h.SpentBy, h.Status = spender.Id, HTLCRefunded
+	for _, txIn := range spender.TxIns {
+		if txIn.TxId != txId || txIn.Index != index {
+			continue
+		}
+		unlocking, err := hex.DecodeString(txIn.Script)
+		if preimage, ok := script.HTLCPreimage(unlocking); err == nil && ok {
+			h.Status, h.Preimage = HTLCClaimed, hex.EncodeToString(preimage)
+		}
+	}
+	return h, nil
+}
+
+// Checks if a transaction spends the given output
+func spends(tx *Tx, txId string, index int) bool {
+	for _, txIn := range tx.TxIns {
+		if txIn.TxId == txId && txIn.Index == index {
+			return true
+		}
+	}
+	return false
+}
+
+// Find a mempool transaction by id (nil if it is not in the mempool)
+func (m *mempool) findTx(txId string) *Tx {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.Txs[txId]
+}
+
+// Find the mempool transaction spending an output (nil if there is none)
+func (m *mempool) findSpender(txId string, index int) *Tx {
+	m.m.Lock()
+	defer m.m.Unlock()
+	for _, tx := range m.Txs {
+		if spends(tx, txId, index) {
+			return tx
+		}
+	}
+	return nil
+}
+
+// Find the transaction of the main chain spending an output, looking back from the last
+// block to the block of the output's transaction (nil if there is none)
+func findSpender(b *blockchain, txId string, index int) *Tx {
+	b.m.Lock()
+	defer b.m.Unlock()
+	data := dbStorage.FindTxLocation(txId)
+	if data == nil || savedUTxOutSet().find(uTxOutKey(txId, index)) != nil {
+		return nil // not in the main chain, or still unspent
+	}
+	var location txLocation
+	utils.FromBytes(&location, data)
+	for block := findChainBlock(b.LastHash); block != nil; block = findChainBlock(block.PrevHash) {
+		for _, tx := range block.Transactions {
+			if spends(tx, txId, index) {
+				return tx
+			}
+		}
+		if block.Hash == location.BlockHash {
+			break
+		}
+	}
+	return nil
+}
+
+// Build a transaction spending an unspent HTLC to an address (leaving fee for the miner), whose
+// input is unlocked by the script unlock makes from the id of the transaction
+func spendHTLC(h *HTLC, to string, fee int, lockTime int, unlock func(txId string) script.Script) (*Tx, error) {
+	if h.Status != HTLCUnspent {
+		return nil, errHTLCSpent
+	}
+	if fee < 0 {
+		return nil, errInvalidFee
+	}
+	if fee >= h.Amount {
+		return nil, errNoMoney
+	}
+	tx := &Tx{
+		Timestamp: int(time.Now().Unix()),
+		TxIns:     []*TxIn{{TxId: h.TxId, Index: h.Index}},
+		TxOuts:    []*TxOut{{Address: to, Amount: h.Amount - fee}},
+		LockTime:  lockTime,
+	}
+	tx.getId()
+	tx.TxIns[0].Script = hex.EncodeToString(unlock(tx.Id))
+	return tx, nil
+}
+
+// Signature of a transaction id by our wallet
+func walletSignature(txId string) []byte {
+	signature, err := hex.DecodeString(wallet.Sign(txId, wallet.Wallet()))
+	utils.ErrorHandler(err)
+	return signature
+}
+
+// MUTATING FUNCTIONS
+// Lock amount in an HTLC from our wallet to recipient (see HTLCScript()), returning the
+// transaction added to the mempool and the HTLC
+func (m *mempool) AddHTLC(hash string, recipient string, lockTime int, amount int, options TxOptions) (*Tx, *HTLC, error) {
+	lockingScript, err := HTLCScript(hash, recipient, lockTime, wallet.Wallet().Address)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := m.AddTx([]Payment{{Amount: amount, Script: lockingScript}}, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	index := len(tx.TxOuts) - 1 // the payment comes after the change
+	h, err := newHTLC(tx.Id, index, tx.TxOuts[index])
+	utils.ErrorHandler(err)
+	return tx, h, nil
+}
+
+// Claim an HTLC to our wallet with its preimage (in hex), returning the transaction added
+// to the mempool
+func (m *mempool) ClaimHTLC(txId string, index int, preimage string, fee int) (*Tx, error) {
+	h, err := FindHTLC(Blockchain(), txId, index)
+	if err != nil {
+		return nil, err
+	}
+	if h.Recipient != wallet.Wallet().Address {
+		return nil, errNotHTLCRecipient
+	}
+	preimageBytes, err := hex.DecodeString(preimage)
+	if err != nil || hex.EncodeToString(script.Hash(preimageBytes)) != h.Hash {
+		return nil, errWrongPreimage
+	}
+	tx, err := spendHTLC(h, h.Recipient, fee, 0, func(txId string) script.Script {
+		return script.NewHTLCClaim(walletSignature(txId), preimageBytes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := m.AddTxFromPeer(tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Refund an HTLC we sent back to our wallet, returning the transaction added to the mempool
+// (which only takes it once the next block is at the lock time of the HTLC)
+func (m *mempool) RefundHTLC(txId string, index int, fee int) (*Tx, error) {
+	h, err := FindHTLC(Blockchain(), txId, index)
+	if err != nil {
+		return nil, err
+	}
+	if h.Sender != wallet.Wallet().Address {
+		return nil, errNotHTLCSender
+	}
+	tx, err := spendHTLC(h, h.Sender, fee, h.LockTime, func(txId string) script.Script {
+		return script.NewHTLCRefund(walletSignature(txId))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := m.AddTxFromPeer(tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
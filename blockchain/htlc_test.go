@@ -0,0 +1,256 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/achung3071/gpcoin/script"
+	"github.com/achung3071/gpcoin/utils"
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+// Load the chain saved in db as the main chain, with an empty mempool (e.g., to switch
+// between the two chains of a swap)
+func switchTestChain(db *fakeDB) *blockchain {
+	dbStorage = db
+	once = *new(sync.Once)
+	bc := Blockchain()
+	setTestMempool()
+	return bc
+}
+
+// Mine the mempool transactions into the next block of the main chain
+func mineTestMempool(bc *blockchain) {
+	txs := []*Tx{}
+	for _, tx := range Mempool().Txs {
+		txs = append(txs, tx)
+	}
+	utils.ErrorHandler(bc.AddBlockFromPeer(mineTestBlock(bc, txs...)))
+}
+
+func TestHTLCScript(t *testing.T) {
+	_, alice := makeTestKeyholder()
+	_, bob := makeTestKeyholder()
+	hash := hex.EncodeToString(script.Hash([]byte("secret")))
+	type test struct {
+		name      string
+		hash      string
+		recipient string
+		lockTime  int
+		expected  error
+	}
+	tests := []test{
+		{"Valid HTLC", hash, bob, 10, nil},
+		{"Hash that is not hex", "xyz", bob, 10, errInvalidHTLC},
+		{"Hash of the wrong size", hash[2:], bob, 10, errInvalidHTLC},
+		{"Recipient that is not an address", hash, "bob", 10, errInvalidHTLC},
+		{"No lock time", hash, bob, 0, errInvalidHTLC},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lockingScript, err := HTLCScript(tc.hash, tc.recipient, tc.lockTime, alice)
+			if err != tc.expected {
+				t.Fatalf("Expected %v, got %v", tc.expected, err)
+			}
+			if err != nil {
+				return
+			}
+			h, err := newHTLC("ab", 0, &TxOut{Amount: 1, Script: lockingScript})
+			if err != nil || h.Hash != tc.hash || h.Recipient != tc.recipient || h.Sender != alice || h.LockTime != tc.lockTime {
+				t.Errorf("Expected to read back the HTLC, got %v (%v)", h, err)
+			}
+		})
+	}
+	t.Run("Other outputs should not be HTLCs", func(t *testing.T) {
+		if _, err := newHTLC("ab", 0, &TxOut{Address: alice, Amount: 1}); err != errNotHTLC {
+			t.Errorf("Expected %v, got %v", errNotHTLC, err)
+		}
+	})
+}
+
+func TestHTLC(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	bc, _ := useTestChain(3)
+	setTestMempool()
+	from := wallet.Wallet().Address
+	preimage := hex.EncodeToString([]byte("secret"))
+	hash := hex.EncodeToString(script.Hash([]byte("secret")))
+	_, other := makeTestKeyholder()
+
+	// HTLCs to ourselves, so we can both claim and refund them
+	claimable, claimableHTLC, err := Mempool().AddHTLC(hash, from, 100, 20, TxOptions{Fee: 1})
+	if err != nil {
+		t.Fatalf("AddHTLC() failed: %v", err)
+	}
+	refundable, refundableHTLC, err := Mempool().AddHTLC(hash, from, bc.Height+4, 10, TxOptions{Fee: 1})
+	utils.ErrorHandler(err)
+	_, otherHTLC, err := Mempool().AddHTLC(hash, other, 100, 10, TxOptions{Fee: 1})
+	utils.ErrorHandler(err)
+	mineTestMempool(bc)
+
+	t.Run("HTLCs should be found with their terms", func(t *testing.T) {
+		h, err := FindHTLC(bc, claimable.Id, claimableHTLC.Index)
+		if err != nil || h.Status != HTLCUnspent || h.Amount != 20 || h.Hash != hash || h.Sender != from || h.LockTime != 100 {
+			t.Errorf("Expected the unspent HTLC, got %v (%v)", h, err)
+		}
+		if _, err := FindHTLC(bc, claimable.Id, 0); err != errNotHTLC {
+			t.Errorf("Expected the change not to be an HTLC, got %v", err)
+		}
+		if _, err := FindHTLC(bc, "ab", 0); err != ErrTxNotFound {
+			t.Errorf("Expected %v, got %v", ErrTxNotFound, err)
+		}
+	})
+	t.Run("Claims should need the preimage and the recipient", func(t *testing.T) {
+		if _, err := Mempool().ClaimHTLC(claimable.Id, claimableHTLC.Index, hex.EncodeToString([]byte("guess")), 1); err != errWrongPreimage {
+			t.Errorf("Expected %v, got %v", errWrongPreimage, err)
+		}
+		if _, err := Mempool().ClaimHTLC(otherHTLC.TxId, otherHTLC.Index, preimage, 1); err != errNotHTLCRecipient {
+			t.Errorf("Expected %v, got %v", errNotHTLCRecipient, err)
+		}
+		if _, err := Mempool().ClaimHTLC(claimable.Id, claimableHTLC.Index, preimage, 20); err != errNoMoney {
+			t.Errorf("Expected %v for a fee of the whole amount, got %v", errNoMoney, err)
+		}
+	})
+	t.Run("Claims should reveal the preimage", func(t *testing.T) {
+		claim, err := Mempool().ClaimHTLC(claimable.Id, claimableHTLC.Index, preimage, 1)
+		if err != nil {
+			t.Fatalf("ClaimHTLC() failed: %v", err)
+		}
+		for _, mined := range []bool{false, true} {
+			h, err := FindHTLC(bc, claimable.Id, claimableHTLC.Index)
+			if err != nil || h.Status != HTLCClaimed || h.SpentBy != claim.Id || h.Preimage != preimage {
+				t.Errorf("Expected the claim to reveal the preimage (mined: %t), got %v (%v)", mined, h, err)
+			}
+			if !mined {
+				mineTestMempool(bc)
+			}
+		}
+		if _, err := Mempool().ClaimHTLC(claimable.Id, claimableHTLC.Index, preimage, 1); err != errHTLCSpent {
+			t.Errorf("Expected %v, got %v", errHTLCSpent, err)
+		}
+	})
+	t.Run("Refunds should wait for the lock time", func(t *testing.T) {
+		var rejection *TxRejectError
+		if _, err := Mempool().RefundHTLC(refundable.Id, refundableHTLC.Index, 1); !errors.As(err, &rejection) || !errors.Is(err, ErrTxLockTime) {
+			t.Errorf("Expected %v before the lock time, got %v", ErrTxLockTime, err)
+		}
+		mineTestMempool(bc) // the next block is at the lock time
+		refund, err := Mempool().RefundHTLC(refundable.Id, refundableHTLC.Index, 1)
+		if err != nil {
+			t.Fatalf("RefundHTLC() failed at the lock time: %v", err)
+		}
+		mineTestMempool(bc)
+		h, err := FindHTLC(bc, refundable.Id, refundableHTLC.Index)
+		if err != nil || h.Status != HTLCRefunded || h.SpentBy != refund.Id || h.Preimage != "" {
+			t.Errorf("Expected the HTLC to be refunded, got %v (%v)", h, err)
+		}
+	})
+	t.Run("Refunds should not be in a block before the lock time", func(t *testing.T) {
+		_, h, err := Mempool().AddHTLC(hash, from, bc.Height+3, 10, TxOptions{Fee: 1})
+		utils.ErrorHandler(err)
+		mineTestMempool(bc)
+		refund, err := spendHTLC(h, from, 1, h.LockTime-1, func(txId string) script.Script { // too early a lock time
+			return script.NewHTLCRefund(walletSignature(txId))
+		})
+		utils.ErrorHandler(err)
+		if err := bc.AddBlockFromPeer(mineTestBlock(bc, refund)); !errors.Is(err, ErrTxScriptLockTime) {
+			t.Errorf("Expected %v for a refund locked until before the HTLC's lock time, got %v", ErrTxScriptLockTime, err)
+		}
+		var rejection *TxRejectError
+		if err := Mempool().AddTxFromPeer(refund); !errors.As(err, &rejection) || rejection.Code != "script-lock-time" {
+			t.Errorf("Expected the mempool to reject the refund with code script-lock-time, got %v", err)
+		}
+	})
+}
+
+// Swap between two chains: we (Alice) trade 30 coins on chain A for 20 coins of Bob on chain B
+func TestAtomicSwap(t *testing.T) {
+	oldStorage, oldParams := dbStorage, params
+	defer func() { dbStorage, params = oldStorage, oldParams }()
+	defer setTestMempool()
+	alice := wallet.Wallet().Address
+	// Both chains are regtest chains (as when trying swaps locally), paying the test wallet at genesis
+	p := regtestParams
+	p.GenesisAddress = alice
+	p, err := MineGenesis(p)
+	utils.ErrorHandler(err)
+	utils.ErrorHandler(SetParams(p))
+	bobKey, bob := makeTestKeyholder()
+	secret := hex.EncodeToString([]byte("swap secret"))
+	hash := hex.EncodeToString(script.Hash([]byte("swap secret")))
+
+	chainA, chainB := newFakeDB(), newFakeDB()
+	dbStorage = chainA
+	useTestChain(3)
+	dbStorage = chainB
+	useTestChain(5)
+
+	// 1. Alice locks 30 coins for Bob on chain A
+	bc := switchTestChain(chainA)
+	_, aliceHTLC, err := Mempool().AddHTLC(hash, bob, bc.Height+20, 30, TxOptions{Fee: 1})
+	if err != nil {
+		t.Fatalf("Alice could not lock her coins: %v", err)
+	}
+	mineTestMempool(bc)
+
+	// 2. Bob checks her HTLC, then locks 20 coins for Alice on chain B with the same hash
+	// and an earlier lock time (his coins on chain B are paid to him by Alice for the test)
+	bc = switchTestChain(chainB)
+	bobCoins, err := makeTx(alice, []Payment{{bob, 25, ""}}, TxOptions{})
+	utils.ErrorHandler(err)
+	utils.ErrorHandler(bc.AddBlockFromPeer(mineTestBlock(bc, bobCoins)))
+	lockingScript, err := HTLCScript(aliceHTLC.Hash, alice, bc.Height+10, bob)
+	utils.ErrorHandler(err)
+	bobLock := &Tx{
+		TxIns:  []*TxIn{{TxId: bobCoins.Id, Index: 1}},
+		TxOuts: []*TxOut{{Address: bob, Amount: 4}, {Amount: 20, Script: lockingScript}},
+	}
+	bobLock.getId()
+	bobLock.TxIns[0].Signature = signTestKeyholder(bobKey, bobLock.Id)
+	if err := Mempool().AddTxFromPeer(bobLock); err != nil {
+		t.Fatalf("Bob could not lock his coins: %v", err)
+	}
+	mineTestMempool(bc)
+
+	// 3. Alice claims Bob's coins on chain B, revealing the secret
+	if _, err := Mempool().ClaimHTLC(bobLock.Id, 1, secret, 1); err != nil {
+		t.Fatalf("Alice could not claim Bob's coins: %v", err)
+	}
+	mineTestMempool(bc)
+	bobHTLC, err := FindHTLC(bc, bobLock.Id, 1)
+	if err != nil || bobHTLC.Status != HTLCClaimed || bobHTLC.Preimage != secret {
+		t.Fatalf("Expected Alice's claim to reveal the secret, got %v (%v)", bobHTLC, err)
+	}
+
+	// 4. Bob claims Alice's coins on chain A with the secret from her claim
+	bc = switchTestChain(chainA)
+	preimage, _ := hex.DecodeString(bobHTLC.Preimage)
+	h, err := FindHTLC(bc, aliceHTLC.TxId, aliceHTLC.Index)
+	utils.ErrorHandler(err)
+	bobClaim, err := spendHTLC(h, bob, 1, 0, func(txId string) script.Script {
+		signature, _ := hex.DecodeString(signTestKeyholder(bobKey, txId))
+		return script.NewHTLCClaim(signature, preimage)
+	})
+	utils.ErrorHandler(err)
+	if err := Mempool().AddTxFromPeer(bobClaim); err != nil {
+		t.Fatalf("Bob could not claim Alice's coins: %v", err)
+	}
+	mineTestMempool(bc)
+
+	t.Run("Both sides should be claimed", func(t *testing.T) {
+		if h, err := FindHTLC(bc, aliceHTLC.TxId, aliceHTLC.Index); err != nil || h.Status != HTLCClaimed {
+			t.Errorf("Expected Bob's claim on chain A, got %v (%v)", h, err)
+		}
+		if balance := BalanceByAddress(bob, bc); balance != 29 {
+			t.Errorf("Expected Bob to have 29 coins on chain A, got %d", balance)
+		}
+		if _, err := Mempool().RefundHTLC(aliceHTLC.TxId, aliceHTLC.Index, 1); err != errHTLCSpent {
+			t.Errorf("Expected Alice not to get a refund after the swap, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package blockchain
+
+import (
+	"errors"
+	"sort"
+)
+
+// How lock times work:
+// A transaction with a lock time cannot be in a block before it, so a payment can be signed
+// now and only become spendable later. Lock times below lockTimeThreshold are block heights
+// (the transaction can be in that block or later ones), and the others are unix times.
+// Times are compared with the median timestamp of the blocks before (median time past), not
+// with the timestamp of the block itself. Block timestamps must be after the median time past
+// and at most maxFutureBlockTime ahead of the clock of the node checking them (see
+// validateHeader()), so a miner can only move the median time past forward by stamping most of
+// the last medianTimeBlocks blocks ahead, and never more than maxFutureBlockTime past the time.
+// A lock time of 0 means the transaction can be in any block.
+//
+// The lock time is part of the canonical encoding (see ENCODING.md), so it is covered by the
+// transaction id and by the signatures. The mempool only takes transactions that can be in
+// the next block, so a transaction locked until later is kept by its sender until then.
+
+const (
+	lockTimeThreshold int = 500000000 // lock times from here on are unix times (1985-11-05)
+	medianTimeBlocks  int = 11        // blocks whose median timestamp time locks are checked against
+)
+
+// Height and median time past of a block, which the lock times of its transactions are checked against
+type lockPoint struct {
+	height     int
+	medianTime int
+}
+
+var ErrTxLockTime error = errors.New("transaction is locked until a later block")
+var ErrTxScriptLockTime error = errors.New("transaction lock time is before the lock time a script of its inputs needs (OP_CHECKLOCKTIMEVERIFY)")
+
+// NON-MUTATING FUNCTIONS
+// Median timestamp of the most recent blocks (newest block first), or 0 without blocks
+func medianTimePast(blocks []*Block) int {
+	if len(blocks) > medianTimeBlocks {
+		blocks = blocks[:medianTimeBlocks]
+	}
+	if len(blocks) == 0 {
+		return 0
+	}
+	timestamps := []int{}
+	for _, block := range blocks {
+		timestamps = append(timestamps, block.Timestamp)
+	}
+	sort.Ints(timestamps)
+	return timestamps[len(timestamps)/2]
+}
+
+// Get the lock point of the block after the given chain of blocks (newest block first)
+func lockPointAfter(blocks []*Block) lockPoint {
+	if len(blocks) == 0 {
+		return lockPoint{height: 1}
+	}
+	return lockPoint{height: blocks[0].Height + 1, medianTime: medianTimePast(blocks)}
+}
+
+// Get the lock point of the next block of the main chain (the blockchain must not be locked)
+func nextLockPoint(b *blockchain) lockPoint {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return lockPointAfter(recentBlocks(b.LastHash))
+}
+
+// Checks if a transaction can be in a block at the given lock point
+func (t *Tx) isFinal(at lockPoint) bool {
+	if t.LockTime < lockTimeThreshold {
+		return t.LockTime <= at.height
+	}
+	return t.LockTime <= at.medianTime
+}
@@ -0,0 +1,121 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Make a signed transaction spending every output of prevTx that cannot be in a block before lockTime
+func makeTestTxWithLockTime(prevTx *Tx, lockTime int) *Tx {
+	tx := makeTestTxWithFee(prevTx, 1)
+	tx.LockTime = lockTime
+	tx.getId()
+	tx.sign()
+	return tx
+}
+
+func TestMedianTimePast(t *testing.T) {
+	blocks := []*Block{}
+	for _, timestamp := range []int{50, 10, 40, 20, 30} {
+		blocks = append(blocks, &Block{Timestamp: timestamp})
+	}
+	if median := medianTimePast(blocks); median != 30 {
+		t.Errorf("Expected a median time of 30, got %d", median)
+	}
+	for i := 0; i < medianTimeBlocks; i++ { // older blocks are left out
+		blocks = append([]*Block{{Timestamp: 100}}, blocks...)
+	}
+	if median := medianTimePast(blocks); median != 100 {
+		t.Errorf("Expected a median time of 100, got %d", median)
+	}
+	if median := medianTimePast(nil); median != 0 {
+		t.Errorf("Expected a median time of 0 without blocks, got %d", median)
+	}
+}
+
+func TestIsFinal(t *testing.T) {
+	at := lockPoint{height: 10, medianTime: 1700000000}
+	type test struct {
+		lockTime int
+		final    bool
+	}
+	tests := []test{
+		{0, true},
+		{9, true},
+		{10, true},
+		{11, false},
+		{lockTimeThreshold - 1, false}, // still a height
+		{1700000000, true},
+		{1700000001, false},
+	}
+	for _, tc := range tests {
+		if final := (&Tx{LockTime: tc.lockTime}).isFinal(at); final != tc.final {
+			t.Errorf("Lock time %d at %v: expected final to be %t, got %t", tc.lockTime, at, tc.final, final)
+		}
+	}
+}
+
+func TestLockTime(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	bc, coinbases := useTestChain(3)
+	setTestMempool()
+	next := bc.Height + 1
+
+	t.Run("Lock times should be covered by the id and signatures", func(t *testing.T) {
+		tx := makeTestTxWithLockTime(coinbases[0], next)
+		tx.LockTime = 0 // e.g., a peer trying to confirm it early
+		if tx.isWellFormed() {
+			t.Error("Changing the lock time did not change the transaction id")
+		}
+	})
+	t.Run("Mempool should only take transactions that can be in the next block", func(t *testing.T) {
+		err := Mempool().AddTxFromPeer(makeTestTxWithLockTime(coinbases[0], next+1))
+		var rejection *TxRejectError
+		if !errors.As(err, &rejection) || !errors.Is(err, ErrTxLockTime) || rejection.Invalid() {
+			t.Errorf("Expected error '%v' (not invalid), got '%v'", ErrTxLockTime, err)
+		}
+		if err := Mempool().AddTxFromPeer(makeTestTxWithLockTime(coinbases[0], next)); err != nil {
+			t.Errorf("AddTxFromPeer() rejected a transaction that can be in the next block: %v", err)
+		}
+	})
+	t.Run("Block templates should leave locked transactions pending", func(t *testing.T) {
+		locked := makeTestTxWithLockTime(coinbases[1], next+1)
+		setTestMempool(locked)
+		txs, _, invalid := Mempool().selectTxs(savedUTxOutSet(), params.MaxBlockSize, lockPoint{height: next})
+		if len(txs) != 0 || len(invalid) != 0 {
+			t.Errorf("Expected no transactions picked or invalid, got %d and %d", len(txs), len(invalid))
+		}
+	})
+	t.Run("Blocks should not include transactions locked until a later block", func(t *testing.T) {
+		err := bc.AddBlockFromPeer(mineTestBlock(bc, makeTestTxWithLockTime(coinbases[1], next+1)))
+		if err != ErrTxLockTime {
+			t.Errorf("Expected error '%v', got '%v'", ErrTxLockTime, err)
+		}
+		if err := bc.AddBlockFromPeer(mineTestBlock(bc, makeTestTxWithLockTime(coinbases[1], next))); err != nil {
+			t.Errorf("AddBlockFromPeer() rejected a transaction locked until its height: %v", err)
+		}
+	})
+	t.Run("Miners should not be able to reach a time lock early", func(t *testing.T) {
+		lockTime := int(time.Now().Unix()) + maxFutureBlockTime + 60*60
+		locked := makeTestTxWithLockTime(coinbases[2], lockTime)
+		block := mineTestBlock(bc, locked)
+		mineTestBlockAt(block, lockTime) // stamped at the lock time
+		if err := bc.AddBlockFromPeer(block); err != ErrFutureTimestamp {
+			t.Errorf("Expected error '%v', got '%v'", ErrFutureTimestamp, err)
+		}
+		for i := 0; i <= medianTimeBlocks/2; i++ { // most of the recent blocks about as far ahead as allowed
+			block := mineTestBlock(bc)
+			mineTestBlockAt(block, int(time.Now().Unix())+maxFutureBlockTime-medianTimeBlocks+i)
+			if err := bc.AddBlockFromPeer(block); err != nil {
+				t.Fatalf("AddBlockFromPeer() rejected a block within the allowed time: %v", err)
+			}
+		}
+		if err := bc.AddBlockFromPeer(mineTestBlock(bc, locked)); err != ErrTxLockTime {
+			t.Errorf("Expected error '%v', got '%v'", ErrTxLockTime, err)
+		}
+	})
+}
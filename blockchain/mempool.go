@@ -0,0 +1,487 @@
+package blockchain
+
+import (
+	"container/heap"
+	"errors"
+	"time"
+
+	"github.com/achung3071/gpcoin/utils"
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+// How mempool admission works:
+// Transactions made by our wallet and transactions relayed by peers go through the same
+// checks before entering the mempool, so that every mempool transaction can be mined
+// (on top of the main chain and the mempool transactions it spends, see unconfirmed.go).
+// A rejected transaction comes with a TxRejectError saying why, and whether the
+// transaction breaks the rules (so a peer relaying it is misbehaving) or only lost a
+// race with another transaction (e.g., one spending the same output).
+//
+// The mempool is limited to MaxSize bytes of transactions: once it is full, the transactions
+// paying the lowest fee per byte are evicted. Transactions that wait more than MaxAge seconds
+// for a block expire. Either way, the transactions spending their outputs (descendants)
+// are removed with them, since they can no longer be mined.
+// The mempool keeps which of its transactions spend which outputs, and its entries by fee
+// rate and by age, up to date as transactions are added and removed. Admitting a transaction
+// looks up only the outputs it spends (in the mempool transactions or the db) and the
+// transactions it conflicts with, and evicting or expiring transactions only goes through
+// the transactions removed, so none of them goes through the whole mempool.
+//
+// Changes to the mempool are saved in the db, so pending transactions survive a restart.
+// They are loaded again when the blockchain is, and only kept if they are still valid on
+// top of the main chain.
+
+// What the mempool keeps (node policy, so not part of the chain parameters)
+type MempoolPolicy struct {
+	MaxSize       int  `json:"maxSize"`       // most bytes of transactions (see Tx.size())
+	MaxAge        int  `json:"maxAge"`        // seconds a transaction can wait for a block
+	ReplaceByFee  bool `json:"replaceByFee"`  // whether conflicting transactions can replace others (see replace.go)
+	MinFeeBump    int  `json:"minFeeBump"`    // how much more a replacement must pay than what it replaces
+	MaxChainDepth int  `json:"maxChainDepth"` // longest chain of mempool transactions (see unconfirmed.go)
+}
+
+// Details of a mempool transaction
+type mempoolEntry struct {
+	feeRate  // fee and size, found once when the transaction is added
+	tx       *Tx
+	added    int // when the transaction entered the mempool (unix time)
+	index    int // position in the mempool's byFeeRate heap
+	ageIndex int // position in the mempool's byAge heap
+}
+
+// Mempool entries, lowest fee rate first (see container/heap), so the next to evict is on top
+type entryHeap []*mempoolEntry
+
+// Mempool entries, oldest first, so the next to expire is on top
+type ageHeap []*mempoolEntry
+
+// Mempool transaction as saved in the db
+type savedMempoolTx struct {
+	Tx    *Tx
+	Added int
+}
+
+// Counts of transactions removed from the mempool without being mined
+type MempoolStats struct {
+	Evicted  int `json:"evicted"`  // to stay under MaxSize (including descendants)
+	Expired  int `json:"expired"`  // after MaxAge (including descendants)
+	Replaced int `json:"replaced"` // by transactions paying a higher fee (including descendants)
+}
+
+// Transactions of the mempool, with how full it is and what it has removed
+type MempoolStatus struct {
+	Txs   map[string]*Tx `json:"txs"`
+	Count int            `json:"count"`
+	Size  int            `json:"size"`
+	MempoolPolicy
+	MempoolStats
+}
+
+// Reason a transaction was not added to the mempool
+type TxRejectError struct {
+	TxId   string `json:"txId"`
+	Code   string `json:"code"`   // short name of the reason, e.g., "bad-signature"
+	Reason string `json:"reason"` // message of the underlying error
+	err    error
+}
+
+// Reasons for rejecting a transaction from the mempool (along with the ErrTx errors of validateTx())
+var (
+	ErrTxMalformed       error = errors.New("transaction is missing data or its id does not match its data")
+	ErrTxCoinbase        error = errors.New("coinbase transactions can only be in blocks")
+	ErrTxInMempool       error = errors.New("transaction is already in the mempool")
+	ErrTxMempoolConflict error = errors.New("transaction spends an output already spent by a mempool transaction")
+	ErrTxMempoolFull     error = errors.New("mempool is full of transactions paying a higher fee rate")
+	ErrTxReplacementFee  error = errors.New("transaction does not pay enough more than the transactions it would replace")
+	ErrTxChainTooLong    error = errors.New("transaction has too many unconfirmed ancestors")
+)
+
+var ErrInvalidMempoolPolicy error = errors.New("mempool size, age and chain depth limits must be positive, and fee bumps cannot be negative")
+
+var mempoolPolicy = MempoolPolicy{
+	MaxSize:       5000000,        // room for about 50 full blocks
+	MaxAge:        14 * 24 * 3600, // two weeks
+	MinFeeBump:    1,
+	MaxChainDepth: 25,
+}
+
+// Code of each rejection reason, and whether it means the transaction breaks the rules
+var rejectCodes = map[error]struct {
+	code    string
+	invalid bool
+}{
+	ErrTxMalformed:       {"malformed", true},
+	ErrTxCoinbase:        {"coinbase", true},
+	ErrTxNoInputs:        {"no-inputs", true},
+	ErrTxBadSignature:    {"bad-signature", true},
+	ErrTxBadAmount:       {"bad-amount", true},
+	ErrTxOverspending:    {"overspending", true},
+	ErrTxInputSpent:      {"input-spent", false}, // e.g., the peer has not seen our newest block yet
+	ErrTxInMempool:       {"duplicate", false},
+	ErrTxMempoolConflict: {"mempool-conflict", false},
+	ErrTxMempoolFull:     {"mempool-full", false},
+	ErrTxReplacementFee:  {"replacement-fee", false},
+	ErrTxChainTooLong:    {"chain-too-long", false},
+	ErrTxLockTime:        {"non-final", false}, // e.g., the peer has seen a newer block than us
+	ErrTxScriptLockTime:  {"script-lock-time", true},
+}
+
+// NON-MUTATING FUNCTIONS
+// Get the transactions of the mempool and its counters
+func MempoolInfo(m *mempool) MempoolStatus {
+	m.m.Lock()
+	defer m.m.Unlock()
+	txs := make(map[string]*Tx)
+	for id, tx := range m.Txs {
+		txs[id] = tx
+	}
+	return MempoolStatus{
+		Txs:           txs,
+		Count:         len(m.Txs),
+		Size:          m.size,
+		MempoolPolicy: mempoolPolicy,
+		MempoolStats:  m.stats,
+	}
+}
+
+// Reject a transaction for one of the reasons in rejectCodes
+func rejectTx(tx *Tx, err error) *TxRejectError {
+	txId := ""
+	if tx != nil {
+		txId = tx.Id
+	}
+	return &TxRejectError{TxId: txId, Code: rejectCodes[err].code, Reason: err.Error(), err: err}
+}
+
+func (e *TxRejectError) Error() string {
+	return e.Reason
+}
+
+// Get the underlying error (e.g., for errors.Is(err, ErrTxBadSignature))
+func (e *TxRejectError) Unwrap() error {
+	return e.err
+}
+
+// Checks if the transaction was rejected for breaking the rules, rather than for
+// conflicting with the chain or the mempool (which can happen to honest nodes)
+func (e *TxRejectError) Invalid() bool {
+	return rejectCodes[e.err].invalid
+}
+
+func (h entryHeap) Len() int           { return len(h) }
+func (h entryHeap) Less(i, j int) bool { return h[j].higherThan(h[i].feeRate) }
+
+func (h ageHeap) Len() int           { return len(h) }
+func (h ageHeap) Less(i, j int) bool { return h[i].added < h[j].added }
+
+// Get the ids of the mempool transactions spending an output that a transaction spends
+func (m *mempool) conflicts(tx *Tx) []string {
+	ids := []string{}
+	seen := make(map[string]bool)
+	for _, txIn := range tx.TxIns {
+		if id, ok := m.spentBy[uTxOutKey(txIn.TxId, txIn.Index)]; ok && !seen[id] {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+	}
+	return ids
+}
+
+// Get the ids of the mempool transactions spending the outputs of a transaction,
+// their children, and so on
+func (m *mempool) descendants(txId string) []string {
+	found := make(map[string]bool)
+	queue := []string{txId}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for child := range m.children[id] {
+			if !found[child] {
+				found[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	ids := []string{}
+	for id := range found {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// MUTATING FUNCTIONS
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	entry := x.(*mempoolEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+func (h ageHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].ageIndex, h[j].ageIndex = i, j
+}
+
+func (h *ageHeap) Push(x interface{}) {
+	entry := x.(*mempoolEntry)
+	entry.ageIndex = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *ageHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// Change the policy of the mempool (e.g., from the command line)
+func SetMempoolPolicy(policy MempoolPolicy) error {
+	if policy.MaxSize <= 0 || policy.MaxAge <= 0 || policy.MaxChainDepth <= 0 || policy.MinFeeBump < 0 {
+		return ErrInvalidMempoolPolicy
+	}
+	mempoolPolicy = policy
+	return nil
+}
+
+// Empty the mempool (without saving the change)
+func (m *mempool) clear() {
+	m.Txs, m.entries, m.byFeeRate, m.byAge = make(map[string]*Tx), make(map[string]*mempoolEntry), nil, nil
+	m.spentBy, m.children = make(map[string]string), make(map[string]map[string]bool)
+	m.size = 0
+}
+
+// Put a transaction paying fee in the mempool, as if it arrived at the time added
+func (m *mempool) add(tx *Tx, fee int, added int) {
+	entry := &mempoolEntry{feeRate: feeRate{txId: tx.Id, fee: fee, size: tx.size()}, tx: tx, added: added}
+	m.Txs[tx.Id] = tx
+	m.entries[tx.Id] = entry
+	heap.Push(&m.byFeeRate, entry)
+	heap.Push(&m.byAge, entry)
+	for _, txIn := range tx.TxIns {
+		m.spentBy[uTxOutKey(txIn.TxId, txIn.Index)] = tx.Id
+		if m.children[txIn.TxId] == nil {
+			m.children[txIn.TxId] = make(map[string]bool)
+		}
+		m.children[txIn.TxId][tx.Id] = true
+	}
+	m.size += entry.size
+	m.unsaved[tx.Id] = true
+}
+
+// Take a transaction out of the mempool (e.g., once it is in a block)
+func (m *mempool) remove(txId string) {
+	entry, ok := m.entries[txId]
+	if !ok {
+		return
+	}
+	for _, txIn := range entry.tx.TxIns {
+		if key := uTxOutKey(txIn.TxId, txIn.Index); m.spentBy[key] == txId {
+			delete(m.spentBy, key)
+		}
+		delete(m.children[txIn.TxId], txId)
+		if len(m.children[txIn.TxId]) == 0 {
+			delete(m.children, txIn.TxId)
+		}
+	}
+	heap.Remove(&m.byFeeRate, entry.index)
+	heap.Remove(&m.byAge, entry.ageIndex)
+	m.size -= entry.size
+	delete(m.entries, txId)
+	delete(m.Txs, txId)
+	m.unsaved[txId] = true
+}
+
+// Take a transaction and its descendants out of the mempool, returning their entries
+// (so they can be put back, see restore())
+func (m *mempool) removeWithDescendants(txId string) []*mempoolEntry {
+	removed := []*mempoolEntry{}
+	for _, id := range append(m.descendants(txId), txId) {
+		if entry, ok := m.entries[id]; ok {
+			removed = append(removed, entry)
+		}
+		m.remove(id)
+	}
+	return removed
+}
+
+// Put back transactions taken out of the mempool, as they were
+func (m *mempool) restore(entries []*mempoolEntry) {
+	for _, entry := range entries {
+		m.add(entry.tx, entry.fee, entry.added)
+	}
+}
+
+// Remove the transactions that have waited longer than MaxAge at the time now
+func (m *mempool) expire(now int) {
+	for len(m.byAge) > 0 && now-m.byAge[0].added > mempoolPolicy.MaxAge {
+		m.stats.Expired += len(m.removeWithDescendants(m.byAge[0].txId))
+	}
+}
+
+// Evict the transactions paying the lowest fee rate until the mempool is under MaxSize,
+// returning their entries
+func (m *mempool) trim() []*mempoolEntry {
+	evicted := []*mempoolEntry{}
+	for m.size > mempoolPolicy.MaxSize {
+		evicted = append(evicted, m.removeWithDescendants(m.byFeeRate[0].txId)...)
+	}
+	m.stats.Evicted += len(evicted)
+	return evicted
+}
+
+// Save the transactions added or removed since the mempool was last saved
+func (m *mempool) save() {
+	if len(m.unsaved) == 0 {
+		return
+	}
+	changes := make(map[string][]byte)
+	for id := range m.unsaved {
+		if entry, ok := m.entries[id]; ok {
+			changes[id] = utils.ToBytes(savedMempoolTx{m.Txs[id], entry.added})
+		} else {
+			changes[id] = nil
+		}
+	}
+	dbStorage.SaveMempool(changes)
+	m.unsaved = make(map[string]bool)
+}
+
+// Load the transactions saved in the db, keeping those that are still valid on the main chain
+// (whose next block is at the given lock point)
+func (m *mempool) load(next lockPoint) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	defer m.save()
+	m.clear()
+	for id, data := range dbStorage.LoadMempool() {
+		saved := savedMempoolTx{}
+		utils.FromBytes(&saved, data)
+		m.Txs[id] = saved.Tx // only until revalidate(), which adds the valid ones again
+		m.entries[id] = &mempoolEntry{tx: saved.Tx, added: saved.Added}
+	}
+	m.revalidate(nil, savedUTxOutSet(), next)
+}
+
+// Rebuild the mempool on top of a chain with unspent outputs uTxOuts, from the transactions
+// of blocks that left the chain (orphanedTxs) and the mempool transactions that are still
+// valid and can be in the chain's next block. Transactions keep the time they first entered the mempool.
+func (m *mempool) revalidate(orphanedTxs []*Tx, uTxOuts *uTxOutSet, at lockPoint) {
+	pending := orphanedTxs
+	for id, tx := range m.Txs {
+		pending = append(pending, tx)
+		m.unsaved[id] = true // saved again if it is still valid, or removed if not
+	}
+	oldEntries := m.entries
+	m.clear()
+	now := int(time.Now().Unix())
+	depths := make(map[string]int)
+	for progress := true; progress; { // until no more transactions are added
+		progress = false
+		var next []*Tx // transactions that might spend the outputs of later ones
+		for _, tx := range pending {
+			fee, err := validateTx(tx, uTxOuts)
+			if err != nil || !tx.isFinal(at) || m.depth(tx, depths) > mempoolPolicy.MaxChainDepth {
+				next = append(next, tx)
+				continue
+			}
+			added := now
+			if entry, ok := oldEntries[tx.Id]; ok {
+				added = entry.added // transactions do not get younger by waiting through a reorg
+			}
+			m.add(tx, fee, added)
+			uTxOuts.apply(tx)
+			progress = true
+		}
+		pending = next
+	}
+	m.expire(now)
+	m.trim()
+}
+
+// Add a transaction to the mempool if it can be mined on top of the main chain, in its
+// next block at the given lock point (the mempool must be locked)
+func (m *mempool) admit(tx *Tx, next lockPoint) error {
+	now := int(time.Now().Unix())
+	m.expire(now) // before validating, so tx cannot spend outputs of transactions that expire
+	if !tx.isWellFormed() {
+		return rejectTx(tx, ErrTxMalformed)
+	}
+	if isCoinbase(tx) {
+		return rejectTx(tx, ErrTxCoinbase)
+	}
+	if !tx.isFinal(next) {
+		return rejectTx(tx, ErrTxLockTime)
+	}
+	if _, ok := m.Txs[tx.Id]; ok {
+		return rejectTx(tx, ErrTxInMempool)
+	}
+	fee, err := validateTx(tx, m.pendingUTxOutSet())
+	if err != nil {
+		return rejectTx(tx, err)
+	}
+	if m.depth(tx, make(map[string]int)) > mempoolPolicy.MaxChainDepth {
+		return rejectTx(tx, ErrTxChainTooLong)
+	}
+	// Transactions removed for tx are put back if tx does not stay in the mempool after all
+	stats, removed := m.stats, []*mempoolEntry{}
+	if conflicts := m.conflicts(tx); len(conflicts) > 0 {
+		if err := m.checkReplacement(tx, fee, conflicts); err != nil {
+			return rejectTx(tx, err)
+		}
+		for _, id := range conflicts {
+			replaced := m.removeWithDescendants(id)
+			m.stats.Replaced += len(replaced)
+			removed = append(removed, replaced...)
+		}
+	}
+	m.add(tx, fee, now)
+	for _, entry := range m.trim() {
+		if entry.tx.Id != tx.Id {
+			removed = append(removed, entry)
+		}
+	}
+	if _, ok := m.Txs[tx.Id]; !ok { // paid the lowest fee rate of a full mempool
+		m.restore(removed)
+		m.stats = stats
+		return rejectTx(tx, ErrTxMempoolFull)
+	}
+	return nil
+}
+
+// Add a transaction paying each of payments on the mempool, made as options say
+// (e.g., leaving a fee for the miner)
+func (m *mempool) AddTx(payments []Payment, options TxOptions) (*Tx, error) {
+	tx, err := makeTx(wallet.Wallet().Address, payments, options)
+	if err != nil {
+		return nil, err
+	}
+	next := nextLockPoint(Blockchain())
+	m.m.Lock()
+	defer m.m.Unlock()
+	defer m.save()
+	if err := m.admit(tx, next); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Add a transaction from a peer on the network (see TxRejectError for why it can be rejected)
+func (m *mempool) AddTxFromPeer(tx *Tx) error {
+	next := nextLockPoint(Blockchain())
+	m.m.Lock()
+	defer m.m.Unlock()
+	defer m.save()
+	return m.admit(tx, next)
+}
@@ -0,0 +1,247 @@
+package blockchain
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/achung3071/gpcoin/utils"
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+func TestAddTxFromPeer(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	_, coinbases := useTestChain(3)
+
+	accepted := makeTestTxWithFee(coinbases[0], 1)
+	setTestMempool()
+	if err := Mempool().AddTxFromPeer(accepted); err != nil {
+		t.Fatalf("AddTxFromPeer() rejected a valid transaction: %v", err)
+	}
+	if _, ok := Mempool().Txs[accepted.Id]; !ok {
+		t.Fatal("AddTxFromPeer() did not add the transaction to the mempool")
+	}
+
+	t.Run("AddTxFromPeer() should reject transactions with a reason", func(t *testing.T) {
+		badSignature := makeTestTxWithFee(coinbases[1], 0)
+		badSignature.TxIns[0].Signature = wallet.Sign(coinbases[1].Id, wallet.Wallet())
+		tampered := makeTestTxWithFee(coinbases[1], 0)
+		tampered.TxOuts[0].Amount++
+		overspending := makeTestTxWithFee(coinbases[1], -1)
+		type test struct {
+			name    string
+			tx      *Tx
+			err     error
+			code    string
+			invalid bool
+		}
+		tests := []test{
+			{"missing transaction", nil, ErrTxMalformed, "malformed", true},
+			{"id not matching data", tampered, ErrTxMalformed, "malformed", true},
+			{"coinbase", createCoinbaseTx(4, 0), ErrTxCoinbase, "coinbase", true},
+			{"no inputs", &Tx{Id: (&Tx{}).calculateId()}, ErrTxNoInputs, "no-inputs", true},
+			{"bad signature", badSignature, ErrTxBadSignature, "bad-signature", true},
+			{"outputs exceeding inputs", overspending, ErrTxOverspending, "overspending", true},
+			{"unknown input", makeTestTxWithFee(&Tx{Id: "x", TxOuts: []*TxOut{{"", 1, ""}}}, 0), ErrTxInputSpent, "input-spent", false},
+			{"same transaction twice", accepted, ErrTxInMempool, "duplicate", false},
+			{"input spent in the mempool", makeTestTxWithFee(coinbases[0], 2), ErrTxMempoolConflict, "mempool-conflict", false},
+		}
+		for _, tc := range tests {
+			err := Mempool().AddTxFromPeer(tc.tx)
+			var rejection *TxRejectError
+			if !errors.As(err, &rejection) || !errors.Is(err, tc.err) {
+				t.Errorf("Transaction with %s: expected error '%v', got '%v'", tc.name, tc.err, err)
+				continue
+			}
+			if rejection.Code != tc.code || rejection.Invalid() != tc.invalid {
+				t.Errorf("Transaction with %s: expected code %s (invalid: %t), got %s (invalid: %t)",
+					tc.name, tc.code, tc.invalid, rejection.Code, rejection.Invalid())
+			}
+		}
+		if len(Mempool().Txs) != 1 {
+			t.Errorf("Expected only the valid transaction in the mempool, got %d transactions", len(Mempool().Txs))
+		}
+	})
+}
+
+func TestMempoolPolicy(t *testing.T) {
+	oldStorage, oldLimits := dbStorage, mempoolPolicy
+	defer func() { dbStorage, mempoolPolicy = oldStorage, oldLimits }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	_, coinbases := useTestChain(4)
+
+	low, mid, high := makeTestTxWithFee(coinbases[0], 5), makeTestTxWithFee(coinbases[1], 10), makeTestTxWithFee(coinbases[2], 20)
+	if err := SetMempoolPolicy(MempoolPolicy{MaxSize: 0, MaxAge: 1}); err != ErrInvalidMempoolPolicy {
+		t.Errorf("Expected error '%v', got '%v'", ErrInvalidMempoolPolicy, err)
+	}
+	utils.ErrorHandler(SetMempoolPolicy(MempoolPolicy{MaxSize: low.size() + mid.size(), MaxAge: 3600, MaxChainDepth: 25}))
+
+	t.Run("Transactions paying the lowest fee rate should be evicted when full", func(t *testing.T) {
+		setTestMempool()
+		for _, tx := range []*Tx{low, mid, high} {
+			utils.ErrorHandler(Mempool().AddTxFromPeer(tx))
+		}
+		info := MempoolInfo(Mempool())
+		if _, ok := info.Txs[low.Id]; ok || info.Count != 2 || info.Evicted != 1 {
+			t.Errorf("Expected the lowest paying transaction to be evicted, got %d transactions and %d evicted", info.Count, info.Evicted)
+		}
+		if info.Size != mid.size()+high.size() || info.MaxSize != mempoolPolicy.MaxSize {
+			t.Errorf("Expected a size of %d/%d, got %d/%d", mid.size()+high.size(), mempoolPolicy.MaxSize, info.Size, info.MaxSize)
+		}
+		err := Mempool().AddTxFromPeer(makeTestTxWithFee(coinbases[3], 1))
+		if !errors.Is(err, ErrTxMempoolFull) {
+			t.Errorf("Expected error '%v', got '%v'", ErrTxMempoolFull, err)
+		}
+	})
+	t.Run("Descendants should be evicted with their parents", func(t *testing.T) {
+		setTestMempool()
+		parent := makeTestTxWithFee(coinbases[0], 1)
+		child := makeTestTxWithFee(parent, 30)
+		now := int(time.Now().Unix())
+		Mempool().add(parent, 1, now)
+		Mempool().add(child, 30, now)
+		Mempool().add(high, 20, now)
+		Mempool().trim()
+		info := MempoolInfo(Mempool())
+		if !reflect.DeepEqual(info.Txs, map[string]*Tx{high.Id: high}) || info.Evicted != 2 {
+			t.Errorf("Expected the parent and child to be evicted, got %d transactions and %d evicted", info.Count, info.Evicted)
+		}
+	})
+	t.Run("Transactions should expire after the maximum age", func(t *testing.T) {
+		setTestMempool()
+		parent := makeTestTxWithFee(coinbases[0], 20)
+		child := makeTestTxWithFee(parent, 1)
+		now := int(time.Now().Unix())
+		Mempool().add(parent, 20, now-mempoolPolicy.MaxAge-1)
+		Mempool().add(child, 1, now) // expires with its parent
+		Mempool().add(mid, 10, now-mempoolPolicy.MaxAge)
+		Mempool().expire(now)
+		info := MempoolInfo(Mempool())
+		if !reflect.DeepEqual(info.Txs, map[string]*Tx{mid.Id: mid}) || info.Expired != 2 || info.Size != mid.size() {
+			t.Errorf("Expected the parent and child to expire, got %d transactions and %d expired", info.Count, info.Expired)
+		}
+	})
+	t.Run("Transactions should not spend outputs of transactions that expire", func(t *testing.T) {
+		setTestMempool()
+		parent := makeTestTxWithFee(coinbases[0], 20)
+		Mempool().add(parent, 20, int(time.Now().Unix())-mempoolPolicy.MaxAge-1)
+		if err := Mempool().AddTxFromPeer(makeTestTxWithFee(parent, 1)); !errors.Is(err, ErrTxInputSpent) {
+			t.Errorf("Expected error '%v', got '%v'", ErrTxInputSpent, err)
+		}
+		if len(Mempool().Txs) != 0 {
+			t.Errorf("Expected the parent to expire without its child, got %d transactions", len(Mempool().Txs))
+		}
+	})
+}
+
+func TestMempoolPersistence(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	storage := newFakeDB()
+	dbStorage = storage
+	defer setTestMempool()
+	bc, coinbases := useTestChain(4)
+
+	setTestMempool()
+	confirmed, pending := makeTestTxWithFee(coinbases[0], 1), makeTestTxWithFee(coinbases[1], 2)
+	expired := makeTestTxWithFee(coinbases[2], 3)
+	for _, tx := range []*Tx{confirmed, pending, expired} {
+		utils.ErrorHandler(Mempool().AddTxFromPeer(tx))
+	}
+	added := Mempool().entries[pending.Id].added
+	if len(storage.mempool) != 3 {
+		t.Fatalf("Expected 3 saved transactions, got %d", len(storage.mempool))
+	}
+
+	// Restart with an empty mempool, after a block confirmed one of the transactions
+	setTestMempool()
+	utils.ErrorHandler(bc.AddBlockFromPeer(mineTestBlock(bc, confirmed)))
+	saved := savedMempoolTx{}
+	utils.FromBytes(&saved, storage.mempool[expired.Id])
+	saved.Added -= mempoolPolicy.MaxAge + 1
+	storage.mempool[expired.Id] = utils.ToBytes(saved)
+	Mempool().load(lockPointAfter(recentBlocks(bc.LastHash)))
+
+	t.Run("Transactions still valid on the main chain should be loaded", func(t *testing.T) {
+		if !reflect.DeepEqual(Mempool().Txs, map[string]*Tx{pending.Id: pending}) {
+			t.Errorf("Expected only transaction '%s' in the mempool, got %d transactions", pending.Id, len(Mempool().Txs))
+		}
+		if entry := Mempool().entries[pending.Id]; entry == nil || entry.added != added || entry.fee != 2 {
+			t.Errorf("Expected the transaction to keep its fee and arrival time, got %v", entry)
+		}
+	})
+	t.Run("Transactions no longer in the mempool should be removed from the db", func(t *testing.T) {
+		if _, ok := storage.mempool[pending.Id]; !ok || len(storage.mempool) != 1 {
+			t.Errorf("Expected only transaction '%s' to be saved, got %d transactions", pending.Id, len(storage.mempool))
+		}
+	})
+}
+
+func TestMempoolIndexes(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	_, coinbases := useTestChain(3)
+
+	parent, other := makeTestTxWithFee(coinbases[0], 1), makeTestTxWithFee(coinbases[1], 30)
+	child := makeTestTxWithFee(parent, 1)
+	grandchild := makeTestTxWithFee(child, 20)
+	setTestMempool(parent, other, child, grandchild)
+
+	t.Run("Descendants and conflicts should be found from the indexes", func(t *testing.T) {
+		if descendants := Mempool().descendants(parent.Id); len(descendants) != 2 {
+			t.Errorf("Expected 2 descendants, got %v", descendants)
+		}
+		if conflicts := Mempool().conflicts(makeTestTxWithFee(parent, 5)); !reflect.DeepEqual(conflicts, []string{child.Id}) {
+			t.Errorf("Expected the child to conflict, got %v", conflicts)
+		}
+		if lowest := Mempool().byFeeRate[0].txId; lowest != parent.Id && lowest != child.Id {
+			t.Errorf("Expected a transaction paying a fee of 1 to have the lowest fee rate, got '%s'", lowest)
+		}
+	})
+	t.Run("Expiring transactions should only go through the oldest", func(t *testing.T) {
+		Mempool().remove(other.Id)
+		Mempool().add(other, 30, int(time.Now().Unix())-mempoolPolicy.MaxAge-1)
+		if oldest := Mempool().byAge[0].txId; oldest != other.Id {
+			t.Errorf("Expected the oldest transaction first, got '%s'", oldest)
+		}
+		Mempool().expire(int(time.Now().Unix()))
+		if _, ok := Mempool().Txs[other.Id]; ok || len(Mempool().Txs) != 3 {
+			t.Errorf("Expected only the oldest transaction to expire, got %d transactions", len(Mempool().Txs))
+		}
+		Mempool().add(other, 30, int(time.Now().Unix()))
+	})
+	t.Run("Outputs of mempool transactions should be found without copying them", func(t *testing.T) {
+		uTxOuts := Mempool().pendingUTxOutSet()
+		if txOut := uTxOuts.find(uTxOutKey(child.Id, 0)); txOut != child.TxOuts[0] || len(uTxOuts.changes) != 0 {
+			t.Errorf("Expected the output of the child from the mempool and no copied outputs, got %v and %d outputs", txOut, len(uTxOuts.changes))
+		}
+		if txOut := uTxOuts.find(uTxOutKey(child.Id, 1)); txOut != nil {
+			t.Errorf("Expected no output past the outputs of the child, got %v", txOut)
+		}
+		if txOut := uTxOuts.find(uTxOutKey(coinbases[2].Id, 0)); txOut == nil || *txOut != *coinbases[2].TxOuts[0] {
+			t.Errorf("Expected the output of the main chain from the db, got %v", txOut)
+		}
+	})
+	t.Run("Removed transactions should leave the indexes", func(t *testing.T) {
+		Mempool().remove(child.Id)
+		if descendants := Mempool().descendants(parent.Id); len(descendants) != 0 {
+			t.Errorf("Expected no descendants, got %v", descendants)
+		}
+		if conflicts := Mempool().conflicts(makeTestTxWithFee(parent, 5)); len(conflicts) != 0 {
+			t.Errorf("Expected no conflicts, got %v", conflicts)
+		}
+		Mempool().removeWithDescendants(parent.Id)
+		Mempool().remove(grandchild.Id)
+		m := Mempool()
+		if len(m.byFeeRate) != 1 || m.byFeeRate[0].txId != other.Id || len(m.byAge) != 1 || len(m.spentBy) != 1 || len(m.children) != 1 || m.size != other.size() {
+			t.Errorf("Expected only the other transaction in the indexes, got %d entries, %d by age, %d spent outputs and %d parents", len(m.byFeeRate), len(m.byAge), len(m.spentBy), len(m.children))
+		}
+	})
+}
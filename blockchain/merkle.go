@@ -0,0 +1,127 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/achung3071/gpcoin/utils"
+)
+
+// How Merkle trees work:
+// Transaction ids are the leaves of a binary tree, and each parent is the hash of its two
+// children (the last node of a level is paired with itself when a level has an odd number
+// of nodes). The root of the tree is in the block header, so the proof of work covers every
+// transaction without hashing them all. To prove a transaction is in a block, we only need
+// the sibling hashes on the path from its leaf to the root (log2(n) hashes).
+
+// One step from a leaf towards the Merkle root: the sibling hash to combine with
+type MerkleStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"` // whether the sibling is on the left
+}
+
+// Proof that a transaction is included in a block of the main chain
+type MerkleProof struct {
+	TxId       string       `json:"txId"`
+	BlockHash  string       `json:"blockHash"`
+	MerkleRoot string       `json:"merkleRoot"`
+	Steps      []MerkleStep `json:"steps"`
+}
+
+var ErrTxNotFound error = errors.New("Transaction with given id not found in the blockchain")
+
+// NON-MUTATING FUNCTIONS
+// Hash two nodes of a Merkle tree into their parent node
+func hashMerklePair(left, right string) string {
+	// ids are validated to be hex, so decoding errors only come from malformed blocks
+	leftBytes, _ := hex.DecodeString(left)
+	rightBytes, _ := hex.DecodeString(right)
+	hash := sha256.Sum256(append(leftBytes, rightBytes...))
+	return hex.EncodeToString(hash[:])
+}
+
+// Get the ids of a list of transactions
+func txIds(txs []*Tx) []string {
+	ids := make([]string, len(txs))
+	for i, tx := range txs {
+		ids[i] = tx.Id
+	}
+	return ids
+}
+
+// Get the next level up of a Merkle tree
+func merkleParents(level []string) []string {
+	var parents []string
+	for i := 0; i < len(level); i += 2 {
+		right := level[i] // pair last node with itself
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		parents = append(parents, hashMerklePair(level[i], right))
+	}
+	return parents
+}
+
+// Get the Merkle root of a list of transaction ids
+func merkleRoot(ids []string) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	level := ids
+	for len(level) > 1 {
+		level = merkleParents(level)
+	}
+	return level[0]
+}
+
+// Get the sibling hashes from the transaction at index up to the Merkle root
+func merkleSteps(ids []string, index int) []MerkleStep {
+	steps := []MerkleStep{}
+	level := ids
+	for len(level) > 1 {
+		sibling := index ^ 1 // index of the other node in the pair
+		if sibling >= len(level) {
+			sibling = index // paired with itself
+		}
+		steps = append(steps, MerkleStep{Hash: level[sibling], Left: sibling < index})
+		level = merkleParents(level)
+		index /= 2
+	}
+	return steps
+}
+
+// Find a transaction in the main chain and prove that it is in its block
+func TxProof(b *blockchain, txId string) (*MerkleProof, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	data := dbStorage.FindTxLocation(txId)
+	if data == nil {
+		return nil, ErrTxNotFound
+	}
+	var location txLocation
+	utils.FromBytes(&location, data)
+	block, err := FindBlock(location.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+	return &MerkleProof{
+		TxId:       txId,
+		BlockHash:  block.Hash,
+		MerkleRoot: block.MerkleRoot,
+		Steps:      merkleSteps(txIds(block.Transactions), location.Position),
+	}, nil
+}
+
+// Verify that a transaction id is a leaf of the Merkle tree with the given root
+func VerifyMerkleProof(txId string, root string, steps []MerkleStep) bool {
+	hash := txId
+	for _, step := range steps {
+		if step.Left {
+			hash = hashMerklePair(step.Hash, hash)
+		} else {
+			hash = hashMerklePair(hash, step.Hash)
+		}
+	}
+	return hash == root
+}
@@ -0,0 +1,90 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/achung3071/gpcoin/utils"
+)
+
+// Make n different transaction ids
+func testTxIds(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = utils.Hash(i)
+	}
+	return ids
+}
+
+func TestMerkleRoot(t *testing.T) {
+	ids := testTxIds(3)
+	t.Run("Root of a single transaction is its id", func(t *testing.T) {
+		if root := merkleRoot(ids[:1]); root != ids[0] {
+			t.Errorf("Expected %s, got %s", ids[0], root)
+		}
+	})
+	t.Run("Last node of an odd level is paired with itself", func(t *testing.T) {
+		expected := hashMerklePair(hashMerklePair(ids[0], ids[1]), hashMerklePair(ids[2], ids[2]))
+		if root := merkleRoot(ids); root != expected {
+			t.Errorf("Expected %s, got %s", expected, root)
+		}
+	})
+	t.Run("Root changes when the order of transactions changes", func(t *testing.T) {
+		if merkleRoot(ids[:2]) == merkleRoot([]string{ids[1], ids[0]}) {
+			t.Error("Swapping transactions should change the Merkle root")
+		}
+	})
+}
+
+func TestVerifyMerkleProof(t *testing.T) {
+	t.Run("Proof of every transaction should verify", func(t *testing.T) {
+		for n := 1; n <= 9; n++ {
+			ids := testTxIds(n)
+			root := merkleRoot(ids)
+			for i, id := range ids {
+				if !VerifyMerkleProof(id, root, merkleSteps(ids, i)) {
+					t.Errorf("Proof of transaction %d of %d did not verify", i, n)
+				}
+			}
+		}
+	})
+	t.Run("Proof should not verify for another transaction or root", func(t *testing.T) {
+		ids := testTxIds(5)
+		steps := merkleSteps(ids, 3)
+		if VerifyMerkleProof(ids[2], merkleRoot(ids), steps) {
+			t.Error("Proof verified for a transaction at another position")
+		}
+		if VerifyMerkleProof(ids[3], merkleRoot(ids[:4]), steps) {
+			t.Error("Proof verified for another Merkle root")
+		}
+	})
+}
+
+func TestTxProof(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+
+	bc := &blockchain{}
+	genesis := bc.addGenesisBlock()
+	tx := makeTestTx(genesis.Transactions[0], params.MinerReward)
+	block := mineTestBlock(bc, tx)
+	utils.ErrorHandler(bc.AddBlockFromPeer(block))
+
+	t.Run("TxProof() should prove a transaction in the main chain", func(t *testing.T) {
+		proof, err := TxProof(bc, tx.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof.BlockHash != block.Hash || proof.MerkleRoot != block.MerkleRoot {
+			t.Error("TxProof() did not return the block containing the transaction")
+		}
+		if !VerifyMerkleProof(tx.Id, proof.MerkleRoot, proof.Steps) {
+			t.Error("Proof returned by TxProof() did not verify")
+		}
+	})
+	t.Run("TxProof() should error when the transaction doesn't exist", func(t *testing.T) {
+		if _, err := TxProof(bc, "xx"); err != ErrTxNotFound {
+			t.Errorf("Expected error '%v', got '%v'", ErrTxNotFound, err)
+		}
+	})
+}
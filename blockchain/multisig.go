@@ -0,0 +1,183 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/achung3071/gpcoin/script"
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+// How multisig works:
+// A multisig output is locked by the standard multisig script (see the script package), which
+// needs signatures by M of its N public keys, e.g., for a treasury shared by several keyholders.
+// The script is the multisig address: MultisigScript() makes it from the keys, and it is paid to
+// like any other script (see Payment).
+//
+// The keyholders usually run their own nodes, so spending from the script goes through a
+// MultisigSpend passed around as JSON. One of them builds the unsigned transaction, with its
+// change going back to the script, then every keyholder adds the signature of their wallet.
+// Once it has enough signatures, any node can turn them into the unlocking scripts of the inputs
+// and send the transaction. Every input spends an output of the same script and signatures are
+// signatures of the transaction id, so a single signature per key unlocks all of them.
+
+// Transaction spending outputs of a multisig script, with the signatures collected so far
+type MultisigSpend struct {
+	Tx         *Tx               `json:"tx"`
+	Script     string            `json:"script"`     // multisig script locking every output spent
+	Required   int               `json:"required"`   // number of signatures needed (from the script)
+	Signatures map[string]string `json:"signatures"` // signatures of the transaction id by public key
+}
+
+var errInvalidMultisig error = errors.New("multisig needs 1 to N signatures of N different public keys (at most 16)")
+var errNotMultisig error = errors.New("script is not a multisig script")
+var errMalformedSpend error = errors.New("spend transaction is missing data or does not match its id")
+var errNotMultisigInput error = errors.New("spend can only spend unspent outputs of its script")
+var errNotMultisigKey error = errors.New("key is not one of the keys of the multisig script")
+var errBadMultisigSignature error = errors.New("signature is not a signature of the spend by the key")
+var errNotEnoughSignatures error = errors.New("spend does not have enough signatures yet")
+
+// NON-MUTATING FUNCTIONS
+// Make a multisig script (in hex) needing signatures by required of the public keys (addresses)
+func MultisigScript(required int, publicKeys []string) (string, error) {
+	if required < 1 || required > len(publicKeys) || len(publicKeys) > script.MaxMultisigKeys {
+		return "", errInvalidMultisig
+	}
+	keys := [][]byte{}
+	seen := make(map[string]bool)
+	for _, publicKey := range publicKeys {
+		key, err := hex.DecodeString(publicKey)
+		if err != nil || len(key) != script.PubKeySize || seen[hex.EncodeToString(key)] {
+			return "", errInvalidMultisig
+		}
+		seen[hex.EncodeToString(key)] = true
+		keys = append(keys, key)
+	}
+	return hex.EncodeToString(script.NewMultisig(required, keys)), nil
+}
+
+// Get the number of signatures needed and the public keys (addresses) of a multisig script
+func ParseMultisigScript(lockingScript string) (int, []string, error) {
+	if !isScriptHex(lockingScript) {
+		return 0, nil, errNotMultisig
+	}
+	data, _ := hex.DecodeString(lockingScript)
+	required, keys, ok := script.ParseMultisig(data)
+	if !ok {
+		return 0, nil, errNotMultisig
+	}
+	publicKeys := []string{}
+	for _, key := range keys {
+		publicKeys = append(publicKeys, hex.EncodeToString(key))
+	}
+	return required, publicKeys, nil
+}
+
+// Build an unsigned transaction spending outputs of a multisig script (see makeUnsignedTx()),
+// with its change going back to the script
+func MakeMultisigSpend(lockingScript string, payments []Payment, options TxOptions) (*MultisigSpend, error) {
+	required, _, err := ParseMultisigScript(lockingScript)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := makeUnsignedTx(scriptOwner(lockingScript), TxOut{Script: lockingScript}, payments, options)
+	if err != nil {
+		return nil, err
+	}
+	return &MultisigSpend{Tx: tx, Script: lockingScript, Required: required, Signatures: make(map[string]string)}, nil
+}
+
+// Check that a spend (e.g., from another keyholder) matches its id and only spends unspent
+// outputs of its script (on the chain or in the mempool), and get the keys of the script
+func (s *MultisigSpend) check() ([]string, error) {
+	required, publicKeys, err := ParseMultisigScript(s.Script)
+	if err != nil {
+		return nil, err
+	}
+	if s.Tx == nil || !s.Tx.isWellFormed() || len(s.Tx.TxIns) == 0 || isCoinbase(s.Tx) {
+		return nil, errMalformedSpend
+	}
+	m := Mempool()
+	m.m.Lock()
+	defer m.m.Unlock()
+	uTxOuts := m.pendingUTxOutSet()
+	for _, txIn := range s.Tx.TxIns {
+		txOut := uTxOuts.find(uTxOutKey(txIn.TxId, txIn.Index))
+		if txOut == nil || txOut.Script != s.Script {
+			return nil, errNotMultisigInput
+		}
+	}
+	s.Required = required
+	return publicKeys, nil
+}
+
+// MUTATING FUNCTIONS
+// Add the signature of a keyholder (e.g., made by their own node) to a spend
+func (s *MultisigSpend) AddSignature(publicKey string, signature string) error {
+	publicKeys, err := s.check()
+	if err != nil {
+		return err
+	}
+	isKey := false
+	for _, key := range publicKeys {
+		isKey = isKey || key == publicKey
+	}
+	if !isKey {
+		return errNotMultisigKey
+	}
+	if !wallet.Verify(s.Tx.Id, signature, publicKey) {
+		return errBadMultisigSignature
+	}
+	if s.Signatures == nil {
+		s.Signatures = make(map[string]string)
+	}
+	s.Signatures[publicKey] = signature
+	return nil
+}
+
+// Add the signature of our wallet to a spend
+func SignMultisigSpend(spend *MultisigSpend) error {
+	if _, err := spend.check(); err != nil {
+		return err
+	}
+	w := wallet.Wallet()
+	return spend.AddSignature(w.Address, wallet.Sign(spend.Tx.Id, w))
+}
+
+// Put enough valid signatures of a spend into the unlocking script of every input
+// (in the order of the keys in the script)
+func (s *MultisigSpend) finalize() error {
+	publicKeys, err := s.check()
+	if err != nil {
+		return err
+	}
+	signatures := [][]byte{}
+	for _, publicKey := range publicKeys {
+		signature, ok := s.Signatures[publicKey]
+		if !ok || len(signatures) == s.Required || !wallet.Verify(s.Tx.Id, signature, publicKey) {
+			continue
+		}
+		data, _ := hex.DecodeString(signature)
+		signatures = append(signatures, data)
+	}
+	if len(signatures) < s.Required {
+		return errNotEnoughSignatures
+	}
+	unlocking := hex.EncodeToString(script.NewMultisigUnlock(signatures))
+	for _, txIn := range s.Tx.TxIns {
+		txIn.Signature, txIn.Script = "", unlocking
+	}
+	return nil
+}
+
+// Add a spend with enough signatures to the mempool, returning its transaction (which
+// gets the same checks as a transaction from a peer)
+func (m *mempool) AddMultisigSpend(spend *MultisigSpend) (*Tx, error) {
+	if err := spend.finalize(); err != nil {
+		return nil, err
+	}
+	if err := m.AddTxFromPeer(spend.Tx); err != nil {
+		return nil, err
+	}
+	return spend.Tx, nil
+}
@@ -0,0 +1,190 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/achung3071/gpcoin/utils"
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+// Key of another keyholder, with its address (public key)
+func makeTestKeyholder() (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	utils.ErrorHandler(err)
+	publicKey := make([]byte, 64)
+	key.X.FillBytes(publicKey[:32])
+	key.Y.FillBytes(publicKey[32:])
+	return key, hex.EncodeToString(publicKey)
+}
+
+// Signature of a transaction id by another keyholder (r and s, 32 bytes each)
+func signTestKeyholder(key *ecdsa.PrivateKey, txId string) string {
+	hash, err := hex.DecodeString(txId)
+	utils.ErrorHandler(err)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	utils.ErrorHandler(err)
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return hex.EncodeToString(signature)
+}
+
+func TestMultisigScript(t *testing.T) {
+	_, alice := makeTestKeyholder()
+	_, bob := makeTestKeyholder()
+	type test struct {
+		name       string
+		required   int
+		publicKeys []string
+		valid      bool
+	}
+	tests := []test{
+		{"2 of 2 keys", 2, []string{alice, bob}, true},
+		{"1 of 2 keys", 1, []string{alice, bob}, true},
+		{"No signatures", 0, []string{alice, bob}, false},
+		{"More signatures than keys", 3, []string{alice, bob}, false},
+		{"Same key twice", 2, []string{alice, alice}, false},
+		{"Same key in uppercase", 2, []string{alice, strings.ToUpper(alice)}, false},
+		{"Key that is not hex", 1, []string{"xyz"}, false},
+		{"Key that is too short", 1, []string{alice[:64]}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lockingScript, err := MultisigScript(tc.required, tc.publicKeys)
+			if !tc.valid {
+				if err != errInvalidMultisig {
+					t.Errorf("Expected %v, got %v", errInvalidMultisig, err)
+				}
+				return
+			}
+			required, publicKeys, err := ParseMultisigScript(lockingScript)
+			if err != nil || required != tc.required || strings.Join(publicKeys, ",") != strings.Join(tc.publicKeys, ",") {
+				t.Errorf("Expected to parse back %d of %v, got %d of %v (%v)", tc.required, tc.publicKeys, required, publicKeys, err)
+			}
+		})
+	}
+	t.Run("Scripts should have at most 16 keys", func(t *testing.T) {
+		publicKeys := []string{}
+		for len(publicKeys) < 17 {
+			_, publicKey := makeTestKeyholder()
+			publicKeys = append(publicKeys, publicKey)
+		}
+		if _, err := MultisigScript(1, publicKeys); err != errInvalidMultisig {
+			t.Errorf("Expected %v, got %v", errInvalidMultisig, err)
+		}
+		if _, err := MultisigScript(1, publicKeys[:16]); err != nil {
+			t.Errorf("Expected 16 keys to be allowed, got %v", err)
+		}
+	})
+	t.Run("Other scripts should not be multisig", func(t *testing.T) {
+		if _, _, err := ParseMultisigScript("51"); err != errNotMultisig {
+			t.Errorf("Expected %v, got %v", errNotMultisig, err)
+		}
+	})
+}
+
+func TestMultisigSpend(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	bc, _ := useTestChain(3)
+	setTestMempool()
+	from := wallet.Wallet().Address
+	aliceKey, alice := makeTestKeyholder()
+	bobKey, bob := makeTestKeyholder()
+	outsiderKey, outsider := makeTestKeyholder()
+	_, carol := makeTestKeyholder()
+	lockingScript, err := MultisigScript(2, []string{alice, from, bob})
+	utils.ErrorHandler(err)
+
+	funding, err := makeTx(from, []Payment{{"", 30, lockingScript}, {"", 20, lockingScript}}, TxOptions{Fee: 1})
+	utils.ErrorHandler(err)
+	utils.ErrorHandler(bc.AddBlockFromPeer(mineTestBlock(bc, funding)))
+	if uTxOuts := UTxOutsByScript(lockingScript, bc); len(uTxOuts) != 2 {
+		t.Fatalf("Expected 2 outputs locked by the multisig script, got %d", len(uTxOuts))
+	}
+
+	spend, err := MakeMultisigSpend(lockingScript, []Payment{{carol, 40, ""}}, TxOptions{Fee: 2})
+	if err != nil {
+		t.Fatalf("MakeMultisigSpend() failed: %v", err)
+	}
+	t.Run("Spends should be unsigned with change back to the script", func(t *testing.T) {
+		if spend.Required != 2 || len(spend.Tx.TxIns) != 2 {
+			t.Errorf("Expected 2 inputs needing 2 signatures, got %d needing %d", len(spend.Tx.TxIns), spend.Required)
+		}
+		for _, txIn := range spend.Tx.TxIns {
+			if txIn.Signature != "" || txIn.Script != "" {
+				t.Errorf("Expected an unsigned input, got %v", txIn)
+			}
+		}
+		change := spend.Tx.TxOuts[0]
+		if change.Script != lockingScript || change.Amount != 8 {
+			t.Errorf("Expected 8 in change to the script, got %v", change)
+		}
+	})
+	t.Run("Spends should need enough signatures", func(t *testing.T) {
+		if _, err := Mempool().AddMultisigSpend(spend); err != errNotEnoughSignatures {
+			t.Errorf("Expected %v, got %v", errNotEnoughSignatures, err)
+		}
+		if err := SignMultisigSpend(spend); err != nil || spend.Signatures[from] == "" {
+			t.Fatalf("Expected the wallet to sign, got %v", err)
+		}
+		if _, err := Mempool().AddMultisigSpend(spend); err != errNotEnoughSignatures {
+			t.Errorf("Expected %v with one signature, got %v", errNotEnoughSignatures, err)
+		}
+	})
+	t.Run("Signatures should be by keys of the script", func(t *testing.T) {
+		type test struct {
+			name      string
+			publicKey string
+			signature string
+			expected  error
+		}
+		tests := []test{
+			{"Key not in the script", outsider, signTestKeyholder(outsiderKey, spend.Tx.Id), errNotMultisigKey},
+			{"Signature by another key", alice, signTestKeyholder(bobKey, spend.Tx.Id), errBadMultisigSignature},
+			{"Signature of another transaction", alice, signTestKeyholder(aliceKey, funding.Id), errBadMultisigSignature},
+		}
+		for _, tc := range tests {
+			if err := spend.AddSignature(tc.publicKey, tc.signature); err != tc.expected {
+				t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, err)
+			}
+		}
+		if len(spend.Signatures) != 1 {
+			t.Errorf("Expected rejected signatures not to be kept, got %v", spend.Signatures)
+		}
+	})
+	t.Run("Spends should match their id and spend outputs of their script", func(t *testing.T) {
+		tampered := *spend.Tx
+		tampered.TxOuts = []*TxOut{{Address: "mallory", Amount: 48}}
+		if err := (&MultisigSpend{Tx: &tampered, Script: lockingScript}).AddSignature(alice, ""); err != errMalformedSpend {
+			t.Errorf("Expected %v, got %v", errMalformedSpend, err)
+		}
+		ours, err := makeUnsignedTx(addressOwner(from), TxOut{Address: from}, []Payment{{carol, 1, ""}}, TxOptions{})
+		utils.ErrorHandler(err)
+		if err := SignMultisigSpend(&MultisigSpend{Tx: ours, Script: lockingScript}); err != errNotMultisigInput {
+			t.Errorf("Expected %v, got %v", errNotMultisigInput, err)
+		}
+	})
+	t.Run("Spends with enough signatures should go to the mempool", func(t *testing.T) {
+		utils.ErrorHandler(spend.AddSignature(bob, signTestKeyholder(bobKey, spend.Tx.Id)))
+		tx, err := Mempool().AddMultisigSpend(spend)
+		if err != nil {
+			t.Fatalf("AddMultisigSpend() failed with 2 signatures: %v", err)
+		}
+		if _, ok := Mempool().Txs[tx.Id]; !ok {
+			t.Fatal("Expected the spend in the mempool")
+		}
+		utils.ErrorHandler(bc.AddBlockFromPeer(mineTestBlock(bc, tx)))
+		uTxOuts := UTxOutsByScript(lockingScript, bc)
+		if len(uTxOuts) != 1 || uTxOuts[0].TxId != tx.Id {
+			t.Errorf("Expected only the change of the spend left, got %v", uTxOuts)
+		}
+	})
+}
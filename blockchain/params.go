@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// Rules of a network. Nodes can only share a chain if they use the same parameters.
+type ChainParams struct {
+	Name                   string `json:"name"`
+	Port                   int    `json:"port"`                   // default port of the node
+	DefaultBits            int    `json:"defaultBits"`            // compact target of the first blocks
+	MaxBits                int    `json:"maxBits"`                // easiest compact target allowed
+	NoRetargeting          bool   `json:"noRetargeting"`          // keep every block at DefaultBits
+	UpdateIntervalInBlocks int    `json:"updateIntervalInBlocks"` // how often we should update difficulty
+	ExpectedMinsPerBlock   int    `json:"expectedMinsPerBlock"`   // num. mins expected for a block to be created
+	MaxRetargetFactor      int    `json:"maxRetargetFactor"`      // most the target can change by in one update
+	MinerReward            int    `json:"minerReward"`            // block subsidy before the first halving
+	HalvingInterval        int    `json:"halvingInterval"`        // blocks between halvings of the subsidy
+	MaxSupply              int    `json:"maxSupply"`              // no subsidy is paid over this many coins
+	MaxBlockSize           int    `json:"maxBlockSize"`           // most bytes of transactions in a block
+	CoinbaseAddress        string `json:"coinbaseAddress"`        // marks the input of a coinbase transaction
+	GenesisTimestamp       int    `json:"genesisTimestamp"`       // see genesis.go
+	GenesisAddress         string `json:"genesisAddress"`         // receives the coinbase of the genesis block
+	GenesisNonce           int    `json:"genesisNonce"`
+	GenesisHash            string `json:"genesisHash"`
+}
+
+// Built-in network profiles
+var (
+	mainnetParams = ChainParams{
+		Name:                   "mainnet",
+		Port:                   5000,
+		DefaultBits:            0x2000ffff, // target of about 2^248 (like hashes starting with two hex zeros)
+		MaxBits:                0x207fffff, // about half of all hashes
+		UpdateIntervalInBlocks: 5,
+		ExpectedMinsPerBlock:   2,
+		MaxRetargetFactor:      4,
+		MinerReward:            50,
+		HalvingInterval:        100000,
+		MaxSupply:              9700000, // 50 + 25 + 12 + 6 + 3 + 1 per block of each interval
+		MaxBlockSize:           100000,  // a few hundred simple transactions
+		CoinbaseAddress:        "COINBASE",
+		GenesisTimestamp:       1633046400,               // 2021-10-01
+		GenesisAddress:         "GPCoin mainnet genesis", // not a public key, so never spendable
+		GenesisNonce:           336,
+		GenesisHash:            "00988f6be2953df65036936c605c38a536ff4cb2dc36c09af441a1ef92fc4ac5",
+	}
+	testnetParams = ChainParams{
+		Name:                   "testnet",
+		Port:                   6000,
+		DefaultBits:            0x2000ffff,
+		MaxBits:                0x207fffff,
+		UpdateIntervalInBlocks: 5,
+		ExpectedMinsPerBlock:   1,
+		MaxRetargetFactor:      4,
+		MinerReward:            50,
+		HalvingInterval:        100000,
+		MaxSupply:              9700000,
+		MaxBlockSize:           100000,
+		CoinbaseAddress:        "COINBASE",
+		GenesisTimestamp:       1633132800,
+		GenesisAddress:         "GPCoin testnet genesis",
+		GenesisNonce:           266,
+		GenesisHash:            "002287a3d5dfaef3bb5f17723d42b9beeec12ed999f6b09b095fa548649f295a",
+	}
+	// For tests on a single machine: blocks are mined instantly at the easiest target
+	regtestParams = ChainParams{
+		Name:                   "regtest",
+		Port:                   7000,
+		DefaultBits:            0x207fffff,
+		MaxBits:                0x207fffff,
+		NoRetargeting:          true,
+		UpdateIntervalInBlocks: 5,
+		ExpectedMinsPerBlock:   2,
+		MaxRetargetFactor:      4,
+		MinerReward:            50,
+		HalvingInterval:        150, // so tests can reach halvings quickly
+		MaxSupply:              14550,
+		MaxBlockSize:           100000,
+		CoinbaseAddress:        "COINBASE",
+		GenesisTimestamp:       1633219200,
+		GenesisAddress:         "GPCoin regtest genesis",
+		GenesisNonce:           0,
+		GenesisHash:            "5efec32060b7438611c2487847d7f85e8ee54989948b73e4d4d40bebb179398a",
+	}
+)
+
+var params ChainParams = mainnetParams // parameters of the network this node is on
+
+var ErrUnknownNetwork error = errors.New("network must be one of 'mainnet', 'testnet', 'regtest'")
+var ErrInvalidParams error = errors.New("chain parameters are missing or out of range")
+
+// NON-MUTATING FUNCTIONS
+// Get the parameters of the network this node is on
+func Params() ChainParams {
+	return params
+}
+
+// Get the parameters of a built-in network
+func NetworkParams(name string) (ChainParams, error) {
+	switch name {
+	case mainnetParams.Name:
+		return mainnetParams, nil
+	case testnetParams.Name:
+		return testnetParams, nil
+	case regtestParams.Name:
+		return regtestParams, nil
+	}
+	return ChainParams{}, ErrUnknownNetwork
+}
+
+// Load parameters from a JSON file. Fields missing from the file are taken from base.
+// (They are validated by SetParams(), so that a new genesis can be mined for them first.)
+func LoadParams(path string, base ChainParams) (ChainParams, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ChainParams{}, err
+	}
+	p := base
+	if err := json.Unmarshal(data, &p); err != nil {
+		return ChainParams{}, err
+	}
+	return p, nil
+}
+
+// Check that the parameters can be used to run a chain
+func (p ChainParams) validate() error {
+	defaultTarget, maxTarget := targetFromBits(p.DefaultBits), targetFromBits(p.MaxBits)
+	if p.Name == "" || p.Port <= 0 || p.CoinbaseAddress == "" || p.MinerReward <= 0 {
+		return ErrInvalidParams
+	}
+	if defaultTarget == nil || maxTarget == nil || defaultTarget.Cmp(maxTarget) > 0 {
+		return ErrInvalidParams
+	}
+	if p.UpdateIntervalInBlocks < 2 || p.ExpectedMinsPerBlock <= 0 || p.MaxRetargetFactor < 1 {
+		return ErrInvalidParams
+	}
+	if p.HalvingInterval <= 0 || p.MaxSupply < p.MinerReward { // genesis pays MinerReward
+		return ErrInvalidParams
+	}
+	genesis := genesisBlock(p)
+	if genesis.Hash != p.GenesisHash || !genesis.hasValidPoW() {
+		return ErrInvalidGenesis
+	}
+	if blockSize(genesis.Transactions) > p.MaxBlockSize { // blocks must have room for a coinbase
+		return ErrInvalidParams
+	}
+	return nil
+}
+
+// MUTATING FUNCTIONS
+// Switch the node to another network (must be called before Blockchain())
+func SetParams(p ChainParams) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	params = p
+	return nil
+}
@@ -0,0 +1,122 @@
+package blockchain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNetworkParams(t *testing.T) {
+	t.Run("Built-in networks should have valid parameters", func(t *testing.T) {
+		for _, name := range []string{"mainnet", "testnet", "regtest"} {
+			p, err := NetworkParams(name)
+			if err != nil || p.Name != name {
+				t.Errorf("NetworkParams(%q) returned %v, %v", name, p, err)
+			}
+			if err := p.validate(); err != nil {
+				t.Errorf("Parameters of %s are invalid: %v", name, err)
+			}
+		}
+	})
+	t.Run("NetworkParams() should error for unknown networks", func(t *testing.T) {
+		if _, err := NetworkParams("simnet"); err != ErrUnknownNetwork {
+			t.Errorf("Expected error '%v', got '%v'", ErrUnknownNetwork, err)
+		}
+	})
+}
+
+func TestLoadParams(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	t.Run("LoadParams() should keep base parameters missing from the file", func(t *testing.T) {
+		path := writeFile("custom.json", `{"name": "custom", "port": 8000}`)
+		p, err := LoadParams(path, regtestParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Name != "custom" || p.Port != 8000 {
+			t.Errorf("LoadParams() did not use the parameters from the file: %v", p)
+		}
+		if p.DefaultBits != regtestParams.DefaultBits || !p.NoRetargeting {
+			t.Errorf("LoadParams() did not keep the base parameters: %v", p)
+		}
+		if err := p.validate(); err != nil {
+			t.Errorf("Expected parameters with the regtest genesis to be valid, got '%v'", err)
+		}
+	})
+	t.Run("LoadParams() should error for missing or malformed files", func(t *testing.T) {
+		if _, err := LoadParams(filepath.Join(dir, "missing.json"), mainnetParams); err == nil {
+			t.Error("LoadParams() did not error for a missing file")
+		}
+		if _, err := LoadParams(writeFile("bad.json", "{"), mainnetParams); err == nil {
+			t.Error("LoadParams() did not error for malformed JSON")
+		}
+	})
+}
+
+func TestRegtest(t *testing.T) {
+	oldParams := params
+	defer func() { params = oldParams }()
+	if err := SetParams(regtestParams); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Regtest should never change the target", func(t *testing.T) {
+		blocks := make([]*Block, params.UpdateIntervalInBlocks)
+		for i := range blocks {
+			blocks[i] = &Block{Height: params.UpdateIntervalInBlocks - i, Bits: params.DefaultBits} // all mined at once
+		}
+		if bits := bitsAfter(blocks); bits != regtestParams.DefaultBits {
+			t.Errorf("Expected bits %x, got %x", regtestParams.DefaultBits, bits)
+		}
+	})
+}
+
+func TestSetParams(t *testing.T) {
+	oldParams := params
+	defer func() { params = oldParams }()
+	withChanges := func(change func(p *ChainParams)) ChainParams {
+		p := regtestParams
+		change(&p)
+		return p
+	}
+	type test struct {
+		name   string
+		params ChainParams
+		err    error
+	}
+	tests := []test{
+		{"no parameters", ChainParams{}, ErrInvalidParams},
+		{"invalid bits", withChanges(func(p *ChainParams) { p.DefaultBits = 0 }), ErrInvalidParams},
+		{"default target easier than the max target", withChanges(func(p *ChainParams) {
+			p.MaxBits = mainnetParams.DefaultBits
+		}), ErrInvalidParams},
+		{"blocks too small for a coinbase", withChanges(func(p *ChainParams) { p.MaxBlockSize = 50 }), ErrInvalidParams},
+		{"genesis of another network", withChanges(func(p *ChainParams) {
+			p.GenesisHash = mainnetParams.GenesisHash
+		}), ErrInvalidGenesis},
+		{"changes to the genesis block", withChanges(func(p *ChainParams) { p.MinerReward = 25 }), ErrInvalidGenesis},
+	}
+	for _, tc := range tests {
+		if err := SetParams(tc.params); err != tc.err {
+			t.Errorf("Parameters with %s: expected error '%v', got '%v'", tc.name, tc.err, err)
+		}
+		if params.Name != oldParams.Name {
+			t.Errorf("SetParams() changed the parameters to ones with %s", tc.name)
+		}
+	}
+	t.Run("SetParams() should accept parameters with a newly mined genesis", func(t *testing.T) {
+		p, err := MineGenesis(withChanges(func(p *ChainParams) { p.Name, p.MinerReward = "custom", 25 }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SetParams(p); err != nil || params.Name != "custom" {
+			t.Errorf("SetParams() rejected the parameters: %v", err)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package blockchain
+
+import (
+	"errors"
+	"time"
+
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+// How replace-by-fee works:
+// A transaction stuck in the mempool because its fee is too low can be replaced by one
+// spending the same outputs with a higher fee, if the node opts in (MempoolPolicy.ReplaceByFee).
+// The replacement must pay at least MinFeeBump more than the total fee of the transactions
+// it replaces (the conflicting transactions and their descendants, which are removed with
+// them), so that replacing transactions over and over costs something, and pay a higher fee
+// rate than each conflicting transaction, so that miners prefer it.
+
+var errNotInMempool error = errors.New("transaction is not in the mempool")
+var errNotOurTx error = errors.New("transaction does not spend outputs of our wallet")
+var errFeeNotHigher error = errors.New("new fee must be higher than the current fee")
+
+// NON-MUTATING FUNCTIONS
+// Check that a transaction paying fee can replace the mempool transactions it conflicts with
+func (m *mempool) checkReplacement(tx *Tx, fee int, conflicts []string) error {
+	if !mempoolPolicy.ReplaceByFee {
+		return ErrTxMempoolConflict
+	}
+	replaced := make(map[string]bool)
+	for _, id := range conflicts {
+		if !(feeRate{txId: tx.Id, fee: fee, size: tx.size()}).higherThan(m.entries[id].feeRate) {
+			return ErrTxReplacementFee
+		}
+		replaced[id] = true
+		for _, descendant := range m.descendants(id) {
+			replaced[descendant] = true
+		}
+	}
+	replacedFees := 0
+	for id := range replaced {
+		replacedFees += m.fee(id)
+	}
+	for _, txIn := range tx.TxIns {
+		if replaced[txIn.TxId] { // would spend an output that is about to be removed
+			return ErrTxMempoolConflict
+		}
+	}
+	if fee < replacedFees+mempoolPolicy.MinFeeBump {
+		return ErrTxReplacementFee
+	}
+	return nil
+}
+
+// Get the fee of a mempool transaction
+func (m *mempool) fee(txId string) int {
+	if entry, ok := m.entries[txId]; ok {
+		return entry.fee
+	}
+	return 0
+}
+
+// Make a transaction replacing one of our mempool transactions, paying the same
+// recipients with a fee of newFee. Outputs to our own address are treated as change,
+// which pays for the higher fee first (then more of our unspent outputs are added).
+func (m *mempool) makeReplacement(txId string, newFee int) (*Tx, error) {
+	m.m.Lock()
+	original, ok := m.Txs[txId]
+	oldFee := m.fee(txId)
+	spent := []*TxOut{} // outputs the original spends, which can be outputs of its parents
+	if ok {
+		uTxOuts := m.pendingUTxOutSet()
+		for _, txIn := range original.TxIns {
+			spent = append(spent, uTxOuts.find(uTxOutKey(txIn.TxId, txIn.Index)))
+		}
+	}
+	replaced := map[string]bool{txId: true}
+	for _, id := range m.descendants(txId) {
+		replaced[id] = true
+	}
+	m.m.Unlock()
+	if !ok {
+		return nil, errNotInMempool
+	}
+	if newFee <= oldFee {
+		return nil, errFeeNotHigher
+	}
+	from := wallet.Wallet().Address
+	txIns := []*TxIn{}
+	for i, txIn := range original.TxIns {
+		if txOut := spent[i]; txOut == nil || !txOut.paysTo(from) {
+			return nil, errNotOurTx
+		}
+		txIns = append(txIns, &TxIn{TxId: txIn.TxId, Index: txIn.Index, Signature: from})
+	}
+	payments := []*TxOut{}
+	change := 0
+	for _, txOut := range original.TxOuts {
+		if txOut.paysTo(from) {
+			change += txOut.Amount
+		} else {
+			payments = append(payments, &TxOut{Address: txOut.Address, Amount: txOut.Amount, Script: txOut.Script})
+		}
+	}
+	change -= newFee - oldFee
+	if change < 0 {
+		// our outputs not spent in the mempool (so not the inputs of the original),
+		// except for those removed along with the original
+		for _, uTxOut := range UTxOutsByAddress(from, Blockchain()) {
+			if replaced[uTxOut.TxId] {
+				continue
+			}
+			change += uTxOut.Amount
+			txIns = append(txIns, &TxIn{TxId: uTxOut.TxId, Index: uTxOut.Index, Signature: from})
+			if change >= 0 {
+				break
+			}
+		}
+	}
+	if change < 0 {
+		return nil, errNoMoney
+	}
+	txOuts := []*TxOut{}
+	if change > 0 {
+		txOuts = append(txOuts, &TxOut{Address: from, Amount: change})
+	}
+	tx := &Tx{
+		Timestamp: int(time.Now().Unix()),
+		TxIns:     txIns,
+		TxOuts:    append(txOuts, payments...),
+		LockTime:  original.LockTime,
+	}
+	tx.getId()
+	tx.sign()
+	return tx, nil
+}
+
+// MUTATING FUNCTIONS
+// Replace one of our mempool transactions with one paying a fee of newFee
+// (the node must allow replace-by-fee, see MempoolPolicy)
+func (m *mempool) BumpFee(txId string, newFee int) (*Tx, error) {
+	tx, err := m.makeReplacement(txId, newFee)
+	if err != nil {
+		return nil, err
+	}
+	next := nextLockPoint(Blockchain())
+	m.m.Lock()
+	defer m.m.Unlock()
+	defer m.save()
+	if err := m.admit(tx, next); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
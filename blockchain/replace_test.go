@@ -0,0 +1,126 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/achung3071/gpcoin/utils"
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+func TestReplaceByFee(t *testing.T) {
+	oldStorage, oldPolicy := dbStorage, mempoolPolicy
+	defer func() { dbStorage, mempoolPolicy = oldStorage, oldPolicy }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	_, coinbases := useTestChain(3)
+
+	original := makeTestTxWithFee(coinbases[0], 5)
+	child := makeTestTxWithFee(original, 5)
+	setup := func() {
+		setTestMempool()
+		utils.ErrorHandler(Mempool().AddTxFromPeer(original))
+		Mempool().add(child, 5, int(time.Now().Unix())) // e.g., back from a block that left the chain
+	}
+
+	t.Run("Conflicting transactions should be rejected without replace-by-fee", func(t *testing.T) {
+		setup()
+		err := Mempool().AddTxFromPeer(makeTestTxWithFee(coinbases[0], 30))
+		if !errors.Is(err, ErrTxMempoolConflict) {
+			t.Errorf("Expected error '%v', got '%v'", ErrTxMempoolConflict, err)
+		}
+	})
+
+	mempoolPolicy.ReplaceByFee, mempoolPolicy.MinFeeBump = true, 1
+	t.Run("Replacements should pay more than everything they replace", func(t *testing.T) {
+		setup()
+		// pays more than the original, but not more than the original and its child
+		err := Mempool().AddTxFromPeer(makeTestTxWithFee(coinbases[0], 10))
+		if !errors.Is(err, ErrTxReplacementFee) {
+			t.Errorf("Expected error '%v', got '%v'", ErrTxReplacementFee, err)
+		}
+		if len(Mempool().Txs) != 2 {
+			t.Errorf("Expected the original transactions to stay, got %d transactions", len(Mempool().Txs))
+		}
+	})
+	t.Run("Replacements should remove the original and its descendants", func(t *testing.T) {
+		setup()
+		replacement := makeTestTxWithFee(coinbases[0], 11)
+		if err := Mempool().AddTxFromPeer(replacement); err != nil {
+			t.Fatalf("AddTxFromPeer() rejected the replacement: %v", err)
+		}
+		info := MempoolInfo(Mempool())
+		if _, ok := info.Txs[replacement.Id]; !ok || info.Count != 1 || info.Replaced != 2 {
+			t.Errorf("Expected only the replacement in the mempool, got %d transactions and %d replaced", info.Count, info.Replaced)
+		}
+	})
+	t.Run("Replacements evicted from a full mempool should not remove the original", func(t *testing.T) {
+		defer func(maxSize int) { mempoolPolicy.MaxSize = maxSize }(mempoolPolicy.MaxSize)
+		setTestMempool()
+		other := makeTestTxWithFee(coinbases[2], 20)
+		for _, tx := range []*Tx{original, other} {
+			utils.ErrorHandler(Mempool().AddTxFromPeer(tx))
+		}
+		mempoolPolicy.MaxSize = original.size() + other.size()
+		// pays a higher fee rate than the original, but is twice as large and pays a lower
+		// fee rate than the other transaction, so it is evicted once the original is gone
+		replacement := &Tx{
+			TxIns:  []*TxIn{{coinbases[0].Id, 0, "", ""}, {coinbases[1].Id, 0, "", ""}},
+			TxOuts: []*TxOut{{wallet.Wallet().Address, 2*params.MinerReward - 11, ""}},
+		}
+		replacement.getId()
+		replacement.sign()
+		if err := Mempool().AddTxFromPeer(replacement); !errors.Is(err, ErrTxMempoolFull) {
+			t.Errorf("Expected error '%v', got '%v'", ErrTxMempoolFull, err)
+		}
+		info := MempoolInfo(Mempool())
+		_, hasOriginal := info.Txs[original.Id]
+		if !hasOriginal || info.Count != 2 || info.Size != mempoolPolicy.MaxSize || info.Replaced != 0 || info.Evicted != 0 {
+			t.Errorf("Expected the original transactions to stay, got %d transactions, %d replaced and %d evicted", info.Count, info.Replaced, info.Evicted)
+		}
+	})
+}
+
+func TestBumpFee(t *testing.T) {
+	oldStorage, oldPolicy := dbStorage, mempoolPolicy
+	defer func() { dbStorage, mempoolPolicy = oldStorage, oldPolicy }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	_, coinbases := useTestChain(2)
+	mempoolPolicy.ReplaceByFee, mempoolPolicy.MinFeeBump = true, 1
+
+	// pays 9 to bob with 40 of change and a fee of 1
+	original := &Tx{
+		TxIns:  []*TxIn{{coinbases[1].Id, 0, "", ""}},
+		TxOuts: []*TxOut{{wallet.Wallet().Address, params.MinerReward - 10, ""}, {"bob", 9, ""}},
+	}
+	original.getId()
+	original.sign()
+	setTestMempool()
+	utils.ErrorHandler(Mempool().AddTxFromPeer(original))
+
+	if _, err := Mempool().BumpFee("unknown", 5); err != errNotInMempool {
+		t.Errorf("Expected error '%v', got '%v'", errNotInMempool, err)
+	}
+	if _, err := Mempool().BumpFee(original.Id, 1); err != errFeeNotHigher {
+		t.Errorf("Expected error '%v', got '%v'", errFeeNotHigher, err)
+	}
+	tx, err := Mempool().BumpFee(original.Id, 5)
+	if err != nil {
+		t.Fatalf("BumpFee() failed: %v", err)
+	}
+	t.Run("The replacement should pay the same recipients from less change", func(t *testing.T) {
+		if len(tx.TxOuts) != 2 || tx.TxOuts[0].Amount != params.MinerReward-14 || *tx.TxOuts[1] != (TxOut{"bob", 9, ""}) {
+			t.Errorf("Unexpected outputs %v, %v", tx.TxOuts[0], tx.TxOuts[1])
+		}
+		if Mempool().fee(tx.Id) != 5 {
+			t.Errorf("Expected a fee of 5, got %d", Mempool().fee(tx.Id))
+		}
+	})
+	t.Run("The replacement should be in the mempool instead of the original", func(t *testing.T) {
+		if _, ok := Mempool().Txs[original.Id]; ok || len(Mempool().Txs) != 1 {
+			t.Errorf("Expected only the replacement in the mempool, got %d transactions", len(Mempool().Txs))
+		}
+	})
+}
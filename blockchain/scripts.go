@@ -0,0 +1,137 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/achung3071/gpcoin/script"
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+// How output scripts work:
+// Every output is locked by a script (see the script package), and the input spending it
+// runs an unlocking script before it. An output to an address has no script of its own:
+// it is locked by the standard pay-to-pubkey script of the address (its public key), and
+// the signature of the input is its unlocking script. Other outputs have their locking
+// script in hex (e.g., a pay-to-pubkey-hash or a hash lock), and the inputs spending them
+// have an unlocking script instead of a signature.
+//
+// Signatures in scripts are signatures of the id of the spending transaction, like the
+// signatures of inputs. Scripts of outputs are part of the id, and unlocking scripts are not.
+// Lock times in scripts (OP_CHECKLOCKTIMEVERIFY) are checked against the lock time of the
+// spending transaction, which cannot be in a block before it (see locktime.go).
+
+var errPaymentTarget error = errors.New("payment needs either an address or a script, not both")
+var errInvalidScript error = errors.New("script must be a valid script in lowercase hex")
+var errInvalidAddress error = errors.New("address must be a 64 byte public key in lowercase hex")
+
+// Checks signatures and lock times in scripts against the spending transaction
+type txChecker struct {
+	tx *Tx
+}
+
+// NON-MUTATING FUNCTIONS
+func (c txChecker) CheckSig(signature []byte, publicKey []byte) bool {
+	return wallet.Verify(c.tx.Id, hex.EncodeToString(signature), hex.EncodeToString(publicKey))
+}
+
+// Lock times must be the same kind (heights or times) as the lock time of the transaction
+func (c txChecker) CheckLockTime(lockTime int) bool {
+	if (lockTime < lockTimeThreshold) != (c.tx.LockTime < lockTimeThreshold) {
+		return false
+	}
+	return lockTime <= c.tx.LockTime
+}
+
+// Checks if s is a script in canonical (lowercase) hex
+func isScriptHex(s string) bool {
+	data, err := hex.DecodeString(s)
+	return err == nil && hex.EncodeToString(data) == s
+}
+
+// Checks if s is an address: a public key in canonical (lowercase) hex, which the
+// pay-to-pubkey script of its outputs needs
+func isAddress(s string) bool {
+	return len(s) == 2*script.PubKeySize && isScriptHex(s)
+}
+
+// Checks if an output is to an address (not locked by a script of its own)
+func (t *TxOut) paysTo(address string) bool {
+	return t.Script == "" && t.Address == address
+}
+
+// Owner of the outputs to an address, under which they are indexed in the db (see TxOut.owner())
+func addressOwner(address string) string {
+	return "address:" + address
+}
+
+// Owner of the outputs locked by a script of their own (see TxOut.owner())
+func scriptOwner(lockingScript string) string {
+	return "script:" + lockingScript
+}
+
+// Get who an output belongs to: its locking script if it has one, or else its address
+func (t *TxOut) owner() string {
+	if t.Script != "" {
+		return scriptOwner(t.Script)
+	}
+	return addressOwner(t.Address)
+}
+
+// Get the script locking an output (the pay-to-pubkey script of its address if it has none)
+func (t *TxOut) lockingScript() (script.Script, error) {
+	if t.Script != "" {
+		return hex.DecodeString(t.Script)
+	}
+	publicKey, err := hex.DecodeString(t.Address)
+	if err != nil {
+		return nil, err
+	}
+	return script.NewPayToPubKey(publicKey), nil
+}
+
+// Get the script unlocking the output an input spends (just its signature if it has none)
+func (t *TxIn) unlockingScript() (script.Script, error) {
+	if t.Script != "" {
+		return hex.DecodeString(t.Script)
+	}
+	signature, err := hex.DecodeString(t.Signature)
+	if err != nil {
+		return nil, err
+	}
+	return script.NewPayToPubKeyUnlock(signature), nil
+}
+
+// Check that an input of tx unlocks the output it spends
+func unlocks(tx *Tx, txIn *TxIn, txOut *TxOut) error {
+	unlocking, err := txIn.unlockingScript()
+	if err != nil {
+		return err
+	}
+	locking, err := txOut.lockingScript()
+	if err != nil {
+		return err
+	}
+	return script.Verify(unlocking, locking, txChecker{tx})
+}
+
+// Get the output a payment creates
+func (p Payment) txOut() (*TxOut, error) {
+	if p.Script == "" {
+		if !isAddress(p.To) {
+			return nil, errInvalidAddress
+		}
+		return &TxOut{Address: p.To, Amount: p.Amount}, nil
+	}
+	if p.To != "" {
+		return nil, errPaymentTarget
+	}
+	if !isScriptHex(p.Script) {
+		return nil, errInvalidScript
+	}
+	data, _ := hex.DecodeString(p.Script)
+	if err := script.Script(data).Validate(); err != nil {
+		return nil, errInvalidScript
+	}
+	return &TxOut{Amount: p.Amount, Script: p.Script}, nil
+}
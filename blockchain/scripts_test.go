@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/achung3071/gpcoin/script"
+	"github.com/achung3071/gpcoin/utils"
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+// Make a transaction spending output index of prevTx back to the wallet (leaving 1 as the fee),
+// with the unlocking script made by unlock from the id of the transaction
+func makeTestScriptSpend(prevTx *Tx, index int, unlock func(txId string) script.Script) *Tx {
+	tx := &Tx{
+		TxIns:  []*TxIn{{TxId: prevTx.Id, Index: index}},
+		TxOuts: []*TxOut{{Address: wallet.Wallet().Address, Amount: prevTx.TxOuts[index].Amount - 1}},
+	}
+	tx.getId()
+	tx.TxIns[0].Script = hex.EncodeToString(unlock(tx.Id))
+	return tx
+}
+
+// Signature of a transaction id by the wallet
+func testSignature(txId string) []byte {
+	signature, err := hex.DecodeString(wallet.Sign(txId, wallet.Wallet()))
+	utils.ErrorHandler(err)
+	return signature
+}
+
+func TestOutputScripts(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	bc, _ := useTestChain(3)
+	setTestMempool()
+	from := wallet.Wallet().Address
+	publicKey, _ := hex.DecodeString(from)
+	preimage := []byte("secret")
+	hashLock := hex.EncodeToString(script.NewHashLock(script.Hash(preimage)))
+	payToPubKeyHash := hex.EncodeToString(script.NewPayToPubKeyHash(script.Hash(publicKey)))
+
+	tx, err := makeTx(from, []Payment{{"", 10, hashLock}, {"", 20, payToPubKeyHash}}, TxOptions{Fee: 1})
+	if err != nil {
+		t.Fatalf("makeTx() could not pay to scripts: %v", err)
+	}
+	if tx.TxOuts[1].Script != hashLock || tx.TxOuts[2].Script != payToPubKeyHash || tx.TxOuts[1].Address != "" {
+		t.Fatalf("Expected outputs locked by the scripts, got %v and %v", tx.TxOuts[1], tx.TxOuts[2])
+	}
+	utils.ErrorHandler(bc.AddBlockFromPeer(mineTestBlock(bc, tx)))
+
+	t.Run("Outputs to an address should be locked by pay-to-pubkey", func(t *testing.T) {
+		locking, err := (&TxOut{Address: from, Amount: 1}).lockingScript()
+		if err != nil || !bytes.Equal(locking, script.NewPayToPubKey(publicKey)) {
+			t.Errorf("Expected %v, got %v (%v)", script.NewPayToPubKey(publicKey), locking, err)
+		}
+	})
+	t.Run("Inputs should be checked with the scripts of their outputs", func(t *testing.T) {
+		type test struct {
+			name     string
+			tx       *Tx
+			expected error
+		}
+		tests := []test{
+			{"Hash lock with the preimage", makeTestScriptSpend(tx, 1, func(string) script.Script {
+				return script.NewHashLockUnlock(preimage)
+			}), nil},
+			{"Hash lock with another preimage", makeTestScriptSpend(tx, 1, func(string) script.Script {
+				return script.NewHashLockUnlock([]byte("guess"))
+			}), ErrTxBadSignature},
+			{"Pay-to-pubkey-hash with a signature and the key", makeTestScriptSpend(tx, 2, func(txId string) script.Script {
+				return script.NewPayToPubKeyHashUnlock(testSignature(txId), publicKey)
+			}), nil},
+			{"Pay-to-pubkey-hash with only a signature", makeTestScriptSpend(tx, 2, func(txId string) script.Script {
+				return script.NewPayToPubKeyUnlock(testSignature(txId))
+			}), ErrTxBadSignature},
+			{"Unlocking script that does more than push", makeTestScriptSpend(tx, 1, func(string) script.Script {
+				return script.Script{}.AddOp(script.Op1).AddOp(script.OpNop)
+			}), ErrTxBadSignature},
+			{"Unlocking script of another input", makeTestScriptSpend(tx, 1, func(string) script.Script {
+				return script.NewPayToPubKeyHashUnlock(testSignature("ab"), publicKey)
+			}), ErrTxBadSignature},
+		}
+		for _, tc := range tests {
+			if _, err := validateTx(tc.tx, savedUTxOutSet()); err != tc.expected {
+				t.Errorf("%s: expected error '%v', got '%v'", tc.name, tc.expected, err)
+			}
+		}
+	})
+	t.Run("Blocks should take inputs unlocked by scripts", func(t *testing.T) {
+		spend := makeTestScriptSpend(tx, 1, func(string) script.Script {
+			return script.NewHashLockUnlock(preimage)
+		})
+		if err := bc.AddBlockFromPeer(mineTestBlock(bc, spend)); err != nil {
+			t.Errorf("AddBlockFromPeer() rejected a hash lock spent with its preimage: %v", err)
+		}
+	})
+	t.Run("Wallet should not count outputs locked by scripts", func(t *testing.T) {
+		for _, uTxOut := range UTxOutsByAddress(from, bc) {
+			if uTxOut.TxId == tx.Id && uTxOut.Index != 0 {
+				t.Errorf("Expected only the change of the transaction, got output %d", uTxOut.Index)
+			}
+		}
+		if (&TxOut{Address: from, Amount: 1, Script: payToPubKeyHash}).paysTo(from) {
+			t.Error("Expected an output with a script not to pay to its address")
+		}
+	})
+	t.Run("Payments should have a valid script or an address", func(t *testing.T) {
+		_, bob := makeTestKeyholder()
+		type test struct {
+			name     string
+			payment  Payment
+			expected error
+		}
+		tests := []test{
+			{"address and script", Payment{bob, 10, hashLock}, errPaymentTarget},
+			{"address that is not a public key", Payment{"bob", 10, ""}, errInvalidAddress},
+			{"address in uppercase hex", Payment{strings.ToUpper(bob), 10, ""}, errInvalidAddress},
+			{"address of the wrong size", Payment{bob + "00", 10, ""}, errInvalidAddress},
+			{"script that is not hex", Payment{"", 10, "xyz"}, errInvalidScript},
+			{"script in uppercase hex", Payment{"", 10, "AB"}, errInvalidScript},
+			{"script that cannot be read", Payment{"", 10, "4c"}, errInvalidScript},
+		}
+		for _, tc := range tests {
+			if _, err := makeTx(from, []Payment{tc.payment}, TxOptions{}); err != tc.expected {
+				t.Errorf("Payment with %s: expected error '%v', got '%v'", tc.name, tc.expected, err)
+			}
+		}
+	})
+	t.Run("Lock times in scripts should be checked against the transaction", func(t *testing.T) {
+		type test struct {
+			name     string
+			lockTime int // of the script
+			txLock   int // of the transaction
+			expected bool
+		}
+		tests := []test{
+			{"height before the transaction's", 10, 20, true},
+			{"height of the transaction", 20, 20, true},
+			{"height after the transaction's", 21, 20, false},
+			{"height for a transaction locked until a time", 10, lockTimeThreshold + 10, false},
+			{"time for a transaction locked until a height", lockTimeThreshold, 20, false},
+			{"time before the transaction's", lockTimeThreshold, lockTimeThreshold + 10, true},
+		}
+		for _, tc := range tests {
+			if ok := (txChecker{&Tx{LockTime: tc.txLock}}).CheckLockTime(tc.lockTime); ok != tc.expected {
+				t.Errorf("Lock time with %s: expected %t, got %t", tc.name, tc.expected, ok)
+			}
+		}
+	})
+	t.Run("Scripts should be in canonical hex", func(t *testing.T) {
+		malformed := &Tx{TxIns: []*TxIn{{TxId: tx.Id}}, TxOuts: []*TxOut{{Amount: 1, Script: "5A"}}}
+		malformed.getId()
+		if malformed.isWellFormed() {
+			t.Error("Expected a script in uppercase hex to be malformed")
+		}
+	})
+}
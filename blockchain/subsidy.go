@@ -0,0 +1,48 @@
+package blockchain
+
+// How the money supply works:
+// The coinbase of each block creates new coins (the block subsidy). The subsidy starts at
+// MinerReward and halves every HalvingInterval blocks, so the supply approaches a limit,
+// and no subsidy is paid once the total would go over MaxSupply.
+
+// Coins created by the main chain so far, and the most that can ever exist
+type SupplyInfo struct {
+	Height      int `json:"height"`
+	Circulating int `json:"circulating"`
+	Max         int `json:"max"`
+}
+
+// NON-MUTATING FUNCTIONS
+// Get the total subsidy of the blocks up to (and including) a height
+func supplyAt(height int) int {
+	supply := 0
+	reward := params.MinerReward
+	for start := 1; start <= height && reward > 0; start += params.HalvingInterval {
+		blocks := height - start + 1 // blocks of this halving interval up to the height
+		if blocks > params.HalvingInterval {
+			blocks = params.HalvingInterval
+		}
+		supply += blocks * reward
+		if supply >= params.MaxSupply {
+			return params.MaxSupply
+		}
+		reward /= 2
+	}
+	return supply
+}
+
+// Get the new coins the coinbase of a block at height can create
+func blockSubsidy(height int) int {
+	return supplyAt(height) - supplyAt(height-1)
+}
+
+// Get the supply of the main chain
+func Supply(b *blockchain) SupplyInfo {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return SupplyInfo{
+		Height:      b.Height,
+		Circulating: supplyAt(b.Height),
+		Max:         params.MaxSupply,
+	}
+}
@@ -0,0 +1,111 @@
+package blockchain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBlockSubsidy(t *testing.T) {
+	oldParams := params
+	defer func() { params = oldParams }()
+	params.MinerReward, params.HalvingInterval, params.MaxSupply = 50, 3, 1000
+
+	subsidies := func(n int) []int {
+		var amounts []int
+		for height := 1; height <= n; height++ {
+			amounts = append(amounts, blockSubsidy(height))
+		}
+		return amounts
+	}
+	t.Run("Subsidy should halve every HalvingInterval blocks", func(t *testing.T) {
+		expected := []int{50, 50, 50, 25, 25, 25, 12, 12, 12, 6}
+		if amounts := subsidies(10); !reflect.DeepEqual(amounts, expected) {
+			t.Errorf("Expected subsidies %v, got %v", expected, amounts)
+		}
+	})
+	t.Run("Subsidy should stop once it rounds down to zero", func(t *testing.T) {
+		if supply := supplyAt(1000); supply != 3*(50+25+12+6+3+1) {
+			t.Errorf("Expected supply %d, got %d", 3*(50+25+12+6+3+1), supply)
+		}
+	})
+	t.Run("Subsidy should never go over the max supply", func(t *testing.T) {
+		params.MaxSupply = 180
+		expected := []int{50, 50, 50, 25, 5, 0, 0}
+		if amounts := subsidies(7); !reflect.DeepEqual(amounts, expected) {
+			t.Errorf("Expected subsidies %v, got %v", expected, amounts)
+		}
+		if supply := supplyAt(100); supply != params.MaxSupply {
+			t.Errorf("Expected supply %d, got %d", params.MaxSupply, supply)
+		}
+	})
+}
+
+func TestCoinbaseSubsidy(t *testing.T) {
+	oldParams := params
+	defer func() { params = oldParams }()
+	params.MaxSupply = params.MinerReward + 1 // the second block can only pay 1
+
+	coinbase := createCoinbaseTx(2, 0)
+	if len(coinbase.TxOuts) != 1 || coinbase.TxOuts[0].Amount != 1 {
+		t.Errorf("Expected the coinbase to pay the capped subsidy, got %v", coinbase.TxOuts)
+	}
+	t.Run("Blocks after the max supply should pay nothing", func(t *testing.T) {
+		coinbase := createCoinbaseTx(3, 0)
+		if len(coinbase.TxOuts) != 0 {
+			t.Errorf("Expected no coinbase outputs, got %d", len(coinbase.TxOuts))
+		}
+		if err := validateBlockTxs([]*Tx{coinbase}, lockPoint{height: 3}, newUTxOutSet()); err != nil {
+			t.Errorf("Coinbase paying nothing was rejected: %v", err)
+		}
+		overpaying := createCoinbaseTx(2, 0)
+		overpaying.TxIns[0].Index = 3
+		overpaying.getId()
+		if err := validateBlockTxs([]*Tx{overpaying}, lockPoint{height: 3}, newUTxOutSet()); err != ErrInvalidCoinbase {
+			t.Errorf("Expected error '%v', got '%v'", ErrInvalidCoinbase, err)
+		}
+	})
+}
+
+func TestCoinbaseFees(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	bc := &blockchain{}
+	genesis := bc.addGenesisBlock()
+	setTestMempool()
+	defer setTestMempool()
+
+	tx := makeTestTx(genesis.Transactions[0], params.MinerReward-10) // 10 left as a fee
+	unknown := &Tx{Id: "unknown", TxIns: []*TxIn{{"x", 0, "", ""}}}  // inputs not on the chain, so no fee
+	setTestMempool(tx, unknown)
+	txs := Mempool().ConfirmTxs(lockPoint{height: 2})
+	coinbase := txs[0]
+	if len(coinbase.TxOuts) != 1 || coinbase.TxOuts[0].Amount != params.MinerReward+10 {
+		t.Errorf("Expected the coinbase to claim the subsidy and fees, got %v", coinbase.TxOuts)
+	}
+	t.Run("Fees of a transaction should only be claimed once", func(t *testing.T) {
+		doubleSpend := makeTestTx(genesis.Transactions[0], params.MinerReward-20)
+		setTestMempool(tx, doubleSpend)
+		coinbase := Mempool().ConfirmTxs(lockPoint{height: 2})[0]
+		if amount := coinbase.TxOuts[0].Amount; amount != params.MinerReward+10 && amount != params.MinerReward+20 {
+			t.Errorf("Expected the coinbase to claim the fees of one transaction, got %d", amount)
+		}
+	})
+}
+
+func TestSupply(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	bc := &blockchain{}
+	bc.addGenesisBlock()
+	block := mineTestBlock(bc)
+	if err := bc.AddBlockFromPeer(block); err != nil {
+		t.Fatal(err)
+	}
+	supply := Supply(bc)
+	expected := SupplyInfo{Height: 2, Circulating: 2 * params.MinerReward, Max: params.MaxSupply}
+	if supply != expected {
+		t.Errorf("Expected %v, got %v", expected, supply)
+	}
+}
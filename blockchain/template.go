@@ -0,0 +1,134 @@
+package blockchain
+
+import "container/heap"
+
+// How block templates work:
+// A block can hold at most MaxBlockSize bytes of transactions (see Tx.size()), so miners
+// pick the mempool transactions paying the most fee per byte first. A transaction can
+// spend the outputs of another mempool transaction, so it only becomes a candidate once
+// its parents are in the template (parents always come before their children). Whatever
+// does not fit stays in the mempool for later blocks.
+
+// Fee paid by a transaction and its size, so fee rates are compared without encoding it again
+type feeRate struct {
+	txId string // breaks ties between equal fee rates
+	fee  int
+	size int
+}
+
+// Candidates of a block template, highest fee rate first (see container/heap)
+type feeRateHeap []feeRate
+
+// NON-MUTATING FUNCTIONS
+// Size of a transaction in a block: its canonical encoding plus its signatures
+func (t *Tx) size() int {
+	size := len(t.encode())
+	for _, txIn := range t.TxIns {
+		size += len(txIn.Signature) + len(txIn.Script)
+	}
+	return size
+}
+
+// Total size of the transactions of a block
+func blockSize(txs []*Tx) int {
+	size := 0
+	for _, tx := range txs {
+		size += tx.size()
+	}
+	return size
+}
+
+// Checks if a transaction pays more per byte than another
+func (r feeRate) higherThan(other feeRate) bool {
+	left, right := r.fee*other.size, other.fee*r.size // r.fee/r.size > other.fee/other.size without rounding
+	if left != right {
+		return left > right
+	}
+	return r.txId < other.txId // same fee rate, so any fixed order will do
+}
+
+func (h feeRateHeap) Len() int           { return len(h) }
+func (h feeRateHeap) Less(i, j int) bool { return h[i].higherThan(h[j]) }
+
+// Checks if every input of a transaction is still in uTxOuts
+func spendsUnspent(tx *Tx, uTxOuts *uTxOutSet) bool {
+	for _, txIn := range tx.TxIns {
+		if uTxOuts.find(uTxOutKey(txIn.TxId, txIn.Index)) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Pick mempool transactions for a block at the given lock point, highest fee rate first,
+// until maxSize bytes are used. Spends the picked transactions from uTxOuts, and returns them
+// (parents first) with their total fee, along with the transactions that can never be
+// confirmed on top of uTxOuts (e.g., spending outputs that are already spent).
+// Transactions locked until a later block stay pending.
+func (m *mempool) selectTxs(uTxOuts *uTxOutSet, maxSize int, at lockPoint) (selected []*Tx, fees int, invalid []*Tx) {
+	candidates := &feeRateHeap{}
+	waiting := make(map[string]int) // number of parents not picked yet of each transaction
+	var consider, release func(id string)
+	consider = func(id string) { // once its parents are picked, or found invalid
+		tx := m.Txs[id]
+		if !tx.isFinal(at) {
+			return // stays pending, so its children are not picked either
+		}
+		fee, err := validateTx(tx, uTxOuts)
+		if err != nil {
+			invalid = append(invalid, tx)
+			release(id) // so its children are found invalid as well
+			return
+		}
+		heap.Push(candidates, feeRate{txId: id, fee: fee, size: m.entries[id].size})
+	}
+	release = func(id string) {
+		for child := range m.children[id] {
+			if waiting[child]--; waiting[child] == 0 {
+				consider(child)
+			}
+		}
+	}
+	ready := []string{}
+	for id, tx := range m.Txs {
+		if waiting[id] = len(m.parents(tx)); waiting[id] == 0 {
+			ready = append(ready, id)
+		}
+	}
+	for _, id := range ready {
+		consider(id)
+	}
+	size := 0
+	for candidates.Len() > 0 {
+		best := heap.Pop(candidates).(feeRate)
+		tx := m.Txs[best.txId]
+		if !spendsUnspent(tx, uTxOuts) { // a picked transaction spent the same output
+			invalid = append(invalid, tx)
+			release(best.txId)
+			continue
+		}
+		if size+best.size > maxSize {
+			continue // stays pending, so its children are not picked either
+		}
+		uTxOuts.apply(tx)
+		selected = append(selected, tx)
+		fees += best.fee
+		size += best.size
+		release(best.txId)
+	}
+	return selected, fees, invalid
+}
+
+// MUTATING FUNCTIONS
+func (h feeRateHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *feeRateHeap) Push(x interface{}) {
+	*h = append(*h, x.(feeRate))
+}
+
+func (h *feeRateHeap) Pop() interface{} {
+	old := *h
+	rate := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return rate
+}
@@ -0,0 +1,151 @@
+package blockchain
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/achung3071/gpcoin/utils"
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+// Start a chain with a few blocks whose coinbases pay the test wallet
+func newTestChain(blocks int) (*blockchain, []*Tx) {
+	bc := &blockchain{}
+	coinbases := []*Tx{bc.addGenesisBlock().Transactions[0]}
+	for i := 1; i < blocks; i++ {
+		block := mineTestBlock(bc)
+		utils.ErrorHandler(bc.AddBlockFromPeer(block))
+		coinbases = append(coinbases, block.Transactions[0])
+	}
+	return bc, coinbases
+}
+
+// Start a test chain and load it as the main chain (e.g., for the wallet)
+func useTestChain(blocks int) (*blockchain, []*Tx) {
+	_, coinbases := newTestChain(blocks)
+	once = *new(sync.Once)
+	return Blockchain(), coinbases
+}
+
+// Make a signed transaction spending every output of prevTx, leaving fee for the miner
+func makeTestTxWithFee(prevTx *Tx, fee int) *Tx {
+	tx := &Tx{TxOuts: []*TxOut{{wallet.Wallet().Address, -fee, ""}}}
+	for idx, txOut := range prevTx.TxOuts {
+		tx.TxIns = append(tx.TxIns, &TxIn{prevTx.Id, idx, "", ""})
+		tx.TxOuts[0].Amount += txOut.Amount
+	}
+	tx.getId()
+	tx.sign()
+	return tx
+}
+
+// Replace the mempool with the given transactions (parents first), without checking them
+func setTestMempool(txs ...*Tx) {
+	m := Mempool()
+	m.clear()
+	m.stats = MempoolStats{}
+	for _, tx := range txs {
+		fee, _ := validateTx(tx, m.pendingUTxOutSet()) // no fee if it is not valid
+		m.add(tx, fee, int(time.Now().Unix()))
+	}
+	m.unsaved = make(map[string]bool)
+}
+
+func TestSelectTxs(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	_, coinbases := newTestChain(4)
+
+	ids := func(txs []*Tx) []string {
+		result := []string{}
+		for _, tx := range txs {
+			result = append(result, tx.Id)
+		}
+		return result
+	}
+	low, high, mid := makeTestTxWithFee(coinbases[0], 5), makeTestTxWithFee(coinbases[1], 20), makeTestTxWithFee(coinbases[2], 10)
+
+	t.Run("Transactions should be picked by fee rate", func(t *testing.T) {
+		setTestMempool(low, high, mid)
+		txs, fees, invalid := Mempool().selectTxs(savedUTxOutSet(), params.MaxBlockSize, lockPoint{height: 2})
+		if expected := ids([]*Tx{high, mid, low}); !reflect.DeepEqual(ids(txs), expected) {
+			t.Errorf("Expected transactions %v, got %v", expected, ids(txs))
+		}
+		if fees != 35 || len(invalid) != 0 {
+			t.Errorf("Expected fees of 35 and no invalid transactions, got %d and %d", fees, len(invalid))
+		}
+	})
+	t.Run("Parents should come before their children", func(t *testing.T) {
+		parent := makeTestTxWithFee(coinbases[3], 0)
+		child := makeTestTxWithFee(parent, 30) // pays the most, but needs its parent
+		setTestMempool(child, low, parent)
+		txs, fees, _ := Mempool().selectTxs(savedUTxOutSet(), params.MaxBlockSize, lockPoint{height: 2})
+		if expected := ids([]*Tx{low, parent, child}); !reflect.DeepEqual(ids(txs), expected) {
+			t.Errorf("Expected transactions %v, got %v", expected, ids(txs))
+		}
+		if fees != 35 {
+			t.Errorf("Expected fees of 35, got %d", fees)
+		}
+	})
+	t.Run("Transactions should stop at the maximum size", func(t *testing.T) {
+		parent := makeTestTxWithFee(coinbases[3], 1)
+		child := makeTestTxWithFee(parent, 30)
+		setTestMempool(low, high, parent, child)
+		maxSize := high.size() + low.size() + parent.size() - 1 // not enough room for the parent
+		txs, _, invalid := Mempool().selectTxs(savedUTxOutSet(), maxSize, lockPoint{height: 2})
+		if expected := ids([]*Tx{high, low}); !reflect.DeepEqual(ids(txs), expected) {
+			t.Errorf("Expected transactions %v, got %v", expected, ids(txs))
+		}
+		if len(invalid) != 0 {
+			t.Errorf("Expected transactions that do not fit to stay valid, got %d invalid", len(invalid))
+		}
+	})
+	t.Run("Transactions that can never be confirmed should be returned as invalid", func(t *testing.T) {
+		doubleSpend := makeTestTxWithFee(coinbases[0], 1) // low pays more for the same output
+		unknown := makeTestTxWithFee(&Tx{Id: "x", TxOuts: []*TxOut{{"", 1, ""}}}, 0)
+		orphan := makeTestTxWithFee(unknown, 0) // parent can never be confirmed
+		setTestMempool(low, doubleSpend, unknown, orphan)
+		txs, _, invalid := Mempool().selectTxs(savedUTxOutSet(), params.MaxBlockSize, lockPoint{height: 2})
+		if expected := ids([]*Tx{low}); !reflect.DeepEqual(ids(txs), expected) {
+			t.Errorf("Expected transactions %v, got %v", expected, ids(txs))
+		}
+		if len(invalid) != 3 {
+			t.Errorf("Expected 3 invalid transactions, got %d", len(invalid))
+		}
+	})
+}
+
+func TestConfirmTxs(t *testing.T) {
+	oldStorage, oldParams := dbStorage, params
+	defer func() { dbStorage, params = oldStorage, oldParams }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	bc, coinbases := newTestChain(3)
+
+	low, high, unknown := makeTestTxWithFee(coinbases[0], 5), makeTestTxWithFee(coinbases[1], 20),
+		makeTestTxWithFee(&Tx{Id: "x", TxOuts: []*TxOut{{"", 1, ""}}}, 0)
+	setTestMempool(low, high, unknown)
+	params.MaxBlockSize = createCoinbaseTx(bc.Height+1, 1).size() + high.size() // room for one transaction
+	txs := Mempool().ConfirmTxs(lockPoint{height: bc.Height + 1})
+	if len(txs) != 2 || txs[1] != high {
+		t.Fatalf("Expected the coinbase and the highest paying transaction, got %d transactions", len(txs))
+	}
+	if txs[0].TxOuts[0].Amount != params.MinerReward+20 {
+		t.Errorf("Expected the coinbase to claim a fee of 20, got %d", txs[0].TxOuts[0].Amount-params.MinerReward)
+	}
+	t.Run("Transactions that do not fit should stay in the mempool", func(t *testing.T) {
+		if expected := map[string]*Tx{low.Id: low}; !reflect.DeepEqual(Mempool().Txs, expected) {
+			t.Errorf("Expected only transaction '%s' in the mempool, got %d transactions", low.Id, len(Mempool().Txs))
+		}
+	})
+	t.Run("Blocks over the maximum size should be rejected", func(t *testing.T) {
+		block := mineTestBlock(bc, low, high)
+		if err := bc.AddBlockFromPeer(block); err != ErrBlockTooLarge {
+			t.Errorf("Expected error '%v', got '%v'", ErrBlockTooLarge, err)
+		}
+	})
+}
@@ -2,9 +2,12 @@ package blockchain
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/achung3071/gpcoin/script"
 	"github.com/achung3071/gpcoin/utils"
 	"github.com/achung3071/gpcoin/wallet"
 )
@@ -15,62 +18,121 @@ import (
 // A coinbase transaction is the first transaction from the blockchain to the miner, as a reward
 // for mining the block (and verifying the transaction).
 
-const (
-	coinbaseAddress string = "COINBASE"
-	minerReward     int    = 50
-)
-
 // Holds info for one transaction
 type Tx struct {
 	Id        string   `json:"id"`
 	Timestamp int      `json:"timestamp"`
 	TxIns     []*TxIn  `json:"txIns"`
 	TxOuts    []*TxOut `json:"txOuts"`
+	LockTime  int      `json:"lockTime"` // first block height or time the transaction can be in (see locktime.go)
 }
 
 // Transaction input (previous transaction output that is being spent)
 type TxIn struct {
-	TxId      string `json:"txId"`      // transaction which created the TxOut (spent as this input)
-	Index     int    `json:"index"`     // index of TxOut within transaction
-	Signature string `json:"signature"` // signature by person creating the transaction
+	TxId      string `json:"txId"`             // transaction which created the TxOut (spent as this input)
+	Index     int    `json:"index"`            // index of TxOut within transaction (block height for a coinbase)
+	Signature string `json:"signature"`        // signature by person creating the transaction
+	Script    string `json:"script,omitempty"` // unlocking script in hex, for outputs with a script (see scripts.go)
 }
 
 // Transaction output (how much each party involved has after transaction)
 type TxOut struct {
 	Address string `json:"address"`
 	Amount  int    `json:"amount"`
+	Script  string `json:"script,omitempty"` // locking script in hex ("" for an output to Address)
+}
+
+// Recipient of a new transaction and how much they get
+type Payment struct {
+	To     string `json:"to"`
+	Amount int    `json:"amount"`
+	Script string `json:"script,omitempty"` // locking script in hex to pay to instead of an address
+}
+
+// How the wallet makes a transaction (besides who it pays)
+type TxOptions struct {
+	Fee           int        `json:"fee"`           // left for the miner of the block
+	CoinSelection string     `json:"coinSelection"` // name of a CoinSelector ("" for the node's default)
+	Inputs        []OutPoint `json:"inputs"`        // outputs to spend, instead of picking them
+	ChangeAddress string     `json:"changeAddress"` // where the change goes ("" for the wallet's address)
+	LockTime      int        `json:"lockTime"`      // see locktime.go (0 for none)
+}
+
+// Transaction output to spend, picked by the sender (coin control)
+type OutPoint struct {
+	TxId  string `json:"txId"`
+	Index int    `json:"index"`
 }
 
 // Unspent transaction output
 type UTxOut struct {
-	TxId   string `json:"txId"`
-	Index  int    `json:"index"`
-	Amount int    `json:"amount"`
+	TxId      string `json:"txId"`
+	Index     int    `json:"index"`
+	Amount    int    `json:"amount"`
+	Confirmed bool   `json:"confirmed"` // false for outputs of mempool transactions
+}
+
+// Unspent transaction outputs keyed by "txId:index". Changes are kept in memory on top
+// of the UTXO set saved in the db (if used), so that they can be saved all at once.
+type uTxOutSet struct {
+	changes map[string]*TxOut // nil when an output has been spent
+	saved   bool              // whether outputs without changes are looked up in the db
+	pending map[string]*Tx    // mempool transactions whose outputs are in the set too (see pendingUTxOutSet())
 }
 
 // Mempool is where unconfirmed transactions are (before added to a block)
 type mempool struct {
-	Txs map[string]*Tx `json:"txs"`
-	m   sync.Mutex
+	Txs       map[string]*Tx             `json:"txs"`
+	entries   map[string]*mempoolEntry   // details of the transactions in Txs (see mempool.go)
+	byFeeRate entryHeap                  // the entries, lowest fee rate first
+	byAge     ageHeap                    // the entries, oldest first
+	spentBy   map[string]string          // output key -> id of the mempool transaction spending it
+	children  map[string]map[string]bool // tx id -> ids of the mempool transactions spending its outputs
+	size      int                        // total size of the entries
+	stats     MempoolStats
+	unsaved   map[string]bool // ids of transactions added or removed since the mempool was saved
+	m         sync.Mutex
 }
 
 var m *mempool
 var memOnce sync.Once
 var errNoMoney error = errors.New("not enough funds to send specified amount")
 var errInvalidTx error = errors.New("inputs are not valid txOuts for the given wallet")
+var errInvalidFee error = errors.New("fee cannot be negative")
+var errNoPayments error = errors.New("transaction needs at least one recipient")
+var errInputNotFound error = errors.New("input is already spent or does not exist")
+var errInputNotOurs error = errors.New("input does not belong to the sender")
+var errInputInMempool error = errors.New("input is already spent by a mempool transaction")
+var errDuplicateInput error = errors.New("input is listed more than once")
+var errInvalidLockTime error = errors.New("lock time cannot be negative")
+
+// Reasons for rejecting a transaction in a block received from a peer
+var (
+	ErrTxNoInputs     error = errors.New("transaction has no inputs")
+	ErrTxInputSpent   error = errors.New("transaction input is already spent or does not exist")
+	ErrTxBadSignature error = errors.New("transaction input does not unlock the output it spends (e.g., is not signed by its owner)")
+	ErrTxBadAmount    error = errors.New("transaction output amount must be positive")
+	ErrTxOverspending error = errors.New("transaction outputs are more than its inputs")
+)
 
 func Mempool() *mempool {
 	memOnce.Do(func() {
-		m = &mempool{Txs: make(map[string]*Tx)}
+		m = &mempool{unsaved: make(map[string]bool)}
+		m.clear()
 	})
 	return m
 }
 
 // NON-MUTATING FUNCTIONS
-// Creates a transaction from the blockchain that gives a reward to the miner
-func createCoinbaseTx() *Tx {
-	txIns := []*TxIn{{"", -1, coinbaseAddress}}
-	txOuts := []*TxOut{{wallet.Wallet().Address, minerReward}}
+// Creates a transaction from the blockchain that gives a reward to the miner (the block
+// subsidy plus the fees of the block's transactions).
+// The block height is part of the input, so every coinbase has a different id.
+func createCoinbaseTx(height int, fees int) *Tx {
+	txIns := []*TxIn{{TxId: "", Index: height, Signature: params.CoinbaseAddress}}
+	txOuts := []*TxOut{}
+	if reward := blockSubsidy(height) + fees; reward > 0 { // nothing to pay once the supply is capped
+		txOuts = append(txOuts, &TxOut{Address: wallet.Wallet().Address, Amount: reward})
+	}
 	tx := Tx{
 		Id:        "",
 		Timestamp: int(time.Now().Unix()),
@@ -81,114 +143,378 @@ func createCoinbaseTx() *Tx {
 	return &tx
 }
 
-// Checks if a uTxOut is on the mempool already (so it isn't passed as an input again)
-func isOnMempool(uTxOut UTxOut) bool {
-	exists := false
-Outer:
-	for _, tx := range Mempool().Txs {
-		for _, txIn := range tx.TxIns {
-			if txIn.TxId == uTxOut.TxId && txIn.Index == uTxOut.Index {
-				exists = true // uTxOut is already being used on the mempool
-				break Outer   // using labels, break from outer for loop
+// Checks if a transaction is a coinbase transaction (reward from the blockchain)
+func isCoinbase(tx *Tx) bool {
+	return len(tx.TxIns) == 1 && tx.TxIns[0].TxId == "" &&
+		tx.TxIns[0].Signature == params.CoinbaseAddress
+}
+
+// Checks that a transaction (e.g., decoded from a peer message) has no
+// missing inputs/outputs and has the hash of its data as its id
+func (t *Tx) isWellFormed() bool {
+	if t == nil || t.LockTime < 0 {
+		return false
+	}
+	for _, txIn := range t.TxIns {
+		if txIn == nil || !isScriptHex(txIn.Script) {
+			return false
+		}
+	}
+	for _, txOut := range t.TxOuts {
+		if txOut == nil || !isScriptHex(txOut.Script) {
+			return false
+		}
+	}
+	return t.Id == t.calculateId()
+}
+
+// Key of a transaction output in a uTxOutSet
+func uTxOutKey(txId string, index int) string {
+	return fmt.Sprintf("%s:%d", txId, index)
+}
+
+// Get the transaction id and output index from a key in a uTxOutSet
+func splitUTxOutKey(key string) (string, int) {
+	index, err := strconv.Atoi(utils.Splitter(key, ":", 1))
+	utils.ErrorHandler(err)
+	return utils.Splitter(key, ":", 0), index
+}
+
+// Create an empty set of unspent transaction outputs (e.g., for validating a whole chain)
+func newUTxOutSet() *uTxOutSet {
+	return &uTxOutSet{changes: make(map[string]*TxOut)}
+}
+
+// Create a set of unspent transaction outputs for the main chain, backed by the db
+func savedUTxOutSet() *uTxOutSet {
+	return &uTxOutSet{changes: make(map[string]*TxOut), saved: true}
+}
+
+// Find an unspent transaction output (nil if it is spent or never existed)
+func (u *uTxOutSet) find(key string) *TxOut {
+	if txOut, ok := u.changes[key]; ok {
+		return txOut
+	}
+	if len(u.pending) > 0 {
+		txId, index := splitUTxOutKey(key)
+		if tx, ok := u.pending[txId]; ok {
+			if index < 0 || index >= len(tx.TxOuts) {
+				return nil
 			}
+			return tx.TxOuts[index]
+		}
+	}
+	if !u.saved {
+		return nil
+	}
+	data := dbStorage.FindUTxOut(key)
+	if data == nil {
+		return nil
+	}
+	txOut := &TxOut{}
+	utils.FromBytes(txOut, data)
+	return txOut
+}
+
+// Encode changes to the set so they can be saved in the db (nil removes an output)
+func (u *uTxOutSet) encodedChanges() map[string][]byte {
+	encoded := make(map[string][]byte)
+	for key, txOut := range u.changes {
+		if txOut == nil {
+			encoded[key] = nil
+		} else {
+			encoded[key] = utils.ToBytes(txOut)
+		}
+	}
+	return encoded
+}
+
+// Encode changes to the set by the owner of each output, so the db can index them (nil removes an
+// output). The owner of a spent output is taken from the db, as it is no longer in the set.
+func (u *uTxOutSet) encodedChangesByOwner() map[string]map[string][]byte {
+	encoded := make(map[string]map[string][]byte)
+	for key, txOut := range u.changes {
+		var data []byte
+		if txOut != nil {
+			data = utils.ToBytes(txOut)
+		} else if saved := dbStorage.FindUTxOut(key); saved != nil {
+			txOut = &TxOut{}
+			utils.FromBytes(txOut, saved)
+		} else {
+			continue // never saved, so never indexed
 		}
+		owner := txOut.owner()
+		if encoded[owner] == nil {
+			encoded[owner] = make(map[string][]byte)
+		}
+		encoded[owner][key] = data
+	}
+	return encoded
+}
+
+// Get the outputs that a sender picked to spend (see TxOptions), checking that each
+// one belongs to the sender (see TxOut.owner()) and is unspent, even by mempool transactions
+func (m *mempool) pickedUTxOuts(owner string, outPoints []OutPoint) ([]*UTxOut, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	pending, view := m.pendingUTxOutSet(), m.viewUTxOutSet()
+	uTxOuts := []*UTxOut{}
+	picked := make(map[string]bool)
+	for _, outPoint := range outPoints {
+		key := uTxOutKey(outPoint.TxId, outPoint.Index)
+		if picked[key] {
+			return nil, errDuplicateInput
+		}
+		picked[key] = true
+		txOut := pending.find(key)
+		if txOut == nil {
+			return nil, errInputNotFound
+		}
+		if txOut.owner() != owner {
+			return nil, errInputNotOurs
+		}
+		if view.find(key) == nil {
+			return nil, errInputInMempool
+		}
+		_, unconfirmed := m.Txs[outPoint.TxId]
+		uTxOuts = append(uTxOuts, &UTxOut{outPoint.TxId, outPoint.Index, txOut.Amount, !unconfirmed})
+	}
+	return uTxOuts, nil
+}
+
+// Create a new transaction from one address to one or more recipients, signed by our wallet
+// (see makeUnsignedTx())
+func makeTx(from string, payments []Payment, options TxOptions) (*Tx, error) {
+	tx, err := makeUnsignedTx(addressOwner(from), TxOut{Address: from}, payments, options)
+	if err != nil {
+		return nil, err
 	}
-	return exists
+	tx.sign()             // sign all inputs in transaction
+	valid := validate(tx) // ensure transaction inputs are valid
+	if !valid {
+		return nil, errInvalidTx
+	}
+	return tx, nil
 }
 
-// Create a new transaction from one address to another
-func makeTx(from string, to string, amount int) (*Tx, error) {
-	currBalance := BalanceByAddress(from, Blockchain())
-	if currBalance < amount {
-		return nil, errNoMoney
+// Create a new transaction spending outputs of a sender (see TxOut.owner()) to one
+// or more recipients, leaving fee for the miner (the fee is whatever the inputs have left after the
+// outputs are paid). Every payment is funded from the same inputs, with a single change output
+// locked like change (unless options has a change address). The inputs are either the ones given
+// in options (all of them are spent), or picked by the CoinSelector of options. The inputs are not
+// signed yet.
+func makeUnsignedTx(owner string, change TxOut, payments []Payment, options TxOptions) (*Tx, error) {
+	fee := options.Fee
+	if fee < 0 {
+		return nil, errInvalidFee
+	}
+	if options.LockTime < 0 {
+		return nil, errInvalidLockTime
+	}
+	if options.ChangeAddress != "" && !isAddress(options.ChangeAddress) {
+		return nil, errInvalidAddress
+	}
+	if len(payments) == 0 {
+		return nil, errNoPayments
+	}
+	selector, err := CoinSelection(options.CoinSelection)
+	if err != nil {
+		return nil, err
+	}
+	var uTxOuts []*UTxOut
+	if len(options.Inputs) > 0 {
+		uTxOuts, err = Mempool().pickedUTxOuts(owner, options.Inputs)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		uTxOuts = uTxOutsOwnedBy(owner, Blockchain())
+	}
+	currBalance := 0
+	for _, uTxOut := range uTxOuts {
+		currBalance += uTxOut.Amount
+	}
+	amount := 0 // total of the payments
+	paymentTxOuts := []*TxOut{}
+	for _, payment := range payments {
+		txOut, err := payment.txOut()
+		if err != nil {
+			return nil, err
+		}
+		paymentTxOuts = append(paymentTxOuts, txOut)
+		if payment.Amount <= 0 {
+			return nil, ErrTxBadAmount
+		}
+		if payment.Amount > currBalance-fee-amount { // compared this way so huge amounts cannot overflow
+			return nil, errNoMoney
+		}
+		amount += payment.Amount
 	}
 	txIns := []*TxIn{}
 	txOuts := []*TxOut{}
 	total := 0
-	uTxOuts := UTxOutsByAddress(from, Blockchain())
+	selected := uTxOuts
+	if len(options.Inputs) == 0 {
+		selected = selectUTxOuts(selector, uTxOuts, amount+fee)
+	}
 	// Append transaction inputs
-	for _, uTxOut := range uTxOuts {
-		if total >= amount {
-			break // enoungh TxIns added
-		}
+	for _, uTxOut := range selected {
 		total += uTxOut.Amount
-		txIns = append(txIns, &TxIn{uTxOut.TxId, uTxOut.Index, from})
+		txIns = append(txIns, &TxIn{TxId: uTxOut.TxId, Index: uTxOut.Index})
 	}
 	// Create transaction outputs
-	if change := total - amount; change > 0 {
+	if change.Amount = total - fee - amount; change.Amount > 0 {
 		// give change back as a transaction output
-		txOuts = append(txOuts, &TxOut{from, change})
+		if options.ChangeAddress != "" {
+			change = TxOut{Address: options.ChangeAddress, Amount: change.Amount}
+		}
+		txOuts = append(txOuts, &change)
 	}
-	txOuts = append(txOuts, &TxOut{to, amount})
+	txOuts = append(txOuts, paymentTxOuts...)
 	// Return final transaction
 	tx := Tx{
 		Id:        "",
 		Timestamp: int(time.Now().Unix()),
 		TxIns:     txIns,
 		TxOuts:    txOuts,
+		LockTime:  options.LockTime,
 	}
-	tx.getId()             // hash transaction to populate id
-	tx.sign()              // sign all inputs in transaction
-	valid := validate(&tx) // ensure transaction inputs are valid
-	if !valid {
-		return nil, errInvalidTx
-	}
+	tx.getId() // hash transaction to populate id
 	return &tx, nil
 }
 
+// Make and sign a transaction from our wallet without adding it to the mempool (e.g., one
+// locked until a later block, which can be added with AddTxFromPeer() once it is final)
+func SignTx(payments []Payment, options TxOptions) (*Tx, error) {
+	return makeTx(wallet.Wallet().Address, payments, options)
+}
+
 // Validate a transaction (i.e., that the wallet owner owns
 // the transaction outputs that are now used as inputs)
 func validate(tx *Tx) bool {
+	// If the public key (address) of an unspent output cannot verify the signature that
+	// I just created w/ my wallet, that means the TxOuts/funds are not actually mine
+	_, err := validateTx(tx, Mempool().view()) // inputs can be outputs of mempool transactions
+	return err == nil
+}
+
+// Check that every input of a transaction spends an output in uTxOuts that it
+// unlocks (see scripts.go), and that the outputs do not create money.
+// Returns the fee of the transaction (inputs minus outputs).
+func validateTx(tx *Tx, uTxOuts *uTxOutSet) (int, error) {
+	if len(tx.TxIns) == 0 {
+		return 0, ErrTxNoInputs
+	}
+	inputTotal := 0
+	spent := make(map[string]bool) // inputs spent earlier in this transaction
 	for _, txIn := range tx.TxIns {
-		// Find the transaction that created the transaction input
-		prevTx := FindTx(Blockchain(), txIn.TxId)
-		if prevTx == nil {
-			// Fake input: not on the blockchain
-			return false
+		key := uTxOutKey(txIn.TxId, txIn.Index)
+		txOut := uTxOuts.find(key)
+		if txOut == nil || spent[key] {
+			return 0, ErrTxInputSpent
 		}
-		prevTxOut := prevTx.TxOuts[txIn.Index]
-		address := prevTxOut.Address
-		// If the public key (address) cannot verify the signature that I just
-		// created w/ my wallet, that means the TxOuts/funds are not actually mine
-		if !wallet.Verify(tx.Id, txIn.Signature, address) {
-			return false
+		if err := unlocks(tx, txIn, txOut); errors.Is(err, script.ErrLockTime) {
+			return 0, ErrTxScriptLockTime // e.g., an HTLC refund before its lock time
+		} else if err != nil {
+			return 0, ErrTxBadSignature
 		}
+		spent[key] = true
+		inputTotal += txOut.Amount
 	}
-	return true // All transaction inputs verfied
+	remaining := inputTotal // subtract one output at a time so huge amounts cannot overflow
+	for _, txOut := range tx.TxOuts {
+		if txOut.Amount <= 0 {
+			return 0, ErrTxBadAmount
+		}
+		if txOut.Amount > remaining {
+			return 0, ErrTxOverspending
+		}
+		remaining -= txOut.Amount
+	}
+	return remaining, nil
 }
 
 // MUTATING FUNCTIONS
-// Add a transaction to a certain address on the mempool
-func (m *mempool) AddTx(to string, amount int) (*Tx, error) {
-	tx, err := makeTx(wallet.Wallet().Address, to, amount)
-	if err != nil {
-		return nil, err
+// Remove the outputs spent by a transaction and add the outputs it creates
+func (u *uTxOutSet) apply(tx *Tx) {
+	if !isCoinbase(tx) {
+		for _, txIn := range tx.TxIns {
+			u.changes[uTxOutKey(txIn.TxId, txIn.Index)] = nil
+		}
+	}
+	for idx, txOut := range tx.TxOuts {
+		u.changes[uTxOutKey(tx.Id, idx)] = txOut
+	}
+}
+
+// Apply every transaction in a block to the set
+func (u *uTxOutSet) connect(block *Block) {
+	for _, tx := range block.Transactions {
+		u.apply(tx)
 	}
-	m.Txs[tx.Id] = tx
-	return tx, nil
 }
 
-// Add a transaction from a peer on the network
-func (m *mempool) AddTxFromPeer(tx *Tx) {
+// Undo a block that is the newest block of the set's chain, removing the outputs it
+// created and bringing back the outputs it spent (found in the main chain's tx index)
+func (u *uTxOutSet) disconnect(block *Block) {
+	for i := len(block.Transactions) - 1; i >= 0; i-- { // newest transaction first
+		tx := block.Transactions[i]
+		for idx := range tx.TxOuts {
+			u.changes[uTxOutKey(tx.Id, idx)] = nil
+		}
+		if isCoinbase(tx) {
+			continue
+		}
+		for _, txIn := range tx.TxIns {
+			prevTx := findTx(txIn.TxId)
+			u.changes[uTxOutKey(txIn.TxId, txIn.Index)] = prevTx.TxOuts[txIn.Index]
+		}
+	}
+}
+
+// Removes the transactions that fit in a block at the given lock point (see template.go)
+// from the mempool, and returns them after the coinbase. Transactions that can never be
+// confirmed are dropped as well. The removals are only saved by saveConfirmed(), once the
+// block is committed, so a crash in between cannot lose the transactions.
+func (m *mempool) ConfirmTxs(at lockPoint) []*Tx {
+	height := at.height
 	m.m.Lock()
 	defer m.m.Unlock()
-	m.Txs[tx.Id] = tx
+	m.expire(int(time.Now().Unix()))
+	coinbaseSize := createCoinbaseTx(height, 1).size() // same size for any reward
+	txs, fees, invalid := m.selectTxs(savedUTxOutSet(), params.MaxBlockSize-coinbaseSize, at)
+	for _, tx := range append(txs, invalid...) {
+		m.remove(tx.Id)
+	}
+	// reward for mining new block & confirming transactions
+	return append([]*Tx{createCoinbaseTx(height, fees)}, txs...)
 }
 
-// Empties mempool and returns now-confirmed transactions
-func (m *mempool) ConfirmTxs() []*Tx {
-	// reward for mining new block & confirming transactions
-	txs := []*Tx{createCoinbaseTx()}
-	for _, tx := range m.Txs {
-		txs = append(txs, tx)
-	}
-	m.Txs = make(map[string]*Tx) // empty mempool
-	return txs
+// Save the removals of ConfirmTxs() once its block and the chain state are committed
+func (m *mempool) saveConfirmed() {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.save()
+}
+
+// Update the mempool for a new main chain (with unspent outputs uTxOuts, and its next
+// block at the given lock point): transactions from disconnected blocks are added back,
+// and transactions that were confirmed or now conflict with the chain are removed
+func (m *mempool) update(orphanedTxs []*Tx, uTxOuts *uTxOutSet, next lockPoint) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	defer m.save()
+	m.revalidate(orphanedTxs, uTxOuts, next)
+}
+
+// Hash the canonical encoding of a transaction
+func (t *Tx) calculateId() string {
+	return hashEncoding(t.encode())
 }
 
 // Populates id field of a transaction
 func (t *Tx) getId() {
-	t.Id = utils.Hash(t)
+	t.Id = t.calculateId()
 }
 
 // Sign all transaction inputs in a transaction
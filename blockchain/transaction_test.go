@@ -0,0 +1,104 @@
+package blockchain
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/achung3071/gpcoin/utils"
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+func TestMakeTx(t *testing.T) {
+	oldStorage := dbStorage
+	defer func() { dbStorage = oldStorage }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	_, coinbases := useTestChain(3)
+	setTestMempool()
+	from := wallet.Wallet().Address
+	_, alice := makeTestKeyholder()
+	_, bob := makeTestKeyholder()
+	_, carol := makeTestKeyholder()
+	_, treasury := makeTestKeyholder()
+
+	t.Run("makeTx() should pay every recipient from one set of inputs", func(t *testing.T) {
+		payments := []Payment{{alice, 30, ""}, {bob, 40, ""}, {carol, 20, ""}}
+		tx, err := makeTx(from, payments, TxOptions{Fee: 2})
+		if err != nil {
+			t.Fatalf("makeTx() failed: %v", err)
+		}
+		if len(tx.TxIns) != 2 || len(tx.TxOuts) != 4 {
+			t.Fatalf("Expected 2 inputs and 4 outputs, got %d and %d", len(tx.TxIns), len(tx.TxOuts))
+		}
+		if change := tx.TxOuts[0]; change.Address != from || change.Amount != 2*params.MinerReward-92 {
+			t.Errorf("Expected change of %d first, got %v", 2*params.MinerReward-92, change)
+		}
+		for i, payment := range payments {
+			if *tx.TxOuts[i+1] != (TxOut{payment.To, payment.Amount, ""}) {
+				t.Errorf("Expected output %v, got %v", payment, tx.TxOuts[i+1])
+			}
+		}
+	})
+	t.Run("makeTx() should reject payments it cannot make", func(t *testing.T) {
+		type test struct {
+			name     string
+			payments []Payment
+			err      error
+		}
+		tests := []test{
+			{"no recipients", nil, errNoPayments},
+			{"a zero amount", []Payment{{alice, 10, ""}, {bob, 0, ""}}, ErrTxBadAmount},
+			{"more than the balance in total", []Payment{{alice, 2 * params.MinerReward, ""}, {bob, params.MinerReward, ""}}, errNoMoney},
+			{"an amount that would overflow", []Payment{{alice, 10, ""}, {bob, int(^uint(0) >> 1), ""}}, errNoMoney},
+		}
+		for _, tc := range tests {
+			if _, err := makeTx(from, tc.payments, TxOptions{Fee: 1}); err != tc.err {
+				t.Errorf("Payments with %s: expected error '%v', got '%v'", tc.name, tc.err, err)
+			}
+		}
+		for _, changeAddress := range []string{"treasury", strings.ToUpper(treasury), treasury[2:]} {
+			options := TxOptions{Fee: 1, ChangeAddress: changeAddress}
+			if _, err := makeTx(from, []Payment{{alice, 10, ""}}, options); err != errInvalidAddress {
+				t.Errorf("Change address '%s': expected error '%v', got '%v'", changeAddress, errInvalidAddress, err)
+			}
+		}
+	})
+	t.Run("makeTx() should spend exactly the picked inputs", func(t *testing.T) {
+		inputs := []OutPoint{{coinbases[2].Id, 0}, {coinbases[1].Id, 0}}
+		tx, err := makeTx(from, []Payment{{alice, 10, ""}}, TxOptions{Fee: 1, Inputs: inputs, ChangeAddress: treasury})
+		if err != nil {
+			t.Fatalf("makeTx() failed: %v", err)
+		}
+		for i, txIn := range tx.TxIns {
+			if (OutPoint{txIn.TxId, txIn.Index}) != inputs[i] {
+				t.Errorf("Expected input %v, got %v", inputs[i], txIn)
+			}
+		}
+		if len(tx.TxIns) != 2 || *tx.TxOuts[0] != (TxOut{treasury, 2*params.MinerReward - 11, ""}) {
+			t.Errorf("Expected change of %d to the change address, got %v", 2*params.MinerReward-11, tx.TxOuts[0])
+		}
+	})
+	t.Run("makeTx() should reject picked inputs it cannot spend", func(t *testing.T) {
+		pending, err := makeTx(from, []Payment{{bob, 10, ""}}, TxOptions{Inputs: []OutPoint{{coinbases[1].Id, 0}}})
+		utils.ErrorHandler(err)
+		utils.ErrorHandler(Mempool().AddTxFromPeer(pending))
+		type test struct {
+			name   string
+			inputs []OutPoint
+			err    error
+		}
+		tests := []test{
+			{"an input listed twice", []OutPoint{{coinbases[2].Id, 0}, {coinbases[2].Id, 0}}, errDuplicateInput},
+			{"an unknown input", []OutPoint{{"x", 0}}, errInputNotFound},
+			{"an input of another address", []OutPoint{{pending.Id, 1}}, errInputNotOurs},
+			{"an input spent in the mempool", []OutPoint{{coinbases[1].Id, 0}}, errInputInMempool},
+			{"inputs worth too little", []OutPoint{{pending.Id, 0}}, errNoMoney},
+		}
+		for _, tc := range tests {
+			options := TxOptions{Fee: 1, Inputs: tc.inputs}
+			if _, err := makeTx(from, []Payment{{alice, params.MinerReward - 10, ""}}, options); err != tc.err {
+				t.Errorf("Transaction with %s: expected error '%v', got '%v'", tc.name, tc.err, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package blockchain
+
+import (
+	"sort"
+
+	"github.com/achung3071/gpcoin/utils"
+)
+
+// How spending unconfirmed outputs works:
+// A mempool transaction can spend the outputs of other mempool transactions (its parents),
+// e.g., the change of a payment we made before the next block. The wallet sees the UTXO
+// set as it will be once every mempool transaction is confirmed: outputs spent in the mempool
+// are gone, and the outputs of mempool transactions are there (marked as unconfirmed).
+// Block templates pick parents before their children (see template.go), and a transaction
+// leaving the mempool takes its descendants with it.
+//
+// Long chains of unconfirmed transactions are expensive to track and can only be mined
+// one block at a time if they do not fit, so a transaction can have at most MaxChainDepth-1
+// unconfirmed ancestors in a row. The wallet does not spend outputs that would go over it.
+
+// NON-MUTATING FUNCTIONS
+// Unspent outputs of the main chain plus the outputs of mempool transactions, including
+// those spent by other mempool transactions (see conflicts()). Outputs are looked up in the
+// mempool transactions when they are needed, so the mempool must stay locked while the set
+// is used.
+func (m *mempool) pendingUTxOutSet() *uTxOutSet {
+	uTxOuts := savedUTxOutSet()
+	uTxOuts.pending = m.Txs
+	return uTxOuts
+}
+
+// Unspent outputs once every mempool transaction is confirmed (the mempool must be locked).
+// The outputs of mempool transactions are in its changes, so they can be listed.
+func (m *mempool) viewUTxOutSet() *uTxOutSet {
+	uTxOuts := savedUTxOutSet()
+	for id, tx := range m.Txs {
+		for idx, txOut := range tx.TxOuts {
+			uTxOuts.changes[uTxOutKey(id, idx)] = txOut
+		}
+	}
+	for _, tx := range m.Txs {
+		for _, txIn := range tx.TxIns {
+			uTxOuts.changes[uTxOutKey(txIn.TxId, txIn.Index)] = nil
+		}
+	}
+	return uTxOuts
+}
+
+// Unspent outputs once every mempool transaction is confirmed
+func (m *mempool) view() *uTxOutSet {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.viewUTxOutSet()
+}
+
+// Get the ids of the mempool transactions whose outputs a transaction spends
+func (m *mempool) parents(tx *Tx) []string {
+	ids := []string{}
+	seen := make(map[string]bool)
+	for _, txIn := range tx.TxIns {
+		if _, ok := m.Txs[txIn.TxId]; ok && !seen[txIn.TxId] {
+			ids = append(ids, txIn.TxId)
+			seen[txIn.TxId] = true
+		}
+	}
+	return ids
+}
+
+// Number of transactions in the longest chain of mempool transactions ending with tx
+// (1 if it only spends confirmed outputs). Depths already found are kept in depths.
+func (m *mempool) depth(tx *Tx, depths map[string]int) int {
+	if depth, ok := depths[tx.Id]; ok {
+		return depth
+	}
+	depth := 1
+	for _, id := range m.parents(tx) {
+		if parentDepth := m.depth(m.Txs[id], depths); parentDepth+1 > depth {
+			depth = parentDepth + 1
+		}
+	}
+	depths[tx.Id] = depth
+	return depth
+}
+
+// Get the outputs of an owner (see TxOut.owner()) that can be spent:
+// unspent outputs of the main chain and of mempool transactions that are not spent in the mempool,
+// leaving out the outputs of transactions at the maximum chain depth. Confirmed outputs come first.
+func (m *mempool) spendableUTxOuts(owner string) []*UTxOut {
+	m.m.Lock()
+	defer m.m.Unlock()
+	view := m.viewUTxOutSet()
+	var uTxOuts []*UTxOut
+	for key, data := range dbStorage.LoadUTxOutsOf(owner) {
+		if txOut, ok := view.changes[key]; ok && txOut == nil {
+			continue // spent by a mempool transaction
+		}
+		txOut := &TxOut{}
+		utils.FromBytes(txOut, data)
+		txId, index := splitUTxOutKey(key)
+		uTxOuts = append(uTxOuts, &UTxOut{txId, index, txOut.Amount, true})
+	}
+	depths := make(map[string]int)
+	for key, txOut := range view.changes {
+		if txOut == nil || txOut.owner() != owner {
+			continue
+		}
+		txId, index := splitUTxOutKey(key)
+		if m.depth(m.Txs[txId], depths) < mempoolPolicy.MaxChainDepth {
+			uTxOuts = append(uTxOuts, &UTxOut{txId, index, txOut.Amount, false})
+		}
+	}
+	// Sort so that the same outputs are always spent first (map order is random)
+	sort.Slice(uTxOuts, func(i, j int) bool {
+		if uTxOuts[i].Confirmed != uTxOuts[j].Confirmed {
+			return uTxOuts[i].Confirmed
+		}
+		return uTxOutKey(uTxOuts[i].TxId, uTxOuts[i].Index) < uTxOutKey(uTxOuts[j].TxId, uTxOuts[j].Index)
+	})
+	return uTxOuts
+}
@@ -0,0 +1,60 @@
+package blockchain
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/achung3071/gpcoin/wallet"
+)
+
+func TestSpendUnconfirmed(t *testing.T) {
+	oldStorage, oldPolicy := dbStorage, mempoolPolicy
+	defer func() { dbStorage, mempoolPolicy = oldStorage, oldPolicy }()
+	dbStorage = newFakeDB()
+	defer setTestMempool()
+	bc, _ := useTestChain(2)
+	setTestMempool()
+	address := wallet.Wallet().Address
+	_, bob := makeTestKeyholder()
+
+	first, err := Mempool().AddTx([]Payment{{bob, 10, ""}}, TxOptions{Fee: 1})
+	if err != nil {
+		t.Fatalf("AddTx() failed: %v", err)
+	}
+	t.Run("Change of mempool transactions should be spendable", func(t *testing.T) {
+		uTxOuts := UTxOutsByAddress(address, bc)
+		if len(uTxOuts) != 2 || !uTxOuts[0].Confirmed || uTxOuts[1].Confirmed || uTxOuts[1].TxId != first.Id {
+			t.Fatalf("Expected a confirmed output and the unconfirmed change, got %d outputs", len(uTxOuts))
+		}
+		if balance := BalanceByAddress(address, bc); balance != 2*params.MinerReward-11 {
+			t.Errorf("Expected balance of %d, got %d", 2*params.MinerReward-11, balance)
+		}
+	})
+	second, err := Mempool().AddTx([]Payment{{bob, params.MinerReward + 5, ""}}, TxOptions{Fee: 1}) // needs the change of the first
+	if err != nil {
+		t.Fatalf("AddTx() could not spend unconfirmed change: %v", err)
+	}
+	t.Run("Block templates should include parents before children", func(t *testing.T) {
+		txs, fees, _ := Mempool().selectTxs(savedUTxOutSet(), params.MaxBlockSize, lockPoint{height: 2})
+		if !reflect.DeepEqual(txs, []*Tx{first, second}) || fees != 2 {
+			t.Errorf("Expected both transactions, parent first, with fees of 2, got %d transactions", len(txs))
+		}
+	})
+	t.Run("Chains of mempool transactions should be limited", func(t *testing.T) {
+		mempoolPolicy.MaxChainDepth = 2
+		for _, uTxOut := range UTxOutsByAddress(address, bc) {
+			if uTxOut.TxId == second.Id {
+				t.Error("Outputs of transactions at the maximum depth should not be spendable")
+			}
+		}
+		change := second.TxOuts[0] // change comes before the payment
+		third := &Tx{TxIns: []*TxIn{{second.Id, 0, "", ""}}, TxOuts: []*TxOut{{change.Address, change.Amount - 1, ""}}}
+		third.getId()
+		third.sign()
+		err := Mempool().AddTxFromPeer(third)
+		if !errors.Is(err, ErrTxChainTooLong) {
+			t.Errorf("Expected error '%v', got '%v'", ErrTxChainTooLong, err)
+		}
+	})
+}
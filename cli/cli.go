@@ -6,7 +6,9 @@ import (
 	"runtime"
 
 	"github.com/achung3071/gpcoin/api"
+	"github.com/achung3071/gpcoin/blockchain"
 	"github.com/achung3071/gpcoin/db"
+	"github.com/achung3071/gpcoin/utils"
 	"github.com/achung3071/gpcoin/webapp"
 )
 
@@ -14,16 +16,76 @@ func displayUsage() {
 	fmt.Printf("This is the GPCoin CLI.\n\n")
 	fmt.Printf("Please use the following flags\n\n")
 	fmt.Println("-mode:		Must be one of 'api', 'web'")
-	fmt.Println("-port:		Set the port that the server should run on")
+	fmt.Println("-network:	Must be one of 'mainnet', 'testnet', 'regtest'")
+	fmt.Println("-params:	Load chain parameters from a JSON file (missing fields come from -network)")
+	fmt.Println("-minegenesis:	Print the chain parameters with a newly mined genesis block, then exit")
+	fmt.Println("-port:		Set the port that the server should run on (default depends on the network)")
+	fmt.Println("-reindex:	Rebuild the UTXO set and tx/height indexes from the saved blocks")
+	fmt.Println("-maxmempool:	Most kilobytes of transactions kept in the mempool")
+	fmt.Println("-mempoolexpiry:	Hours before a transaction that has not been mined leaves the mempool")
+	fmt.Println("-rbf:		Let transactions paying a higher fee replace conflicting mempool transactions")
+	fmt.Println("-maxchaindepth:	Longest chain of unconfirmed transactions kept in the mempool")
+	fmt.Println("-coinselection:	How the wallet picks outputs to spend: 'largest-first', 'smallest-first', 'branch-and-bound', 'random'")
 	runtime.Goexit() // ensure deferred calls (db.Close) are honored even when exiting
 }
 
 func Start() {
 	// automatically get flags from CLI and parse
 	mode := flag.String("mode", "api", "Must be one of 'api', 'web'")
-	port := flag.Int("port", 5000, "Set the port that the server should run on")
+	network := flag.String("network", "mainnet", "Must be one of 'mainnet', 'testnet', 'regtest'")
+	paramsFile := flag.String("params", "", "Load chain parameters from a JSON file (missing fields come from -network)")
+	mineGenesis := flag.Bool("minegenesis", false, "Print the chain parameters with a newly mined genesis block, then exit")
+	port := flag.Int("port", 0, "Set the port that the server should run on (default depends on the network)")
+	reindex := flag.Bool("reindex", false, "Rebuild the UTXO set and tx/height indexes from the saved blocks")
+	maxMempool := flag.Int("maxmempool", 5000, "Most kilobytes of transactions kept in the mempool")
+	mempoolExpiry := flag.Int("mempoolexpiry", 336, "Hours before a transaction that has not been mined leaves the mempool")
+	rbf := flag.Bool("rbf", false, "Let transactions paying a higher fee replace conflicting mempool transactions")
+	maxChainDepth := flag.Int("maxchaindepth", 25, "Longest chain of unconfirmed transactions kept in the mempool")
+	coinSelection := flag.String("coinselection", blockchain.BranchAndBound, "How the wallet picks outputs to spend: 'largest-first', 'smallest-first', 'branch-and-bound', 'random'")
 	flag.Parse()
-	db.SetDBName(*port)
+	params, err := blockchain.NetworkParams(*network)
+	if err == nil && *paramsFile != "" {
+		params, err = blockchain.LoadParams(*paramsFile, params)
+	}
+	if err == nil && *mineGenesis {
+		// e.g., for a custom network whose parameters change the genesis block
+		params, err = blockchain.MineGenesis(params)
+		if err == nil {
+			fmt.Println(string(utils.ToJSON(params)))
+			return
+		}
+	}
+	if err == nil {
+		err = blockchain.SetParams(params)
+	}
+	if err != nil {
+		fmt.Printf("Invalid chain parameters: %s\n\n", err)
+		displayUsage()
+	}
+	policy := blockchain.MempoolPolicy{
+		MaxSize:       *maxMempool * 1000,
+		MaxAge:        *mempoolExpiry * 3600,
+		ReplaceByFee:  *rbf,
+		MinFeeBump:    1,
+		MaxChainDepth: *maxChainDepth,
+	}
+	if err := blockchain.SetMempoolPolicy(policy); err != nil {
+		fmt.Printf("Invalid mempool policy: %s\n\n", err)
+		displayUsage()
+	}
+	if err := blockchain.SetCoinSelection(*coinSelection); err != nil {
+		fmt.Printf("Invalid coin selection: %s\n\n", err)
+		displayUsage()
+	}
+	if *port == 0 {
+		*port = params.Port
+	}
+	db.SetDBName(params.Name, *port)
+	db.InitDB()
+	if *reindex {
+		blockchain.Blockchain().Reindex()
+	}
+	blockchain.Blockchain() // load the chain and the saved mempool before serving requests
 
 	switch *mode {
 	case "web":
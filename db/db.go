@@ -1,6 +1,8 @@
 package db
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 
 	"github.com/achung3071/gpcoin/utils"
@@ -8,11 +10,28 @@ import (
 )
 
 const (
-	dataBucketName   string = "data"
-	dataBucketKey    string = "metadata"
-	blocksBucketName string = "blocks"
+	dataBucketName    string = "data"
+	dataBucketKey     string = "metadata"
+	blocksBucketName  string = "blocks"
+	utxosBucketName   string = "utxos"
+	ownersBucketName  string = "owners"  // owner + txId:index -> unspent tx output (UTXO set by owner)
+	txsBucketName     string = "txs"     // txId -> location of the tx in the main chain
+	heightBucketName  string = "heights" // height -> hash of block in the main chain
+	mempoolBucketName string = "mempool" // txId -> unconfirmed transaction
 )
 
+// Changes to the chain that are saved together in a single db transaction,
+// so that the UTXO set and indexes always match the saved blockchain.
+// A nil value removes an entry.
+type ChainState struct {
+	Blockchain   []byte
+	Reset        bool                         // remove all UTXOs and index entries before saving changes
+	UTxOuts      map[string][]byte            // "txId:index" -> unspent tx output
+	OwnedUTxOuts map[string]map[string][]byte // owner (e.g., an address) -> "txId:index" -> unspent tx output
+	TxLocations  map[string][]byte            // txId -> location of tx in main chain
+	BlockHashes  map[int][]byte               // height -> block hash
+}
+
 // Struct to implement "storage" interface from blockchain pkg.
 type BoltDB struct{}
 
@@ -22,22 +41,41 @@ func (BoltDB) FindBlock(hash string) []byte {
 func (BoltDB) SaveBlock(hash string, data []byte) {
 	saveBlock(hash, data)
 }
-func (BoltDB) EmptyBlocks() {
-	emptyBlocks()
-}
-func (BoltDB) SaveBlockchain(data []byte) {
-	saveBlockchain(data)
-}
 func (BoltDB) LoadBlockchain() []byte {
 	return loadBlockchain()
 }
+func (BoltDB) SaveChainState(state ChainState) {
+	saveChainState(state)
+}
+func (BoltDB) FindUTxOut(key string) []byte {
+	return findUTxOut(key)
+}
+func (BoltDB) LoadUTxOuts() map[string][]byte {
+	return loadUTxOuts()
+}
+func (BoltDB) LoadUTxOutsOf(owner string) map[string][]byte {
+	return loadUTxOutsOf(owner)
+}
+func (BoltDB) FindTxLocation(txId string) []byte {
+	return findTxLocation(txId)
+}
+func (BoltDB) FindBlockHash(height int) string {
+	return findBlockHash(height)
+}
+func (BoltDB) SaveMempool(changes map[string][]byte) {
+	saveMempool(changes)
+}
+func (BoltDB) LoadMempool() map[string][]byte {
+	return loadMempool()
+}
 
 var db *bolt.DB
+var indexBucketNames = []string{utxosBucketName, ownersBucketName, txsBucketName, heightBucketName}
 var dbName string = "blockchain.db"
 
-// DB name reset to include port when cli.Start() called
-func SetDBName(port int) {
-	dbName = fmt.Sprintf("blockchain_%d.db", port)
+// DB name reset to include network and port when cli.Start() called
+func SetDBName(network string, port int) {
+	dbName = fmt.Sprintf("blockchain_%s_%d.db", network, port)
 }
 
 // Initialize database connection on program start
@@ -52,7 +90,14 @@ func InitDB() {
 			_, err := t.CreateBucketIfNotExists([]byte(dataBucketName))
 			utils.ErrorHandler(err)
 			_, err = t.CreateBucketIfNotExists([]byte(blocksBucketName))
-			return err
+			utils.ErrorHandler(err)
+			_, err = t.CreateBucketIfNotExists([]byte(mempoolBucketName))
+			utils.ErrorHandler(err)
+			for _, name := range indexBucketNames {
+				_, err = t.CreateBucketIfNotExists([]byte(name))
+				utils.ErrorHandler(err)
+			}
+			return nil
 		})
 		utils.ErrorHandler(err)
 	}
@@ -60,20 +105,9 @@ func InitDB() {
 
 // Close database connection
 func Close() {
-	db.Close()
-}
-
-// Remove blocks from blocks bucket in db
-func emptyBlocks() {
-	err := db.Update(func(t *bolt.Tx) error {
-		err := t.DeleteBucket([]byte(blocksBucketName))
-		if err != nil {
-			return err
-		}
-		_, err = t.CreateBucket([]byte(blocksBucketName))
-		return err
-	})
-	utils.ErrorHandler(err)
+	if db != nil { // not opened when the CLI exits early
+		db.Close()
+	}
 }
 
 // Get an existing block from the db
@@ -98,12 +132,154 @@ func loadBlockchain() []byte {
 	return data
 }
 
-// Save blockchain metadata to db
-func saveBlockchain(data []byte) {
+// Get an unspent transaction output from the db
+func findUTxOut(key string) []byte {
+	var data []byte
+	db.View(func(t *bolt.Tx) error {
+		utxosBucket := t.Bucket([]byte(utxosBucketName))
+		data = utxosBucket.Get([]byte(key))
+		return nil
+	})
+	return data
+}
+
+// Load every unspent transaction output from the db
+func loadUTxOuts() map[string][]byte {
+	return loadAll(utxosBucketName)
+}
+
+// Load the unspent transaction outputs of an owner ("txId:index" -> output), going through
+// its own outputs only
+func loadUTxOutsOf(owner string) map[string][]byte {
+	entries := make(map[string][]byte)
+	prefix := ownerPrefix(owner)
+	db.View(func(t *bolt.Tx) error {
+		cursor := t.Bucket([]byte(ownersBucketName)).Cursor()
+		for key, data := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, data = cursor.Next() {
+			entries[string(key[len(prefix):])] = append([]byte{}, data...)
+		}
+		return nil
+	})
+	return entries
+}
+
+// Start of the keys of an owner's outputs in the owners bucket. Owners are prefixed with their
+// length, so no owner's keys start with the prefix of another.
+func ownerPrefix(owner string) []byte {
+	prefix := make([]byte, 4, 4+len(owner))
+	binary.BigEndian.PutUint32(prefix, uint32(len(owner)))
+	return append(prefix, owner...)
+}
+
+// Load every transaction saved from the mempool
+func loadMempool() map[string][]byte {
+	return loadAll(mempoolBucketName)
+}
+
+// Load every entry of a bucket
+func loadAll(bucketName string) map[string][]byte {
+	entries := make(map[string][]byte)
+	db.View(func(t *bolt.Tx) error {
+		bucket := t.Bucket([]byte(bucketName))
+		return bucket.ForEach(func(key, data []byte) error {
+			// bolt reuses key/data memory after the transaction, so copy them
+			entries[string(key)] = append([]byte{}, data...)
+			return nil
+		})
+	})
+	return entries
+}
+
+// Get the location of a transaction in the main chain
+func findTxLocation(txId string) []byte {
+	var data []byte
+	db.View(func(t *bolt.Tx) error {
+		txsBucket := t.Bucket([]byte(txsBucketName))
+		data = txsBucket.Get([]byte(txId))
+		return nil
+	})
+	return data
+}
+
+// Get the hash of the block at a height of the main chain ("" if none)
+func findBlockHash(height int) string {
+	var hash string
+	db.View(func(t *bolt.Tx) error {
+		heightBucket := t.Bucket([]byte(heightBucketName))
+		hash = string(heightBucket.Get(heightKey(height)))
+		return nil
+	})
+	return hash
+}
+
+// Encode a height as a fixed-size key, so that blocks are kept in height order
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+	return key
+}
+
+// Put (or delete, for nil data) every entry in a bucket
+func putAll(bucket *bolt.Bucket, entries map[string][]byte) error {
+	for key, data := range entries {
+		var err error
+		if data == nil {
+			err = bucket.Delete([]byte(key))
+		} else {
+			err = bucket.Put([]byte(key), data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save blockchain metadata with changes to the UTXO set and indexes in a single db transaction
+func saveChainState(state ChainState) {
 	err := db.Update(func(t *bolt.Tx) error {
+		if state.Reset {
+			for _, name := range indexBucketNames {
+				if err := t.DeleteBucket([]byte(name)); err != nil {
+					return err
+				}
+				if _, err := t.CreateBucket([]byte(name)); err != nil {
+					return err
+				}
+			}
+		}
+		blockHashes := make(map[string][]byte)
+		for height, hash := range state.BlockHashes {
+			blockHashes[string(heightKey(height))] = hash
+		}
+		if err := putAll(t.Bucket([]byte(utxosBucketName)), state.UTxOuts); err != nil {
+			return err
+		}
+		ownedUTxOuts := make(map[string][]byte)
+		for owner, uTxOuts := range state.OwnedUTxOuts {
+			for key, data := range uTxOuts {
+				ownedUTxOuts[string(ownerPrefix(owner))+key] = data
+			}
+		}
+		if err := putAll(t.Bucket([]byte(ownersBucketName)), ownedUTxOuts); err != nil {
+			return err
+		}
+		if err := putAll(t.Bucket([]byte(txsBucketName)), state.TxLocations); err != nil {
+			return err
+		}
+		if err := putAll(t.Bucket([]byte(heightBucketName)), blockHashes); err != nil {
+			return err
+		}
 		dataBucket := t.Bucket([]byte(dataBucketName))
-		err := dataBucket.Put([]byte(dataBucketKey), data) // updata db with chain data
-		return err
+		return dataBucket.Put([]byte(dataBucketKey), state.Blockchain) // updata db with chain data
+	})
+	utils.ErrorHandler(err)
+}
+
+// Save changes to the mempool (a nil value removes a transaction)
+func saveMempool(changes map[string][]byte) {
+	err := db.Update(func(t *bolt.Tx) error {
+		return putAll(t.Bucket([]byte(mempoolBucketName)), changes)
 	})
 	utils.ErrorHandler(err)
 }
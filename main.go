@@ -7,6 +7,5 @@ import (
 
 func main() {
 	defer db.Close() // close db connection when program exits
-	db.InitDB()
-	cli.Start()
+	cli.Start()      // opens the db once the network and port are known
 }
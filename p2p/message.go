@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/achung3071/gpcoin/blockchain"
@@ -82,11 +83,11 @@ func handleMessage(m *Message, p *peer) {
 		fmt.Printf("Received newest block from %s.\n", p.key)
 		var payload blockchain.Block
 		utils.ErrorHandler(json.Unmarshal(m.Payload, &payload))
-		latestBlock, err := blockchain.FindBlock(blockchain.Blockchain().LastHash)
-		utils.ErrorHandler(err)
-		if payload.Height >= latestBlock.Height { // our node is behind, so request blocks
+		if _, err := blockchain.FindBlock(payload.Hash); err != nil {
+			// block we don't have, so request blocks to see if their chain has more work
 			requestAllBlocks(p)
-		} else { // our node is ahead, so send newest block to let them know they are behind
+		} else if blockchain.Blockchain().HasMoreWork(payload.Hash) {
+			// our chain has more work, so send newest block to let them know they are behind
 			sendNewestBlock(p)
 		}
 	case MessageAllBlocksRequest:
@@ -96,20 +97,41 @@ func handleMessage(m *Message, p *peer) {
 		fmt.Printf("Received all blocks from the blockchain of %s.\n", p.key)
 		var payload []*blockchain.Block
 		utils.ErrorHandler(json.Unmarshal(m.Payload, &payload))
-		blockchain.Blockchain().Replace(payload)
+		err := blockchain.Blockchain().Replace(payload)
+		if err == blockchain.ErrNotEnoughWork {
+			if blockchain.Blockchain().HasMoreWork(payload[0].Hash) {
+				sendNewestBlock(p) // let them know that our chain has more work
+			}
+		} else if err != nil {
+			fmt.Printf("Rejected blocks from %s: %s\n", p.key, err)
+		}
 	case MessageNotifyNewBlock:
 		var payload *blockchain.Block
 		utils.ErrorHandler(json.Unmarshal(m.Payload, &payload))
-		blockchain.Blockchain().AddBlockFromPeer(payload)
+		err := blockchain.Blockchain().AddBlockFromPeer(payload)
+		if err == blockchain.ErrUnknownParent {
+			requestAllBlocks(p) // we are missing blocks from their chain
+		} else if err != nil {
+			fmt.Printf("Rejected block from %s: %s\n", p.key, err)
+		}
 	case MessageNotifyNewPeer:
 		var payload BroadcastPeerInfo
 		utils.ErrorHandler(json.Unmarshal(m.Payload, &payload))
 		// broadcast is false b/c new peer has already been broadcasted to other peers
-		AddPeer(payload.NewPeerAddress, payload.NewPeerPort, payload.ReceivingPort, false)
+		err := AddPeer(payload.NewPeerAddress, payload.NewPeerPort, payload.ReceivingPort, false)
+		if err != nil {
+			fmt.Printf("Could not connect to %s:%s: %s\n", payload.NewPeerAddress, payload.NewPeerPort, err)
+		}
 	case MessageNotifyNewTx:
 		var payload *blockchain.Tx
 		utils.ErrorHandler(json.Unmarshal(m.Payload, &payload))
-		blockchain.Mempool().AddTxFromPeer(payload)
+		err := blockchain.Mempool().AddTxFromPeer(payload)
+		var rejection *blockchain.TxRejectError
+		if errors.As(err, &rejection) && rejection.Invalid() {
+			p.penalize(invalidTxScore, err)
+		} else if err != nil {
+			fmt.Printf("Rejected transaction from %s: %s\n", p.key, err)
+		}
 	}
 
 }
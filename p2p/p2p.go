@@ -1,15 +1,22 @@
 package p2p
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
+	"github.com/achung3071/gpcoin/blockchain"
 	"github.com/achung3071/gpcoin/utils"
 	"github.com/gorilla/websocket"
 )
 
+// Header in which a node sends the hash of its genesis block when accepting a peer
+const genesisHeader string = "Gpcoin-Genesis"
+
 var upgrader websocket.Upgrader = websocket.Upgrader{}
 
+var ErrGenesisMismatch error = errors.New("peer is on a network with another genesis block")
+
 // Upgrade http request to websocket connection
 // (e.g., :4000 accepts a websocket upgrade request from :5000)
 func Upgrade(rw http.ResponseWriter, r *http.Request) {
@@ -17,24 +24,40 @@ func Upgrade(rw http.ResponseWriter, r *http.Request) {
 	originIp := utils.Splitter(r.RemoteAddr, ":", 0)
 	openPort := r.URL.Query().Get("openPort")
 	fmt.Printf("Port %s wants a websocket upgrade from this node.\n", openPort)
+	// Only nodes with the same genesis block (i.e., on the same network) can be peers
+	genesisHash := blockchain.Params().GenesisHash
+	if r.URL.Query().Get("genesis") != genesisHash {
+		fmt.Printf("Rejected port %s: %s\n", openPort, ErrGenesisMismatch)
+		http.Error(rw, ErrGenesisMismatch.Error(), http.StatusConflict)
+		return
+	}
 	// Don't allow connection if invalid ip or no open port
 	upgrader.CheckOrigin = func(r *http.Request) bool {
 		return originIp != "" && openPort != ""
 	}
-	conn, err := upgrader.Upgrade(rw, r, nil) // return ws connection
+	header := http.Header{genesisHeader: []string{genesisHash}}
+	conn, err := upgrader.Upgrade(rw, r, header) // return ws connection
 	utils.ErrorHandler(err)
 	initPeer(conn, originIp, openPort)
 }
 
 // Add a peer (initiate a websocket connection with another node)
 // (e.g., :5000 requests a websocket upgrade to :4000)
-func AddPeer(address, port, myPort string, broadcast bool) {
+func AddPeer(address, port, myPort string, broadcast bool) error {
 	fmt.Printf("This node (port %s) wants to connect to port %s.\n", myPort, port)
-	url := fmt.Sprintf("ws://%s:%s/ws?openPort=%s", address, port, myPort)
+	genesisHash := blockchain.Params().GenesisHash
+	url := fmt.Sprintf("ws://%s:%s/ws?openPort=%s&genesis=%s", address, port, myPort, genesisHash)
 	// Request a websocket upgrade from the other node
 	// (2nd argument (nil) is request header, usually w/ credentials/cookies)
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	conn, res, err := websocket.DefaultDialer.Dial(url, nil)
+	if res != nil && res.StatusCode == http.StatusConflict {
+		return ErrGenesisMismatch // they rejected our genesis block
+	}
 	utils.ErrorHandler(err)
+	if res.Header.Get(genesisHeader) != genesisHash {
+		conn.Close()
+		return ErrGenesisMismatch
+	}
 	p := initPeer(conn, address, port) // add to list of active peers
 	if broadcast {
 		// If new peer was added via API reqeust, then broadcast to other peers
@@ -45,5 +68,5 @@ func AddPeer(address, port, myPort string, broadcast bool) {
 		// otherwise added via broadcast, so no need to broadcast again (inf. loop)
 		sendNewestBlock(p) // send newest block to peer
 	}
-
+	return nil
 }
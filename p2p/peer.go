@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 
@@ -13,6 +14,7 @@ type peer struct {
 	inbox   chan []byte // holds outgoing messages to peer
 	key     string
 	port    string
+	score   int // misbehavior of the peer (see penalize())
 }
 
 type peers struct {
@@ -23,6 +25,13 @@ type peers struct {
 // Map of peers connected to this node (address -> peer)
 var Peers peers = peers{v: make(map[string]*peer)}
 
+const (
+	maxScore       = 100 // peers are disconnected once they misbehave this much
+	invalidTxScore = 10  // relaying a transaction that breaks the rules
+)
+
+var errMisbehaving error = errors.New("peer sent too many invalid messages")
+
 // NON-MUTATING FUNCTIONS
 // Get a list of all peer addresses to return
 func AllPeers(p *peers) []string {
@@ -62,6 +71,18 @@ func (p *peer) close() {
 	delete(Peers.v, p.key) // Will close inbox channel
 }
 
+// Add to the misbehavior score of a peer, disconnecting it once it reaches maxScore
+func (p *peer) penalize(points int, reason error) {
+	Peers.m.Lock()
+	defer Peers.m.Unlock()
+	p.score += points
+	fmt.Printf("Penalized %s (score %d/%d): %s\n", p.key, p.score, maxScore, reason)
+	if p.score >= maxScore {
+		fmt.Printf("Disconnecting %s: %s\n", p.key, errMisbehaving)
+		p.conn.Close() // read() then fails and removes the peer
+	}
+}
+
 // Continue to read messages from peers
 func (p *peer) read() {
 	defer p.close() // close after function (after loop break)
@@ -0,0 +1,298 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// Checks signatures for the transaction whose input is being unlocked
+type SignatureChecker interface {
+	// Checks if signature is a valid signature of the transaction by publicKey
+	CheckSig(signature []byte, publicKey []byte) bool
+}
+
+// Checks lock times for the transaction whose input is being unlocked (a SignatureChecker
+// can also be one, for OP_CHECKLOCKTIMEVERIFY)
+type LockTimeChecker interface {
+	// Checks if the transaction is locked until at least lockTime (a block height or a unix
+	// time, which must be the same kind as the lock time of the transaction)
+	CheckLockTime(lockTime int) bool
+}
+
+// State of running scripts
+type engine struct {
+	stack   [][]byte
+	conds   []bool // for each OP_IF that is not closed yet, whether its current branch runs
+	ops     int    // opcodes run other than pushes
+	checker SignatureChecker
+}
+
+// NON-MUTATING FUNCTIONS
+// Run an unlocking script and then the locking script of the output it spends, returning
+// nil if the output is unlocked (or the reason it is not). Without a checker, every
+// signature is invalid, and so is every lock time without a LockTimeChecker.
+func Verify(unlocking Script, locking Script, checker SignatureChecker) error {
+	if err := unlocking.Validate(); err != nil {
+		return err
+	}
+	if !unlocking.IsPushOnly() {
+		return ErrNotPushOnly
+	}
+	e := &engine{checker: checker}
+	if err := e.run(unlocking); err != nil {
+		return err
+	}
+	if err := e.run(locking); err != nil {
+		return err
+	}
+	if len(e.stack) == 0 || !asBool(e.stack[len(e.stack)-1]) {
+		return ErrScriptFailed
+	}
+	return nil
+}
+
+// Checks if data on the stack is true (anything other than zero, including negative zero)
+func asBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 && !(i == len(data)-1 && b == 0x80) {
+			return true
+		}
+	}
+	return false
+}
+
+// Data pushed for a boolean result
+func fromBool(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+// Checks if the current branch of every open OP_IF runs
+func (e *engine) executing() bool {
+	for _, cond := range e.conds {
+		if !cond {
+			return false
+		}
+	}
+	return true
+}
+
+// MUTATING FUNCTIONS
+// Run every instruction of a script on the stack (OP_IFs must be closed in the same script)
+func (e *engine) run(s Script) error {
+	instructions, err := s.instructions()
+	if err != nil {
+		return err
+	}
+	e.conds = nil
+	for _, inst := range instructions {
+		if !inst.op.isPush() {
+			e.ops++
+			if e.ops > MaxOps {
+				return ErrTooManyOps
+			}
+		}
+		if err := e.step(inst); err != nil {
+			return err
+		}
+		if len(e.stack) > MaxStackSize {
+			return ErrStackOverflow
+		}
+	}
+	if len(e.conds) > 0 {
+		return ErrUnbalancedIf
+	}
+	return nil
+}
+
+// Push data on the stack
+func (e *engine) push(data []byte) {
+	e.stack = append(e.stack, data)
+}
+
+// Pop n items off the stack (the top item last)
+func (e *engine) pop(n int) ([][]byte, error) {
+	if len(e.stack) < n {
+		return nil, ErrStackUnderflow
+	}
+	items := append([][]byte{}, e.stack[len(e.stack)-n:]...) // copied, since pushes reuse the array
+	e.stack = e.stack[:len(e.stack)-n]
+	return items, nil
+}
+
+// Pop a number (see encodeNum())
+func (e *engine) popNum() (int, error) {
+	items, err := e.pop(1)
+	if err != nil {
+		return 0, err
+	}
+	return decodeNum(items[0], maxNumSize)
+}
+
+// Pop the number of keys, the keys, the number of signatures and the signatures (each list in
+// the order they were pushed), and check that the signatures are by different keys, in the same
+// order as the keys. Every key checked counts as an opcode.
+func (e *engine) checkMultiSig() (bool, error) {
+	keyCount, err := e.popNum()
+	if err != nil {
+		return false, err
+	}
+	if keyCount < 1 || keyCount > MaxMultisigKeys {
+		return false, ErrInvalidMultisig
+	}
+	e.ops += keyCount
+	if e.ops > MaxOps {
+		return false, ErrTooManyOps
+	}
+	keys, err := e.pop(keyCount)
+	if err != nil {
+		return false, err
+	}
+	sigCount, err := e.popNum()
+	if err != nil {
+		return false, err
+	}
+	if sigCount < 1 || sigCount > keyCount {
+		return false, ErrInvalidMultisig
+	}
+	signatures, err := e.pop(sigCount)
+	if err != nil {
+		return false, err
+	}
+	matched := 0 // signatures matched with a key so far
+	for i := 0; i < len(keys) && matched < len(signatures); i++ {
+		if len(signatures)-matched > len(keys)-i {
+			break // not enough keys left for the other signatures
+		}
+		if e.checker != nil && e.checker.CheckSig(signatures[matched], keys[i]) {
+			matched++
+		}
+	}
+	return matched == len(signatures), nil
+}
+
+// Run one instruction
+func (e *engine) step(inst instruction) error {
+	op := inst.op
+	if !e.executing() && (op < OpIf || op > OpEndIf) { // skipped branch, but still tracking OP_IFs
+		return nil
+	}
+	switch {
+	case op >= Op1 && op <= Op16:
+		e.push([]byte{byte(op-Op1) + 1})
+		return nil
+	case op.isPush():
+		e.push(append([]byte{}, inst.data...))
+		return nil
+	}
+	switch op {
+	case OpNop:
+	case OpIf, OpNotIf:
+		cond := false
+		if e.executing() {
+			items, err := e.pop(1)
+			if err != nil {
+				return err
+			}
+			cond = asBool(items[0]) == (op == OpIf)
+		}
+		e.conds = append(e.conds, cond)
+	case OpElse:
+		if len(e.conds) == 0 {
+			return ErrUnbalancedIf
+		}
+		e.conds[len(e.conds)-1] = !e.conds[len(e.conds)-1]
+	case OpEndIf:
+		if len(e.conds) == 0 {
+			return ErrUnbalancedIf
+		}
+		e.conds = e.conds[:len(e.conds)-1]
+	case OpVerify:
+		items, err := e.pop(1)
+		if err != nil {
+			return err
+		}
+		if !asBool(items[0]) {
+			return ErrVerifyFailed
+		}
+	case OpReturn:
+		return ErrReturn
+	case OpDrop:
+		_, err := e.pop(1)
+		return err
+	case OpDup:
+		if len(e.stack) < 1 {
+			return ErrStackUnderflow
+		}
+		e.push(e.stack[len(e.stack)-1])
+	case OpSwap:
+		items, err := e.pop(2)
+		if err != nil {
+			return err
+		}
+		e.push(items[1])
+		e.push(items[0])
+	case OpEqual, OpEqualVerify:
+		items, err := e.pop(2)
+		if err != nil {
+			return err
+		}
+		equal := bytes.Equal(items[0], items[1])
+		if op == OpEqualVerify {
+			if !equal {
+				return ErrVerifyFailed
+			}
+			return nil
+		}
+		e.push(fromBool(equal))
+	case OpSHA256:
+		items, err := e.pop(1)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(items[0])
+		e.push(hash[:])
+	case OpCheckSig, OpCheckSigVerify:
+		items, err := e.pop(2) // signature, then public key
+		if err != nil {
+			return err
+		}
+		valid := e.checker != nil && e.checker.CheckSig(items[0], items[1])
+		if op == OpCheckSigVerify {
+			if !valid {
+				return ErrVerifyFailed
+			}
+			return nil
+		}
+		e.push(fromBool(valid))
+	case OpCheckMultiSig, OpCheckMultiSigVerify:
+		valid, err := e.checkMultiSig()
+		if err != nil {
+			return err
+		}
+		if op == OpCheckMultiSigVerify {
+			if !valid {
+				return ErrVerifyFailed
+			}
+			return nil
+		}
+		e.push(fromBool(valid))
+	case OpCheckLockTimeVerify:
+		if len(e.stack) < 1 {
+			return ErrStackUnderflow
+		}
+		lockTime, err := decodeNum(e.stack[len(e.stack)-1], maxLockTimeSize) // left on the stack
+		if err != nil {
+			return err
+		}
+		checker, ok := e.checker.(LockTimeChecker)
+		if lockTime < 0 || !ok || !checker.CheckLockTime(lockTime) {
+			return ErrLockTime
+		}
+	default:
+		return ErrUnknownOpcode
+	}
+	return nil
+}
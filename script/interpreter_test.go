@@ -0,0 +1,280 @@
+package script
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Signature checker that accepts signatures equal to "signed by " + the public key
+type fakeChecker struct{}
+
+func (fakeChecker) CheckSig(signature []byte, publicKey []byte) bool {
+	return bytes.Equal(signature, append([]byte("signed by "), publicKey...))
+}
+
+// Checker for a transaction locked until lockTime (signatures as in fakeChecker)
+type fakeLockTimeChecker struct {
+	fakeChecker
+	lockTime int
+}
+
+func (c fakeLockTimeChecker) CheckLockTime(lockTime int) bool {
+	return lockTime <= c.lockTime
+}
+
+// Parse the text form of a script, failing the test if it is invalid
+func mustParse(t *testing.T, text string) Script {
+	t.Helper()
+	s, err := Parse(text)
+	if err != nil {
+		t.Fatalf("Could not parse %q: %v", text, err)
+	}
+	return s
+}
+
+func TestVerify(t *testing.T) {
+	key := []byte("key")
+	sig := append([]byte("signed by "), key...)
+	type test struct {
+		name      string
+		unlocking Script
+		locking   string
+		expected  error
+	}
+	tests := []test{
+		{"True should unlock", Script{}, "OP_1", nil},
+		{"Any non-zero data should be true", Script{}.AddData([]byte{0, 0, 3}), "", nil},
+		{"Empty stack should fail", Script{}, "", ErrScriptFailed},
+		{"False should fail", Script{}, "OP_0", ErrScriptFailed},
+		{"Zero bytes should be false", Script{}.AddData([]byte{0, 0}), "", ErrScriptFailed},
+		{"Negative zero should be false", Script{}.AddData([]byte{0, 0x80}), "", ErrScriptFailed},
+		{"0x80 before the end should be true", Script{}.AddData([]byte{0x80, 0}), "", nil},
+		{"Only the top item should count", Script{}.AddOp(Op0), "OP_1", nil},
+		{"OP_EQUAL should compare the top two items", Script{}.AddData([]byte{5}), "05 OP_EQUAL", nil},
+		{"OP_EQUAL should push false for different items", Script{}.AddData([]byte{5}), "06 OP_EQUAL", ErrScriptFailed},
+		{"OP_EQUALVERIFY should fail for different items", Script{}.AddData([]byte{5}), "06 OP_EQUALVERIFY OP_1", ErrVerifyFailed},
+		{"OP_EQUALVERIFY should not leave a result", Script{}.AddData([]byte{5}), "05 OP_EQUALVERIFY", ErrScriptFailed},
+		{"OP_VERIFY should fail on false", Script{}.AddOp(Op0), "OP_VERIFY OP_1", ErrVerifyFailed},
+		{"OP_VERIFY should pop true", Script{}.AddOp(Op1), "OP_VERIFY", ErrScriptFailed},
+		{"OP_DUP should copy the top item", Script{}.AddData([]byte{9}), "OP_DUP OP_EQUAL", nil},
+		{"OP_DROP should remove the top item", Script{}.AddOp(Op1).AddOp(Op0), "OP_DROP", nil},
+		{"OP_SWAP should swap the top two items", Script{}.AddOp(Op1).AddOp(Op0), "OP_SWAP", nil},
+		{"OP_SWAP should keep both items", Script{}.AddOp(Op1).AddOp(Op1 + 1), "OP_SWAP OP_1 OP_EQUALVERIFY 02 OP_EQUAL", nil},
+		{"OP_NOP should do nothing", Script{}.AddOp(Op1), "OP_NOP", nil},
+		{"OP_SHA256 should hash the top item", Script{}.AddData([]byte("abc")),
+			"OP_SHA256 ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad OP_EQUAL", nil},
+		{"OP_RETURN should fail", Script{}.AddOp(Op1), "OP_RETURN", ErrReturn},
+		{"OP_CHECKSIG should accept a valid signature", Script{}.AddData(sig).AddData(key), "OP_CHECKSIG", nil},
+		{"OP_CHECKSIG should push false for an invalid signature", Script{}.AddData(key).AddData(key), "OP_CHECKSIG", ErrScriptFailed},
+		{"OP_CHECKSIGVERIFY should fail for an invalid signature", Script{}.AddData(key).AddData(key), "OP_CHECKSIGVERIFY OP_1", ErrVerifyFailed},
+		{"OP_CHECKSIGVERIFY should not leave a result", Script{}.AddData(sig).AddData(key), "OP_CHECKSIGVERIFY", ErrScriptFailed},
+		{"Opcodes should fail on an empty stack", Script{}, "OP_DUP", ErrStackUnderflow},
+		{"Two item opcodes should fail with one item", Script{}.AddOp(Op1), "OP_EQUAL", ErrStackUnderflow},
+		{"OP_CHECKSIG should need two items", Script{}.AddData(sig), "OP_CHECKSIG", ErrStackUnderflow},
+		{"Unlocking scripts should only push", Script{}.AddOp(Op1).AddOp(OpDup), "OP_EQUAL", ErrNotPushOnly},
+		{"Invalid unlocking scripts should fail", Script{0x02, 0x01}, "OP_1", ErrMalformedPush},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := Verify(tc.unlocking, mustParse(t, tc.locking), fakeChecker{}); err != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+	t.Run("Invalid locking scripts should fail", func(t *testing.T) {
+		locking := Script{byte(OpNop), 0xff}
+		if err := Verify(Script{}.AddOp(Op1), locking, fakeChecker{}); err != ErrUnknownOpcode {
+			t.Errorf("Expected %v, got %v", ErrUnknownOpcode, err)
+		}
+	})
+	t.Run("Signatures should be invalid without a checker", func(t *testing.T) {
+		if err := Verify(Script{}.AddData(sig).AddData(key), mustParse(t, "OP_CHECKSIG"), nil); err != ErrScriptFailed {
+			t.Errorf("Expected %v, got %v", ErrScriptFailed, err)
+		}
+	})
+}
+
+func TestConditionals(t *testing.T) {
+	// pushes 2 if the top item is true and 3 otherwise
+	branch := "OP_IF 02 OP_ELSE 03 OP_ENDIF"
+	type test struct {
+		name      string
+		unlocking Script
+		locking   string
+		expected  error
+	}
+	tests := []test{
+		{"OP_IF should run its first branch for true", Script{}.AddOp(Op1), branch + " 02 OP_EQUAL", nil},
+		{"OP_IF should run its OP_ELSE branch for false", Script{}.AddOp(Op0), branch + " 03 OP_EQUAL", nil},
+		{"OP_NOTIF should run its first branch for false", Script{}.AddOp(Op0), "OP_NOTIF 02 OP_ELSE 03 OP_ENDIF 02 OP_EQUAL", nil},
+		{"OP_IF without OP_ELSE should skip for false", Script{}.AddOp(Op1).AddOp(Op0), "OP_IF OP_RETURN OP_ENDIF", nil},
+		{"Skipped branches should not run OP_RETURN", Script{}.AddOp(Op0), "OP_IF OP_RETURN OP_ELSE OP_1 OP_ENDIF", nil},
+		{"Skipped branches should not touch the stack", Script{}.AddOp(Op0), "OP_IF OP_DROP OP_DROP OP_ENDIF OP_1", nil},
+		{"Nested OP_IFs should run in a running branch", Script{}.AddOp(Op0).AddOp(Op1),
+			"OP_IF OP_IF 02 OP_ELSE 03 OP_ENDIF OP_ENDIF 03 OP_EQUAL", nil},
+		{"Nested OP_IFs should not pop in a skipped branch", Script{}.AddOp(Op1).AddOp(Op0),
+			"OP_IF OP_IF OP_RETURN OP_ELSE OP_RETURN OP_ENDIF OP_ENDIF", nil},
+		{"OP_ELSE should toggle more than once", Script{}.AddOp(Op1),
+			"OP_IF 02 OP_ELSE OP_RETURN OP_ELSE 02 OP_EQUALVERIFY OP_ENDIF OP_1", nil},
+		{"OP_IF should need an item", Script{}, "OP_IF OP_ENDIF", ErrStackUnderflow},
+		{"OP_IF without OP_ENDIF should fail", Script{}.AddOp(Op1), "OP_IF OP_1", ErrUnbalancedIf},
+		{"OP_ELSE without OP_IF should fail", Script{}.AddOp(Op1), "OP_ELSE", ErrUnbalancedIf},
+		{"OP_ENDIF without OP_IF should fail", Script{}.AddOp(Op1), "OP_ENDIF", ErrUnbalancedIf},
+		{"OP_IF should not be closed by the other script", Script{}, "OP_1 OP_IF OP_1", ErrUnbalancedIf},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := Verify(tc.unlocking, mustParse(t, tc.locking), fakeChecker{}); err != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	t.Run("Scripts should run at most the maximum number of opcodes", func(t *testing.T) {
+		nops := Script(bytes.Repeat([]byte{byte(OpNop)}, MaxOps))
+		if err := Verify(Script{}.AddOp(Op1), nops, nil); err != nil {
+			t.Errorf("Expected the maximum number of opcodes to run, got %v", err)
+		}
+		if err := Verify(Script{}.AddOp(Op1), nops.AddOp(OpNop), nil); err != ErrTooManyOps {
+			t.Errorf("Expected %v, got %v", ErrTooManyOps, err)
+		}
+	})
+	t.Run("Skipped opcodes should count toward the maximum", func(t *testing.T) {
+		skipped := append(Script{}.AddOp(Op0).AddOp(OpIf), bytes.Repeat([]byte{byte(OpNop)}, MaxOps-1)...)
+		skipped = skipped.AddOp(OpEndIf).AddOp(Op1) // OP_IF, the skipped OP_NOPs and OP_ENDIF
+		if err := Verify(Script{}, skipped, nil); err != ErrTooManyOps {
+			t.Errorf("Expected %v, got %v", ErrTooManyOps, err)
+		}
+	})
+	t.Run("Pushes should not count toward the maximum", func(t *testing.T) {
+		pushes := Script(bytes.Repeat([]byte{byte(Op1)}, MaxOps+1))
+		nops := Script(bytes.Repeat([]byte{byte(OpNop)}, MaxOps))
+		if err := Verify(Script{}, append(pushes, nops...), nil); err != nil {
+			t.Errorf("Expected %v, got %v", nil, err)
+		}
+	})
+	t.Run("The stack should hold at most the maximum number of items", func(t *testing.T) {
+		unlocking := Script(bytes.Repeat([]byte{byte(Op1)}, MaxStackSize))
+		if err := Verify(unlocking, Script{}, nil); err != nil {
+			t.Errorf("Expected a full stack to be fine, got %v", err)
+		}
+		if err := Verify(unlocking, Script{}.AddOp(OpDup), nil); err != ErrStackOverflow {
+			t.Errorf("Expected %v, got %v", ErrStackOverflow, err)
+		}
+		if err := Verify(unlocking.AddOp(Op1), Script{}, nil); err != ErrStackOverflow {
+			t.Errorf("Expected %v, got %v", ErrStackOverflow, err)
+		}
+	})
+	t.Run("Running a script should always give the same result", func(t *testing.T) {
+		unlocking := Script{}.AddData([]byte("abc"))
+		locking := mustParse(t, "OP_DUP OP_SHA256 OP_SWAP OP_DROP OP_SHA256 OP_DUP OP_EQUAL")
+		for i := 0; i < 10; i++ {
+			if err := Verify(unlocking, locking, nil); err != nil {
+				t.Fatalf("Run %d: expected %v, got %v", i, nil, err)
+			}
+		}
+	})
+}
+
+func TestCheckMultiSig(t *testing.T) {
+	keys := [][]byte{[]byte("key a"), []byte("key b"), []byte("key c")}
+	sig := func(key []byte) []byte {
+		return append([]byte("signed by "), key...)
+	}
+	twoOfThree := NewMultisig(2, keys)
+	type test struct {
+		name      string
+		unlocking Script
+		locking   Script
+		expected  error
+	}
+	tests := []test{
+		{"Signatures by enough keys should unlock", NewMultisigUnlock([][]byte{sig(keys[0]), sig(keys[2])}), twoOfThree, nil},
+		{"Any of the keys should do", NewMultisigUnlock([][]byte{sig(keys[1]), sig(keys[2])}), twoOfThree, nil},
+		{"Signatures should be in the order of the keys", NewMultisigUnlock([][]byte{sig(keys[2]), sig(keys[0])}), twoOfThree, ErrScriptFailed},
+		{"A key should not sign twice", NewMultisigUnlock([][]byte{sig(keys[0]), sig(keys[0])}), twoOfThree, ErrScriptFailed},
+		{"Every signature should be valid", NewMultisigUnlock([][]byte{sig(keys[0]), []byte("forged")}), twoOfThree, ErrScriptFailed},
+		{"Not enough signatures should fail", NewMultisigUnlock([][]byte{sig(keys[0])}), twoOfThree, ErrStackUnderflow},
+		{"1-of-1 should work like OP_CHECKSIG", NewMultisigUnlock([][]byte{sig(keys[1])}), NewMultisig(1, keys[1:2]), nil},
+		{"3-of-3 should need every key", NewMultisigUnlock([][]byte{sig(keys[0]), sig(keys[1]), sig(keys[2])}), NewMultisig(3, keys), nil},
+		{"OP_CHECKMULTISIGVERIFY should fail for invalid signatures",
+			NewMultisigUnlock([][]byte{sig(keys[2]), sig(keys[0])}), NewMultisig(2, keys)[:len(twoOfThree)-1].AddOp(OpCheckMultiSigVerify).AddOp(Op1), ErrVerifyFailed},
+		{"OP_CHECKMULTISIGVERIFY should not leave a result",
+			NewMultisigUnlock([][]byte{sig(keys[0]), sig(keys[1])}), NewMultisig(2, keys)[:len(twoOfThree)-1].AddOp(OpCheckMultiSigVerify), ErrScriptFailed},
+		{"More signatures than keys should be invalid", NewMultisigUnlock([][]byte{sig(keys[0]), sig(keys[1])}), NewMultisig(2, keys[:1]), ErrInvalidMultisig},
+		{"Zero signatures should be invalid", Script{}, NewMultisig(0, keys), ErrInvalidMultisig},
+		{"Zero keys should be invalid", Script{}.AddOp(Op1), Script{}.AddOp(Op0).AddOp(OpCheckMultiSig), ErrInvalidMultisig},
+		{"Counts should be numbers", NewMultisigUnlock([][]byte{sig(keys[0])}),
+			Script{}.AddData([]byte{1, 0}).AddData(keys[0]).AddOp(Op1).AddOp(OpCheckMultiSig), ErrInvalidNumber},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := Verify(tc.unlocking, tc.locking, fakeChecker{}); err != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+	t.Run("At most the maximum number of keys should be checked", func(t *testing.T) {
+		manyKeys := [][]byte{}
+		for i := 0; i <= MaxMultisigKeys; i++ {
+			manyKeys = append(manyKeys, []byte{byte(i)})
+		}
+		unlocking := NewMultisigUnlock([][]byte{sig(manyKeys[0])})
+		if err := Verify(unlocking, NewMultisig(1, manyKeys[:MaxMultisigKeys]), fakeChecker{}); err != nil {
+			t.Errorf("Expected the maximum number of keys to be fine, got %v", err)
+		}
+		if err := Verify(unlocking, NewMultisig(1, manyKeys), fakeChecker{}); err != ErrInvalidMultisig {
+			t.Errorf("Expected %v, got %v", ErrInvalidMultisig, err)
+		}
+	})
+	t.Run("Every key should count toward the maximum number of opcodes", func(t *testing.T) {
+		nops := Script(bytes.Repeat([]byte{byte(OpNop)}, MaxOps-len(keys)))
+		unlocking := NewMultisigUnlock([][]byte{sig(keys[0]), sig(keys[1])})
+		if err := Verify(unlocking, append(nops, twoOfThree...), fakeChecker{}); err != ErrTooManyOps {
+			t.Errorf("Expected %v, got %v", ErrTooManyOps, err)
+		}
+		if err := Verify(unlocking, append(nops[1:], twoOfThree...), fakeChecker{}); err != nil {
+			t.Errorf("Expected %v, got %v", nil, err)
+		}
+	})
+}
+
+func TestCheckLockTimeVerify(t *testing.T) {
+	checker := fakeLockTimeChecker{lockTime: 300}
+	type test struct {
+		name     string
+		locking  Script
+		expected error
+	}
+	tests := []test{
+		{"Lock times before the transaction's should pass", Script{}.AddInt(299).AddOp(OpCheckLockTimeVerify), nil},
+		{"The transaction's lock time should pass", Script{}.AddInt(300).AddOp(OpCheckLockTimeVerify), nil},
+		{"Lock times after the transaction's should fail", Script{}.AddInt(301).AddOp(OpCheckLockTimeVerify), ErrLockTime},
+		{"Negative lock times should fail", Script{}.AddInt(-1).AddOp(OpCheckLockTimeVerify), ErrLockTime},
+		{"The lock time should stay on the stack", Script{}.AddInt(5).AddOp(OpCheckLockTimeVerify).AddInt(5).AddOp(OpEqual), nil},
+		{"Lock times should be numbers", Script{}.AddData([]byte{5, 0}).AddOp(OpCheckLockTimeVerify), ErrInvalidNumber},
+		{"Lock times should be at most 5 bytes", Script{}.AddData([]byte{1, 0, 0, 0, 0, 1}).AddOp(OpCheckLockTimeVerify), ErrInvalidNumber},
+		{"OP_CHECKLOCKTIMEVERIFY should need an item", Script{}.AddOp(OpCheckLockTimeVerify), ErrStackUnderflow},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := Verify(Script{}, tc.locking, checker); err != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+	t.Run("Lock times of 5 bytes should be allowed", func(t *testing.T) {
+		locking := Script{}.AddInt(1 << 32).AddOp(OpCheckLockTimeVerify)
+		if err := Verify(Script{}, locking, fakeLockTimeChecker{lockTime: 1 << 32}); err != nil {
+			t.Errorf("Expected %v, got %v", nil, err)
+		}
+	})
+	t.Run("Lock times should fail without a lock time checker", func(t *testing.T) {
+		locking := Script{}.AddInt(1).AddOp(OpCheckLockTimeVerify)
+		if err := Verify(Script{}, locking, fakeChecker{}); err != ErrLockTime {
+			t.Errorf("Expected %v, got %v", ErrLockTime, err)
+		}
+	})
+}
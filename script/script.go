@@ -0,0 +1,336 @@
+package script
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// How scripts work:
+// Every transaction output is locked by a script, and the input spending it gives another
+// script to unlock it. The unlocking script runs first and leaves data on a stack (e.g., a
+// signature), then the locking script runs on the same stack (e.g., checking the signature
+// against a public key). The output can be spent if a true value is on top of the stack at
+// the end, and no opcode failed on the way.
+//
+// A script is a list of opcodes, some of which are followed by data to push on the stack.
+// There are no loops or jumps, so every opcode runs at most once, and limits on the size of
+// scripts, data, the stack and the number of opcodes bound the work a script can make a node
+// do. Running a script only depends on the scripts and the transaction being spent from, so
+// every node gets the same result. See SCRIPT.md for the opcodes and the standard scripts.
+
+// Serialized script (opcodes and the data they push)
+type Script []byte
+
+// Operation in a script
+type Opcode byte
+
+const (
+	Op0                   Opcode = 0x00 // push an empty array (false)
+	OpPushData1           Opcode = 0x4c // push data whose length is in the next byte
+	OpPushData2           Opcode = 0x4d // push data whose length is in the next 2 bytes (little-endian)
+	Op1                   Opcode = 0x51 // push the number 1 (Op2 to Op16 push 2 to 16)
+	Op16                  Opcode = 0x60
+	OpNop                 Opcode = 0x61
+	OpIf                  Opcode = 0x63
+	OpNotIf               Opcode = 0x64
+	OpElse                Opcode = 0x67
+	OpEndIf               Opcode = 0x68
+	OpVerify              Opcode = 0x69
+	OpReturn              Opcode = 0x6a
+	OpDrop                Opcode = 0x75
+	OpDup                 Opcode = 0x76
+	OpSwap                Opcode = 0x7c
+	OpEqual               Opcode = 0x87
+	OpEqualVerify         Opcode = 0x88
+	OpSHA256              Opcode = 0xa8
+	OpCheckSig            Opcode = 0xac
+	OpCheckSigVerify      Opcode = 0xad
+	OpCheckMultiSig       Opcode = 0xae
+	OpCheckMultiSigVerify Opcode = 0xaf
+	OpCheckLockTimeVerify Opcode = 0xb1 // fail unless the transaction is locked until at least the top item
+)
+
+// Limits that bound the work of running a script
+const (
+	MaxScriptSize   int = 10000 // bytes in a script
+	MaxElementSize  int = 520   // bytes pushed at once
+	MaxStackSize    int = 1000  // items on the stack
+	MaxOps          int = 201   // opcodes run other than pushes, across both scripts
+	MaxMultisigKeys int = 16    // public keys checked by OP_CHECKMULTISIG
+	maxNumSize      int = 4     // bytes of a number used by an opcode
+	maxLockTimeSize int = 5     // bytes of a lock time (unix times need more than maxNumSize)
+
+	maxDirectPush Opcode = 0x4b // opcodes up to this one push that many bytes
+)
+
+// Names of the opcodes in the text form of a script (pushes are written as their data in hex)
+var opNames = map[Opcode]string{
+	Op0:                   "OP_0",
+	OpNop:                 "OP_NOP",
+	OpIf:                  "OP_IF",
+	OpNotIf:               "OP_NOTIF",
+	OpElse:                "OP_ELSE",
+	OpEndIf:               "OP_ENDIF",
+	OpVerify:              "OP_VERIFY",
+	OpReturn:              "OP_RETURN",
+	OpDrop:                "OP_DROP",
+	OpDup:                 "OP_DUP",
+	OpSwap:                "OP_SWAP",
+	OpEqual:               "OP_EQUAL",
+	OpEqualVerify:         "OP_EQUALVERIFY",
+	OpSHA256:              "OP_SHA256",
+	OpCheckSig:            "OP_CHECKSIG",
+	OpCheckSigVerify:      "OP_CHECKSIGVERIFY",
+	OpCheckMultiSig:       "OP_CHECKMULTISIG",
+	OpCheckMultiSigVerify: "OP_CHECKMULTISIGVERIFY",
+	OpCheckLockTimeVerify: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+// Opcode and data of one step of a script
+type instruction struct {
+	op   Opcode
+	data []byte // pushed data (nil for other opcodes)
+}
+
+// Reasons for a script to be invalid or to fail
+var (
+	ErrScriptTooLarge    error = errors.New("script is larger than the maximum script size")
+	ErrMalformedPush     error = errors.New("script ends in the middle of pushed data")
+	ErrElementTooLarge   error = errors.New("script pushes more than the maximum element size")
+	ErrUnknownOpcode     error = errors.New("script has an unknown opcode")
+	ErrTooManyOps        error = errors.New("script runs more than the maximum number of opcodes")
+	ErrStackOverflow     error = errors.New("stack has more than the maximum number of items")
+	ErrStackUnderflow    error = errors.New("opcode needs more items than are on the stack")
+	ErrUnbalancedIf      error = errors.New("script has an OP_ELSE or OP_ENDIF without an OP_IF, or an OP_IF without an OP_ENDIF")
+	ErrVerifyFailed      error = errors.New("script failed a verify opcode")
+	ErrReturn            error = errors.New("script ran OP_RETURN")
+	ErrNotPushOnly       error = errors.New("unlocking script can only push data")
+	ErrScriptFailed      error = errors.New("script did not end with true on top of the stack")
+	ErrInvalidScriptText error = errors.New("script text has something that is not an opcode name or hex data")
+	ErrInvalidNumber     error = errors.New("number is too large or not in its shortest encoding")
+	ErrInvalidMultisig   error = errors.New("OP_CHECKMULTISIG needs 1 <= signatures <= keys <= 16")
+	ErrLockTime          error = errors.New("transaction is not locked until the lock time the script needs")
+)
+
+// NON-MUTATING FUNCTIONS
+// Name of an opcode (e.g., "OP_DUP")
+func (op Opcode) String() string {
+	if op >= Op1 && op <= Op16 {
+		return "OP_" + strconv.Itoa(int(op-Op1)+1)
+	}
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return "OP_UNKNOWN_" + hex.EncodeToString([]byte{byte(op)})
+}
+
+// Checks if an opcode only pushes data on the stack
+func (op Opcode) isPush() bool {
+	return op <= OpPushData2 || (op >= Op1 && op <= Op16)
+}
+
+// Read the instruction at position pc of a script, and the position of the next one
+func (s Script) instructionAt(pc int) (instruction, int, error) {
+	op := Opcode(s[pc])
+	pc++
+	size := 0
+	switch {
+	case op == Op0:
+		return instruction{op: op, data: []byte{}}, pc, nil
+	case op <= maxDirectPush:
+		size = int(op)
+	case op == OpPushData1:
+		if pc+1 > len(s) {
+			return instruction{}, 0, ErrMalformedPush
+		}
+		size = int(s[pc])
+		pc++
+	case op == OpPushData2:
+		if pc+2 > len(s) {
+			return instruction{}, 0, ErrMalformedPush
+		}
+		size = int(binary.LittleEndian.Uint16(s[pc:]))
+		pc += 2
+	default:
+		if !op.isPush() {
+			if _, ok := opNames[op]; !ok {
+				return instruction{}, 0, ErrUnknownOpcode
+			}
+		}
+		return instruction{op: op}, pc, nil
+	}
+	if size > MaxElementSize {
+		return instruction{}, 0, ErrElementTooLarge
+	}
+	if pc+size > len(s) {
+		return instruction{}, 0, ErrMalformedPush
+	}
+	return instruction{op: op, data: s[pc : pc+size]}, pc + size, nil
+}
+
+// Split a script into its instructions, checking that every one of them is valid
+func (s Script) instructions() ([]instruction, error) {
+	if len(s) > MaxScriptSize {
+		return nil, ErrScriptTooLarge
+	}
+	instructions := []instruction{}
+	for pc := 0; pc < len(s); {
+		inst, next, err := s.instructionAt(pc)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, inst)
+		pc = next
+	}
+	return instructions, nil
+}
+
+// Check that a script can be read (it can still fail when run)
+func (s Script) Validate() error {
+	_, err := s.instructions()
+	return err
+}
+
+// Checks if a script is valid and only pushes data (as unlocking scripts must)
+func (s Script) IsPushOnly() bool {
+	instructions, err := s.instructions()
+	if err != nil {
+		return false
+	}
+	for _, inst := range instructions {
+		if !inst.op.isPush() {
+			return false
+		}
+	}
+	return true
+}
+
+// Text form of a script, e.g., "OP_DUP OP_SHA256 <hash in hex> OP_EQUALVERIFY OP_CHECKSIG".
+// A script that cannot be read ends with "[error]" after its valid instructions.
+func (s Script) String() string {
+	words := []string{}
+	for pc := 0; pc < len(s); {
+		inst, next, err := s.instructionAt(pc)
+		if err != nil {
+			words = append(words, "[error]")
+			break
+		}
+		if inst.data != nil && inst.op != Op0 {
+			words = append(words, hex.EncodeToString(inst.data))
+		} else {
+			words = append(words, inst.op.String())
+		}
+		pc = next
+	}
+	return strings.Join(words, " ")
+}
+
+// Get a script from its text form (see String())
+func Parse(text string) (Script, error) {
+	names := make(map[string]Opcode)
+	for op := Op1; op <= Op16; op++ {
+		names[op.String()] = op
+	}
+	for op, name := range opNames {
+		names[name] = op
+	}
+	s := Script{}
+	for _, word := range strings.Fields(text) {
+		if op, ok := names[word]; ok {
+			s = s.AddOp(op)
+			continue
+		}
+		data, err := hex.DecodeString(word)
+		if err != nil || len(data) == 0 {
+			return nil, ErrInvalidScriptText
+		}
+		s = s.AddData(data)
+	}
+	return s, s.Validate()
+}
+
+// Script with an opcode added to the end (use AddData() for pushes)
+func (s Script) AddOp(op Opcode) Script {
+	return append(append(Script{}, s...), byte(op))
+}
+
+// Script with a number added to the end (OP_0 to OP_16 for small numbers, see encodeNum())
+func (s Script) AddInt(n int) Script {
+	switch {
+	case n == 0:
+		return s.AddOp(Op0)
+	case n >= 1 && n <= 16:
+		return s.AddOp(Op1 + Opcode(n-1))
+	}
+	return s.AddData(encodeNum(n))
+}
+
+// Encode a number as pushed on the stack: little-endian, in as few bytes as possible, with the
+// highest bit of the last byte as the sign (e.g., 255 is ff00 and -1 is 81)
+func encodeNum(n int) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+	negative := n < 0
+	abs := uint64(n)
+	if negative {
+		abs = uint64(-n)
+	}
+	data := []byte{}
+	for abs > 0 {
+		data = append(data, byte(abs&0xff))
+		abs >>= 8
+	}
+	if data[len(data)-1]&0x80 != 0 { // highest bit is taken, so the sign needs a byte of its own
+		data = append(data, 0)
+	}
+	if negative {
+		data[len(data)-1] |= 0x80
+	}
+	return data
+}
+
+// Decode a number (see encodeNum()) of at most maxSize bytes, which must be in its shortest encoding
+func decodeNum(data []byte, maxSize int) (int, error) {
+	if len(data) > maxSize {
+		return 0, ErrInvalidNumber
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	last := data[len(data)-1]
+	// a last byte of only the sign is only needed if the byte before uses its highest bit
+	if last&0x7f == 0 && (len(data) == 1 || data[len(data)-2]&0x80 == 0) {
+		return 0, ErrInvalidNumber
+	}
+	n := int(last & 0x7f)
+	for i := len(data) - 2; i >= 0; i-- {
+		n = n<<8 | int(data[i])
+	}
+	if last&0x80 != 0 {
+		return -n, nil
+	}
+	return n, nil
+}
+
+// Script with data added to the end, pushed with the smallest push opcode for its size
+// (data must be at most MaxElementSize bytes to be valid)
+func (s Script) AddData(data []byte) Script {
+	s = append(Script{}, s...)
+	switch {
+	case len(data) == 0:
+		return append(s, byte(Op0))
+	case len(data) <= int(maxDirectPush):
+		s = append(s, byte(len(data)))
+	case len(data) <= 0xff:
+		s = append(s, byte(OpPushData1), byte(len(data)))
+	default:
+		var size [2]byte
+		binary.LittleEndian.PutUint16(size[:], uint16(len(data)))
+		s = append(append(s, byte(OpPushData2)), size[:]...)
+	}
+	return append(s, data...)
+}
@@ -0,0 +1,191 @@
+package script
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestAddData(t *testing.T) {
+	type test struct {
+		name   string
+		size   int
+		prefix string // bytes before the data
+	}
+	tests := []test{
+		{"Empty data should be OP_0", 0, "00"},
+		{"Small data should use a direct push", 1, "01"},
+		{"Data up to 75 bytes should use a direct push", 75, "4b"},
+		{"Data from 76 bytes should use OP_PUSHDATA1", 76, "4c4c"},
+		{"Data up to 255 bytes should use OP_PUSHDATA1", 255, "4cff"},
+		{"Data from 256 bytes should use OP_PUSHDATA2", 256, "4d0001"},
+		{"Data of the maximum element size should use OP_PUSHDATA2", MaxElementSize, "4d0802"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte{7}, tc.size)
+			s := Script{}.AddData(data)
+			prefix, _ := hex.DecodeString(tc.prefix)
+			if !bytes.Equal(s, append(prefix, data...)) {
+				t.Errorf("Expected prefix %s, got %x", tc.prefix, s[:len(prefix)])
+			}
+			instructions, err := s.instructions()
+			if err != nil || len(instructions) != 1 || !bytes.Equal(instructions[0].data, data) {
+				t.Errorf("Expected to read back the data, got %v (%v)", instructions, err)
+			}
+		})
+	}
+	t.Run("Adding should not change the original script", func(t *testing.T) {
+		s := make(Script, 1, 10)
+		s.AddData([]byte{1})
+		s.AddOp(OpDup)
+		if extended := s[:2]; extended[1] != 0 {
+			t.Error("Expected the original script to be left alone")
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	type test struct {
+		name     string
+		script   string // hex
+		expected error
+	}
+	tests := []test{
+		{"Empty script should be valid", "", nil},
+		{"Known opcodes should be valid", "76a8876951", nil},
+		{"Pushes should be valid", "0201024c020304", nil},
+		{"Direct push should not go past the end", "03aabb", ErrMalformedPush},
+		{"OP_PUSHDATA1 should need a length", "4c", ErrMalformedPush},
+		{"OP_PUSHDATA1 should not go past the end", "4c03aabb", ErrMalformedPush},
+		{"OP_PUSHDATA2 should need a 2 byte length", "4d01", ErrMalformedPush},
+		{"OP_PUSHDATA2 should not go past the end", "4d0300aabb", ErrMalformedPush},
+		{"Pushes should be at most the maximum element size", "4d0902" + hex.EncodeToString(make([]byte, MaxElementSize+1)), ErrElementTooLarge},
+		{"Unknown opcodes should be invalid", "76ff", ErrUnknownOpcode},
+		{"OP_PUSHDATA4 should be invalid", "4e01000000aa", ErrUnknownOpcode},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := hex.DecodeString(tc.script)
+			if err := Script(s).Validate(); err != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+	t.Run("Scripts should be at most the maximum script size", func(t *testing.T) {
+		s := Script(bytes.Repeat([]byte{byte(OpNop)}, MaxScriptSize+1))
+		if err := s.Validate(); err != ErrScriptTooLarge {
+			t.Errorf("Expected %v, got %v", ErrScriptTooLarge, err)
+		}
+		if err := s[1:].Validate(); err != nil {
+			t.Errorf("Expected a script of the maximum size to be valid, got %v", err)
+		}
+	})
+}
+
+func TestIsPushOnly(t *testing.T) {
+	type test struct {
+		name     string
+		script   Script
+		expected bool
+	}
+	tests := []test{
+		{"Empty script should be push only", Script{}, true},
+		{"Data and numbers should be push only", Script{}.AddData([]byte{1}).AddOp(Op0).AddOp(Op16), true},
+		{"Other opcodes should not be push only", Script{}.AddData([]byte{1}).AddOp(OpDup), false},
+		{"OP_NOP should not be push only", Script{}.AddOp(OpNop), false},
+		{"Invalid scripts should not be push only", Script{0x02, 0x01}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if pushOnly := tc.script.IsPushOnly(); pushOnly != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, pushOnly)
+			}
+		})
+	}
+}
+
+func TestScriptText(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, HashSize)
+	type test struct {
+		name   string
+		script Script
+		text   string
+	}
+	tests := []test{
+		{"Pay-to-pubkey-hash", NewPayToPubKeyHash(hash),
+			"OP_DUP OP_SHA256 " + hex.EncodeToString(hash) + " OP_EQUALVERIFY OP_CHECKSIG"},
+		{"Numbers and OP_0", Script{}.AddOp(Op0).AddOp(Op1).AddOp(Op1 + 9).AddOp(Op16), "OP_0 OP_1 OP_10 OP_16"},
+		{"Branches", Script{}.AddOp(OpIf).AddData([]byte{1, 2}).AddOp(OpElse).AddOp(OpReturn).AddOp(OpEndIf),
+			"OP_IF 0102 OP_ELSE OP_RETURN OP_ENDIF"},
+		{"Large pushes", Script{}.AddData(make([]byte, 300)), hex.EncodeToString(make([]byte, 300))},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if text := tc.script.String(); text != tc.text {
+				t.Errorf("Expected text %q, got %q", tc.text, text)
+			}
+			parsed, err := Parse(tc.text)
+			if err != nil || !bytes.Equal(parsed, tc.script) {
+				t.Errorf("Expected to parse back %x, got %x (%v)", []byte(tc.script), []byte(parsed), err)
+			}
+		})
+	}
+	t.Run("Invalid scripts should end with an error", func(t *testing.T) {
+		if text := (Script{byte(OpDup), 0x05, 0x01}).String(); text != "OP_DUP [error]" {
+			t.Errorf("Expected %q, got %q", "OP_DUP [error]", text)
+		}
+	})
+	t.Run("Parsing should reject unknown words", func(t *testing.T) {
+		for _, text := range []string{"OP_DUP OP_FOO", "OP_DUP xyz", "abc"} {
+			if _, err := Parse(text); err != ErrInvalidScriptText {
+				t.Errorf("Parsing %q: expected %v, got %v", text, ErrInvalidScriptText, err)
+			}
+		}
+	})
+	t.Run("Parsing should reject data over the maximum element size", func(t *testing.T) {
+		if _, err := Parse(hex.EncodeToString(make([]byte, MaxElementSize+1))); err != ErrElementTooLarge {
+			t.Errorf("Expected %v, got %v", ErrElementTooLarge, err)
+		}
+	})
+}
+
+func TestNumbers(t *testing.T) {
+	type test struct {
+		n        int
+		encoding string
+	}
+	tests := []test{{0, ""}, {1, "01"}, {-1, "81"}, {127, "7f"}, {128, "8000"}, {-128, "8080"},
+		{255, "ff00"}, {256, "0001"}, {-255, "ff80"}, {32767, "ff7f"}, {500000, "20a107"}}
+	for _, tc := range tests {
+		if encoding := hex.EncodeToString(encodeNum(tc.n)); encoding != tc.encoding {
+			t.Errorf("Encoding %d: expected %q, got %q", tc.n, tc.encoding, encoding)
+		}
+		data, _ := hex.DecodeString(tc.encoding)
+		if n, err := decodeNum(data, maxNumSize); err != nil || n != tc.n {
+			t.Errorf("Decoding %q: expected %d, got %d (%v)", tc.encoding, tc.n, n, err)
+		}
+	}
+	t.Run("Numbers should be in their shortest encoding", func(t *testing.T) {
+		for _, encoding := range []string{"00", "80", "0100", "0180", "ff0000"} {
+			data, _ := hex.DecodeString(encoding)
+			if _, err := decodeNum(data, maxNumSize); err != ErrInvalidNumber {
+				t.Errorf("Decoding %q: expected %v, got %v", encoding, ErrInvalidNumber, err)
+			}
+		}
+	})
+	t.Run("Numbers should be at most the maximum size", func(t *testing.T) {
+		if _, err := decodeNum(encodeNum(1<<31), maxNumSize); err != ErrInvalidNumber {
+			t.Errorf("Expected %v, got %v", ErrInvalidNumber, err)
+		}
+		if n, err := decodeNum(encodeNum(1<<31), maxNumSize+1); err != nil || n != 1<<31 {
+			t.Errorf("Expected %d with a larger maximum size, got %d (%v)", 1<<31, n, err)
+		}
+	})
+	t.Run("AddInt() should use OP_0 to OP_16 for small numbers", func(t *testing.T) {
+		s := Script{}.AddInt(0).AddInt(1).AddInt(16).AddInt(17).AddInt(-1)
+		if text := s.String(); text != "OP_0 OP_1 OP_16 11 81" {
+			t.Errorf("Expected %q, got %q", "OP_0 OP_1 OP_16 11 81", text)
+		}
+	})
+}
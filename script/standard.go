@@ -0,0 +1,201 @@
+package script
+
+import "crypto/sha256"
+
+// Standard scripts (see SCRIPT.md), with the unlocking scripts that spend them:
+//   - pay-to-pubkey: <public key> OP_CHECKSIG, unlocked by <signature>. Outputs to an
+//     address (the hex of a public key) are locked by this script.
+//   - pay-to-pubkey-hash: OP_DUP OP_SHA256 <public key hash> OP_EQUALVERIFY OP_CHECKSIG,
+//     unlocked by <signature> <public key>, so the key is only revealed when spending
+//   - hash lock: OP_SHA256 <hash> OP_EQUAL, unlocked by <preimage>. Anyone who sees the
+//     preimage (e.g., in the mempool) can spend it, so it is usually combined with a signature.
+//   - multisig: M <public key 1> ... <public key N> N OP_CHECKMULTISIG, unlocked by M
+//     signatures by different keys, in the same order as the keys
+//   - HTLC (hash time-locked contract): OP_IF OP_SHA256 <hash> OP_EQUALVERIFY <recipient key>
+//     OP_ELSE <lock time> OP_CHECKLOCKTIMEVERIFY OP_DROP <sender key> OP_ENDIF OP_CHECKSIG,
+//     claimed by the recipient with <signature> <preimage> OP_1, or refunded to the sender
+//     from the lock time on with <signature> OP_0
+
+// Kinds of standard scripts
+const (
+	PayToPubKey     string = "pubkey"
+	PayToPubKeyHash string = "pubkeyhash"
+	HashLock        string = "hashlock"
+	Multisig        string = "multisig"
+	HTLC            string = "htlc"
+	NonStandard     string = "nonstandard"
+
+	PubKeySize int = 64 // bytes of a public key (x and y, 32 bytes each)
+	HashSize   int = 32 // bytes of a SHA-256 hash
+)
+
+// NON-MUTATING FUNCTIONS
+// SHA-256 hash of data (e.g., a public key or a preimage)
+func Hash(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// Locking script paying to a public key
+func NewPayToPubKey(publicKey []byte) Script {
+	return Script{}.AddData(publicKey).AddOp(OpCheckSig)
+}
+
+// Locking script paying to the hash of a public key (see Hash())
+func NewPayToPubKeyHash(pubKeyHash []byte) Script {
+	return Script{}.AddOp(OpDup).AddOp(OpSHA256).AddData(pubKeyHash).AddOp(OpEqualVerify).AddOp(OpCheckSig)
+}
+
+// Locking script that anyone knowing a preimage of hash can unlock
+func NewHashLock(hash []byte) Script {
+	return Script{}.AddOp(OpSHA256).AddData(hash).AddOp(OpEqual)
+}
+
+// Unlocking script for pay-to-pubkey
+func NewPayToPubKeyUnlock(signature []byte) Script {
+	return Script{}.AddData(signature)
+}
+
+// Unlocking script for pay-to-pubkey-hash
+func NewPayToPubKeyHashUnlock(signature []byte, publicKey []byte) Script {
+	return Script{}.AddData(signature).AddData(publicKey)
+}
+
+// Unlocking script for a hash lock
+func NewHashLockUnlock(preimage []byte) Script {
+	return Script{}.AddData(preimage)
+}
+
+// Locking script that needs signatures by required of the public keys (at most MaxMultisigKeys)
+func NewMultisig(required int, publicKeys [][]byte) Script {
+	s := Script{}.AddInt(required)
+	for _, publicKey := range publicKeys {
+		s = s.AddData(publicKey)
+	}
+	return s.AddInt(len(publicKeys)).AddOp(OpCheckMultiSig)
+}
+
+// Unlocking script for multisig (signatures in the same order as their keys in the locking script)
+func NewMultisigUnlock(signatures [][]byte) Script {
+	s := Script{}
+	for _, signature := range signatures {
+		s = s.AddData(signature)
+	}
+	return s
+}
+
+// Get the number of signatures needed and the public keys of a standard multisig script
+// (ok is false if it is not one)
+func ParseMultisig(s Script) (required int, publicKeys [][]byte, ok bool) {
+	instructions, err := s.instructions()
+	if err != nil || len(instructions) < 4 {
+		return 0, nil, false
+	}
+	smallInt := func(inst instruction) int { // 0 if not OP_1 to OP_16
+		if inst.op >= Op1 && inst.op <= Op16 {
+			return int(inst.op-Op1) + 1
+		}
+		return 0
+	}
+	last := len(instructions) - 1
+	required, keyCount := smallInt(instructions[0]), smallInt(instructions[last-1])
+	if instructions[last].op != OpCheckMultiSig || required == 0 || required > keyCount || keyCount != last-2 {
+		return 0, nil, false
+	}
+	for _, inst := range instructions[1 : last-1] {
+		if len(inst.data) != PubKeySize {
+			return 0, nil, false
+		}
+		publicKeys = append(publicKeys, inst.data)
+	}
+	return required, publicKeys, true
+}
+
+// Locking script the recipient can claim by revealing a preimage of hash, and the sender can
+// take back once the transaction spending it is locked until lockTime (see NewHTLCRefund())
+func NewHTLC(hash []byte, recipient []byte, lockTime int, sender []byte) Script {
+	return Script{}.AddOp(OpIf).
+		AddOp(OpSHA256).AddData(hash).AddOp(OpEqualVerify).AddData(recipient).
+		AddOp(OpElse).
+		AddInt(lockTime).AddOp(OpCheckLockTimeVerify).AddOp(OpDrop).AddData(sender).
+		AddOp(OpEndIf).AddOp(OpCheckSig)
+}
+
+// Unlocking script for the recipient of an HTLC
+func NewHTLCClaim(signature []byte, preimage []byte) Script {
+	return Script{}.AddData(signature).AddData(preimage).AddOp(Op1)
+}
+
+// Unlocking script for the sender of an HTLC (the transaction must be locked until its lock time)
+func NewHTLCRefund(signature []byte) Script {
+	return Script{}.AddData(signature).AddOp(Op0)
+}
+
+// Get the hash, the keys of the recipient and the sender and the lock time of a standard HTLC
+// (ok is false if it is not one)
+func ParseHTLC(s Script) (hash []byte, recipient []byte, lockTime int, sender []byte, ok bool) {
+	instructions, err := s.instructions()
+	if err != nil || len(instructions) != 12 {
+		return nil, nil, 0, nil, false
+	}
+	if inst := instructions[6]; inst.op >= Op1 && inst.op <= Op16 {
+		lockTime = int(inst.op-Op1) + 1
+	} else {
+		lockTime, err = decodeNum(inst.data, maxLockTimeSize)
+	}
+	template := NewHTLC(make([]byte, HashSize), make([]byte, PubKeySize), lockTime, make([]byte, PubKeySize))
+	if err != nil || lockTime < 1 || !matches(s, template) {
+		return nil, nil, 0, nil, false
+	}
+	return instructions[2].data, instructions[4].data, lockTime, instructions[9].data, true
+}
+
+// Get the preimage revealed by the unlocking script of an HTLC claim (ok is false if it is not one)
+func HTLCPreimage(unlocking Script) (preimage []byte, ok bool) {
+	instructions, err := unlocking.instructions()
+	if err != nil || len(instructions) != 3 || instructions[2].op != Op1 || !instructions[1].op.isPush() {
+		return nil, false
+	}
+	if op := instructions[1].op; op >= Op1 && op <= Op16 { // pushes the number as a single byte
+		return []byte{byte(op-Op1) + 1}, true
+	}
+	return instructions[1].data, true
+}
+
+// Checks if a script has the same opcodes as a template, pushing data of the same size
+// wherever the template pushes data (the template's data itself is ignored)
+func matches(s Script, template Script) bool {
+	instructions, err := s.instructions()
+	if err != nil {
+		return false
+	}
+	expected, _ := template.instructions()
+	if len(instructions) != len(expected) {
+		return false
+	}
+	for i, inst := range instructions {
+		if inst.op != expected[i].op || len(inst.data) != len(expected[i].data) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the kind of a locking script (NonStandard if it is not a standard script)
+func Classify(s Script) string {
+	switch {
+	case matches(s, NewPayToPubKey(make([]byte, PubKeySize))):
+		return PayToPubKey
+	case matches(s, NewPayToPubKeyHash(make([]byte, HashSize))):
+		return PayToPubKeyHash
+	case matches(s, NewHashLock(make([]byte, HashSize))):
+		return HashLock
+	}
+	if _, _, ok := ParseMultisig(s); ok {
+		return Multisig
+	}
+	if _, _, _, _, ok := ParseHTLC(s); ok {
+		return HTLC
+	}
+	return NonStandard
+}
@@ -0,0 +1,202 @@
+package script
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+// Signature checker for a transaction with the given hash and lock time, using ECDSA keys like the wallet
+type ecdsaChecker struct {
+	hash     []byte
+	lockTime int
+}
+
+func (c ecdsaChecker) CheckLockTime(lockTime int) bool {
+	return lockTime <= c.lockTime
+}
+
+func (c ecdsaChecker) CheckSig(signature []byte, publicKey []byte) bool {
+	if len(signature) != 64 || len(publicKey) != PubKeySize {
+		return false
+	}
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(publicKey[:32]),
+		Y:     new(big.Int).SetBytes(publicKey[32:]),
+	}
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	return ecdsa.Verify(key, c.hash, r, s)
+}
+
+// Make a key, returning it with its public key (x and y, 32 bytes each)
+func makeTestKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := make([]byte, PubKeySize)
+	key.X.FillBytes(publicKey[:32])
+	key.Y.FillBytes(publicKey[32:])
+	return key, publicKey
+}
+
+// Sign a hash (r and s, 32 bytes each)
+func signTest(t *testing.T, key *ecdsa.PrivateKey, hash []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature
+}
+
+func TestStandardScripts(t *testing.T) {
+	txHash := sha256.Sum256([]byte("transaction"))
+	checker := ecdsaChecker{txHash[:], 100}
+	key, publicKey := makeTestKey(t)
+	otherKey, otherPublicKey := makeTestKey(t)
+	signature := signTest(t, key, txHash[:])
+	otherSignature := signTest(t, otherKey, txHash[:])
+	preimage := []byte("secret")
+	htlc := NewHTLC(Hash(preimage), publicKey, 100, otherPublicKey) // claimed by key, refunded to otherKey
+	type test struct {
+		name      string
+		unlocking Script
+		locking   Script
+		expected  error
+	}
+	tests := []test{
+		{"Pay-to-pubkey should be unlocked by a signature of the key",
+			NewPayToPubKeyUnlock(signature), NewPayToPubKey(publicKey), nil},
+		{"Pay-to-pubkey should not be unlocked by another key",
+			NewPayToPubKeyUnlock(otherSignature), NewPayToPubKey(publicKey), ErrScriptFailed},
+		{"Pay-to-pubkey should not be unlocked by a signature of another transaction",
+			NewPayToPubKeyUnlock(signTest(t, key, make([]byte, 32))), NewPayToPubKey(publicKey), ErrScriptFailed},
+		{"Pay-to-pubkey-hash should be unlocked by the key and its signature",
+			NewPayToPubKeyHashUnlock(signature, publicKey), NewPayToPubKeyHash(Hash(publicKey)), nil},
+		{"Pay-to-pubkey-hash should not be unlocked by another key",
+			NewPayToPubKeyHashUnlock(otherSignature, otherPublicKey), NewPayToPubKeyHash(Hash(publicKey)), ErrVerifyFailed},
+		{"Pay-to-pubkey-hash should not be unlocked by a signature of another key",
+			NewPayToPubKeyHashUnlock(otherSignature, publicKey), NewPayToPubKeyHash(Hash(publicKey)), ErrScriptFailed},
+		{"Pay-to-pubkey-hash should not be unlocked by a signature alone",
+			NewPayToPubKeyUnlock(signature), NewPayToPubKeyHash(Hash(publicKey)), ErrVerifyFailed},
+		{"Pay-to-pubkey-hash should need two items",
+			Script{}, NewPayToPubKeyHash(Hash(publicKey)), ErrStackUnderflow},
+		{"Hash lock should be unlocked by the preimage",
+			NewHashLockUnlock(preimage), NewHashLock(Hash(preimage)), nil},
+		{"Hash lock should not be unlocked by another preimage",
+			NewHashLockUnlock([]byte("guess")), NewHashLock(Hash(preimage)), ErrScriptFailed},
+		{"Hash lock should not be unlocked by the hash itself",
+			NewHashLockUnlock(Hash(preimage)), NewHashLock(Hash(preimage)), ErrScriptFailed},
+		{"Multisig should be unlocked by enough signatures of its keys",
+			NewMultisigUnlock([][]byte{signature, otherSignature}), NewMultisig(2, [][]byte{publicKey, otherPublicKey}), nil},
+		{"Multisig should not be unlocked by signatures of other keys",
+			NewMultisigUnlock([][]byte{otherSignature}), NewMultisig(1, [][]byte{publicKey}), ErrScriptFailed},
+		{"HTLC should be claimed by the recipient with the preimage",
+			NewHTLCClaim(signature, preimage), htlc, nil},
+		{"HTLC should not be claimed with another preimage",
+			NewHTLCClaim(signature, []byte("guess")), htlc, ErrVerifyFailed},
+		{"HTLC should not be claimed by the sender",
+			NewHTLCClaim(otherSignature, preimage), htlc, ErrScriptFailed},
+		{"HTLC should be refunded to the sender from the lock time",
+			NewHTLCRefund(otherSignature), htlc, nil},
+		{"HTLC should not be refunded to the recipient",
+			NewHTLCRefund(signature), htlc, ErrScriptFailed},
+		{"HTLC should not be refunded before the lock time",
+			NewHTLCRefund(otherSignature), NewHTLC(Hash(preimage), publicKey, 101, otherPublicKey), ErrLockTime},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := Verify(tc.unlocking, tc.locking, checker); err != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	publicKey := bytes.Repeat([]byte{1}, PubKeySize)
+	hash := bytes.Repeat([]byte{2}, HashSize)
+	tooManyKeys := [][]byte{}
+	for i := 0; i <= MaxMultisigKeys; i++ {
+		tooManyKeys = append(tooManyKeys, publicKey)
+	}
+	type test struct {
+		name     string
+		script   Script
+		expected string
+	}
+	tests := []test{
+		{"Pay-to-pubkey", NewPayToPubKey(publicKey), PayToPubKey},
+		{"Pay-to-pubkey-hash", NewPayToPubKeyHash(hash), PayToPubKeyHash},
+		{"Hash lock", NewHashLock(hash), HashLock},
+		{"Empty script", Script{}, NonStandard},
+		{"Public key of the wrong size", NewPayToPubKey(publicKey[1:]), NonStandard},
+		{"Hash of the wrong size", NewPayToPubKeyHash(publicKey), NonStandard},
+		{"Extra opcode", NewHashLock(hash).AddOp(OpVerify), NonStandard},
+		{"Different opcode", Script{}.AddOp(OpSHA256).AddData(hash).AddOp(OpEqualVerify), NonStandard},
+		{"Push of the right size with a longer opcode", append(Script{byte(OpPushData1), byte(PubKeySize)}, publicKey...).AddOp(OpCheckSig), NonStandard},
+		{"Invalid script", NewPayToPubKey(publicKey)[:10], NonStandard},
+		{"Multisig", NewMultisig(2, [][]byte{publicKey, publicKey, publicKey}), Multisig},
+		{"Multisig with more signatures than keys", NewMultisig(2, [][]byte{publicKey}), NonStandard},
+		{"Multisig with the wrong number of keys", NewMultisig(1, [][]byte{publicKey})[:66].AddInt(2).AddOp(OpCheckMultiSig), NonStandard},
+		{"Multisig with a key of the wrong size", NewMultisig(1, [][]byte{hash}), NonStandard},
+		{"Multisig with more than the maximum number of keys", NewMultisig(1, tooManyKeys), NonStandard},
+		{"HTLC", NewHTLC(hash, publicKey, 500, publicKey), HTLC},
+		{"HTLC with a small lock time", NewHTLC(hash, publicKey, 16, publicKey), HTLC},
+		{"HTLC with a lock time of 0", NewHTLC(hash, publicKey, 0, publicKey), NonStandard},
+		{"HTLC with a key of the wrong size", NewHTLC(hash, hash, 500, publicKey), NonStandard},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if kind := Classify(tc.script); kind != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, kind)
+			}
+		})
+	}
+}
+
+func TestParseMultisig(t *testing.T) {
+	keys := [][]byte{bytes.Repeat([]byte{1}, PubKeySize), bytes.Repeat([]byte{2}, PubKeySize)}
+	required, publicKeys, ok := ParseMultisig(NewMultisig(1, keys))
+	if !ok || required != 1 || len(publicKeys) != 2 || !bytes.Equal(publicKeys[1], keys[1]) {
+		t.Errorf("Expected 1 of the keys, got %d of %d (%t)", required, len(publicKeys), ok)
+	}
+	if _, _, ok := ParseMultisig(NewPayToPubKey(keys[0])); ok {
+		t.Error("Expected pay-to-pubkey not to be a multisig script")
+	}
+}
+
+func TestParseHTLC(t *testing.T) {
+	hash := bytes.Repeat([]byte{1}, HashSize)
+	recipient, sender := bytes.Repeat([]byte{2}, PubKeySize), bytes.Repeat([]byte{3}, PubKeySize)
+	for _, lockTime := range []int{1, 16, 17, 500000, 1700000000} {
+		parsedHash, parsedRecipient, parsedLockTime, parsedSender, ok := ParseHTLC(NewHTLC(hash, recipient, lockTime, sender))
+		if !ok || !bytes.Equal(parsedHash, hash) || !bytes.Equal(parsedRecipient, recipient) ||
+			parsedLockTime != lockTime || !bytes.Equal(parsedSender, sender) {
+			t.Errorf("Expected to parse back the HTLC with lock time %d, got lock time %d (%t)", lockTime, parsedLockTime, ok)
+		}
+	}
+	if _, _, _, _, ok := ParseHTLC(NewHashLock(hash)); ok {
+		t.Error("Expected a hash lock not to be an HTLC")
+	}
+	t.Run("Claims should reveal their preimage", func(t *testing.T) {
+		signature := bytes.Repeat([]byte{4}, 64)
+		if preimage, ok := HTLCPreimage(NewHTLCClaim(signature, []byte("secret"))); !ok || string(preimage) != "secret" {
+			t.Errorf("Expected %q, got %q (%t)", "secret", preimage, ok)
+		}
+		if preimage, ok := HTLCPreimage(Script{}.AddData(signature).AddOp(Op1 + 4).AddOp(Op1)); !ok || !bytes.Equal(preimage, []byte{5}) {
+			t.Errorf("Expected the number pushed by OP_5, got %v (%t)", preimage, ok)
+		}
+		if _, ok := HTLCPreimage(NewHTLCRefund(signature)); ok {
+			t.Error("Expected a refund not to reveal a preimage")
+		}
+	})
+}
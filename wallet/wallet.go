@@ -95,12 +95,16 @@ func keyToAddress(k *ecdsa.PrivateKey) string {
 	// Note that since PublicKey is an embedded struct in PrivateKey,
 	// all its fields (X and Y) are "promoted" to PrivateKey, making
 	// them directly accessible.
-	return encodeBigInts(k.X.Bytes(), k.Y.Bytes())
+	return encodeBigInts(k.X, k.Y)
 }
 
-// Encodes big ints (r/s for signature or x/y for public key) into hex string
-func encodeBigInts(a, b []byte) string {
-	return fmt.Sprintf("%x", append(a, b...))
+// Encodes big ints (r/s for signature or x/y for public key) into hex string.
+// Each int is padded to 32 bytes, or ints with leading zero bytes would be split wrongly.
+func encodeBigInts(a, b *big.Int) string {
+	bytes := make([]byte, 64)
+	a.FillBytes(bytes[:32])
+	b.FillBytes(bytes[32:])
+	return fmt.Sprintf("%x", bytes)
 }
 
 // Restore two big ints (either r/s for signature or x/y for public key)
@@ -132,17 +136,24 @@ func Sign(hash string, w *wallet) string {
 	utils.ErrorHandler(err)
 	r, s, err := ecdsa.Sign(rand.Reader, w.privateKey, hashBytes)
 	utils.ErrorHandler(err)
-	return encodeBigInts(r.Bytes(), s.Bytes())
+	return encodeBigInts(r, s)
 }
 
 // Verify a hash (transaction) has been signed by the private key (wallet) associated w/ address
+// (malformed input from peers is treated as an invalid signature instead of panicking)
 func Verify(hash, signature, address string) bool {
 	hashBytes, err := hex.DecodeString(hash)
-	utils.ErrorHandler(err)
+	if err != nil {
+		return false
+	}
 	r, s, err := restoreBigInts(signature)
-	utils.ErrorHandler(err)
+	if err != nil {
+		return false
+	}
 	x, y, err := restoreBigInts(address)
-	utils.ErrorHandler(err)
+	if err != nil {
+		return false
+	}
 	publicKey := ecdsa.PublicKey{
 		Curve: elliptic.P256(),
 		X:     x,
@@ -3,6 +3,7 @@ package wallet
 import (
 	"crypto/x509"
 	"encoding/hex"
+	"math/big"
 	"reflect"
 	"testing"
 )
@@ -90,6 +91,33 @@ func TestVerify(t *testing.T) {
 	}
 }
 
+func TestVerifyMalformedInput(t *testing.T) {
+	w := makeTestWallet()
+	type test struct {
+		hash      string
+		signature string
+		address   string
+	}
+	tests := []test{
+		{"xx", testSignature, w.Address},
+		{testHash, "xx", w.Address},
+		{testHash, testSignature, "xx"},
+	}
+	for _, tc := range tests {
+		if Verify(tc.hash, tc.signature, tc.address) {
+			t.Error("Verify() should return false for non-hexadecimal input")
+		}
+	}
+}
+
+func TestEncodeBigInts(t *testing.T) {
+	a, b := big.NewInt(1), big.NewInt(2) // far less than 32 bytes each
+	restoredA, restoredB, _ := restoreBigInts(encodeBigInts(a, b))
+	if restoredA.Cmp(a) != 0 || restoredB.Cmp(b) != 0 {
+		t.Errorf("Expected (%s, %s) to be restored, got (%s, %s)", a, b, restoredA, restoredB)
+	}
+}
+
 func TestRestoreBigInts(t *testing.T) {
 	_, _, err := restoreBigInts("xx") // not a hex encoding
 	if err == nil {
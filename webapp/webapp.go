@@ -3,6 +3,7 @@ package webapp
 import (
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
 	"text/template"
 
@@ -16,12 +17,14 @@ var templates *template.Template
 // need uppercase fields to be able to access in template
 type tempData struct {
 	PageTitle string
+	ChainWork *big.Int
 	Blocks    []*blockchain.Block
 }
 
 // basic handler for route
 func home(rw http.ResponseWriter, r *http.Request) {
-	data := tempData{"GPCoin Blockchain", blockchain.Blocks(blockchain.Blockchain())}
+	bc := blockchain.Blockchain()
+	data := tempData{"GPCoin Blockchain", blockchain.ChainWork(bc), blockchain.Blocks(bc)}
 	templates.ExecuteTemplate(rw, "home", data)
 }
 